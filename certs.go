@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/innovia/portal/server/pki"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const certsUsage = `usage: portal certs <command> [flags]
+
+commands:
+  init-ca       create a self-signed CA, ca_cert.pem and ca_key.pem
+  issue-server  issue a server certificate signed by the CA, server.crt and server.key
+  issue-client  issue a client certificate signed by the CA, <name>.crt and <name>.key
+
+run portal certs <command> -h for the flags of a command
+`
+
+// stringsFlag is a flag that can be repeated or set to a comma separated list
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*s = append(*s, v)
+		}
+	}
+	return nil
+}
+
+// runCerts runs the certs subcommands that create the CA, server and client certificates
+func runCerts(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, certsUsage)
+		return errors.New("missing certs command")
+	}
+
+	command := args[0]
+	fs := flag.NewFlagSet("portal certs "+command, flag.ContinueOnError)
+	var outDir, caCertFile, caKeyFile, keyType, commonName, name string
+	var validity time.Duration
+	var overwrite bool
+	var organizations, units, dnsNames, ips, uris stringsFlag
+	fs.StringVar(&outDir, "out", "./certs", "directory the PEM files are written to")
+	fs.StringVar(&keyType, "key_type", pki.KeyTypeECDSA, "private key type, ecdsa (P-256) or ed25519")
+	fs.BoolVar(&overwrite, "force", false, "overwrite existing files")
+	fs.Var(&organizations, "o", "organization of the subject, can be repeated")
+	fs.Var(&units, "ou", "organizational unit of the subject, can be repeated")
+
+	switch command {
+	case "init-ca":
+		fs.StringVar(&commonName, "cn", "Portal CA", "common name of the CA")
+		fs.DurationVar(&validity, "validity", pki.DefaultCAValidity, "validity of the CA certificate")
+	case "issue-server":
+		fs.StringVar(&commonName, "cn", "", "common name of the server certificate, defaults to the first DNS name")
+		fs.Var(&dnsNames, "dns", "DNS name SAN, can be repeated")
+		fs.Var(&ips, "ip", "IP address SAN, can be repeated")
+		fs.DurationVar(&validity, "validity", pki.DefaultCertificateValidity, "validity of the certificate")
+	case "issue-client":
+		fs.StringVar(&commonName, "cn", "", "common name of the client certificate, the identity used by authorization")
+		fs.StringVar(&name, "name", "", "file name of the certificate and key without extension, defaults to the common name")
+		fs.Var(&uris, "uri", "URI SAN, e.g. spiffe://cluster.local/ns/ci/sa/deployer, can be repeated")
+		fs.DurationVar(&validity, "validity", pki.DefaultCertificateValidity, "validity of the certificate")
+	default:
+		fmt.Fprint(os.Stderr, certsUsage)
+		return fmt.Errorf("unknown certs command %q", command)
+	}
+	if command != "init-ca" {
+		fs.StringVar(&caCertFile, "ca_cert", "", "CA certificate, defaults to ca_cert.pem in the out directory")
+		fs.StringVar(&caKeyFile, "ca_key", "", "CA private key, defaults to ca_key.pem in the out directory")
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	opts := pki.Options{
+		KeyType:             keyType,
+		Validity:            validity,
+		CommonName:          commonName,
+		Organization:        organizations,
+		OrganizationalUnits: units,
+		DNSNames:            dnsNames,
+	}
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return fmt.Errorf("invalid IP address %q", ip)
+		}
+		opts.IPAddresses = append(opts.IPAddresses, parsed)
+	}
+	for _, uri := range uris {
+		parsed, err := url.Parse(uri)
+		if err != nil || parsed.Scheme == "" {
+			return fmt.Errorf("invalid URI %q", uri)
+		}
+		opts.URIs = append(opts.URIs, parsed)
+	}
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return fmt.Errorf("error creating %s: %v", outDir, err)
+	}
+	if command == "init-ca" {
+		ca, err := pki.NewCA(opts)
+		if err != nil {
+			return err
+		}
+		return writeKeyPair(ca, outDir, "ca_cert.pem", "ca_key.pem", overwrite)
+	}
+
+	if caCertFile == "" {
+		caCertFile = filepath.Join(outDir, "ca_cert.pem")
+	}
+	if caKeyFile == "" {
+		caKeyFile = filepath.Join(outDir, "ca_key.pem")
+	}
+	ca, err := pki.LoadKeyPair(caCertFile, caKeyFile)
+	if err != nil {
+		return err
+	}
+
+	if command == "issue-server" {
+		if len(dnsNames) == 0 && len(ips) == 0 {
+			opts.DNSNames = []string{"localhost"}
+		}
+		server, err := pki.IssueServer(ca, opts)
+		if err != nil {
+			return err
+		}
+		return writeKeyPair(server, outDir, "server.crt", "server.key", overwrite)
+	}
+
+	// the file name defaults to the common name which may hold any character
+	if name == "" {
+		name = commonName
+	}
+	if strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return fmt.Errorf("invalid file name %q, the name must not contain path separators or .., set it with -name", name)
+	}
+	client, err := pki.IssueClient(ca, opts)
+	if err != nil {
+		return err
+	}
+	return writeKeyPair(client, outDir, name+".crt", name+".key", overwrite)
+}
+
+// writeKeyPair writes the certificate and key files to dir and prints their paths
+func writeKeyPair(keyPair *pki.KeyPair, dir, certName, keyName string, overwrite bool) error {
+	certFile, keyFile := filepath.Join(dir, certName), filepath.Join(dir, keyName)
+	if err := keyPair.WriteFiles(certFile, keyFile, overwrite); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s and %s, CN=%s serial %s valid until %s\n", certFile, keyFile,
+		keyPair.Certificate.Subject.CommonName, keyPair.Certificate.SerialNumber, keyPair.Certificate.NotAfter.Format(time.RFC3339))
+	return nil
+}
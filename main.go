@@ -2,16 +2,19 @@ package main
 
 import (
   "context"
-  "crypto/tls"
-  "crypto/x509"
   "errors"
   "flag"
   "fmt"
   "github.com/innovia/portal/server"
+  "github.com/innovia/portal/server/audit"
+  "github.com/innovia/portal/server/authz"
   "github.com/innovia/portal/server/signals"
+  "k8s.io/client-go/informers"
   "k8s.io/klog/v2"
   "net/http"
   "os"
+  "strings"
+  "time"
 )
 
 func main() {
@@ -23,7 +26,7 @@ func main() {
 }
 
 // startServer
-func startServer(ctx context.Context, client *server.KubernetesClient, stopCh <-chan struct{}, healthAddress, listenAddress, caCertFile, tlsCertFile, tlsPrivateKeyFile string) {
+func startServer(ctx context.Context, client *server.KubernetesClient, stopCh <-chan struct{}, healthAddress, listenAddress string, certificates *server.CertificateReloader, tlsReloadInterval time.Duration) {
   routerApiHandler, err := server.ApiHandler(client)
   if err != nil {
     klog.Errorf("error getting API handler: %v", err)
@@ -34,28 +37,19 @@ func startServer(ctx context.Context, client *server.KubernetesClient, stopCh <-
     klog.Errorf("error getting healthcheck API handler %v", err)
   }
 
-  // Create a CA certificate pool and add cert.pem to it
-  caCert, err := os.ReadFile(caCertFile)
-  if err != nil {
-    klog.Errorf("error reading Root CA cert file %s: %v", caCertFile, err)
-  }
-  certPool := x509.NewCertPool()
-  certPool.AppendCertsFromPEM(caCert)
+  // the server keypair and the client CA pool are reloaded when their files change
+  go certificates.Run(tlsReloadInterval, stopCh)
 
   // Create a Server instance to listen on main port with the TLS config
   srv := &http.Server{
-    Addr: listenAddress,
-    TLSConfig: &tls.Config{
-      ClientAuth: tls.RequireAndVerifyClientCert,
-      ClientCAs:  certPool,
-      MinVersion: tls.VersionTLS12,
-    },
-    Handler: routerApiHandler,
+    Addr:      listenAddress,
+    TLSConfig: certificates.TLSConfig(),
+    Handler:   routerApiHandler,
   }
   klog.Infof("Server started and listening on https://%s", listenAddress)
 
   go func() {
-    if err = srv.ListenAndServeTLS(tlsCertFile, tlsPrivateKeyFile); err != nil {
+    if err = srv.ListenAndServeTLS("", ""); err != nil {
       klog.Error(err)
     }
   }()
@@ -87,18 +81,50 @@ func startServer(ctx context.Context, client *server.KubernetesClient, stopCh <-
 }
 
 func run(args []string) error {
+  if len(args) > 1 && args[1] == "certs" {
+    return runCerts(args[2:])
+  }
+
   // set up signals, so we handle the first shutdown signal gracefully
   stopCh := signals.SetupSignalHandler()
   ctx := context.Background()
-  var caCertFile, kubeconfig, masterURL, tlsPrivateKeyFile, tlsCertFile, listenAddress, healthAddress string
+  var caCertFile, kubeconfig, masterURL, tlsPrivateKeyFile, tlsCertFile, listenAddress, healthAddress, leaseName, stateBackend, reconcileResources, authorizationMode, authorizationPolicyFile, authorizationPolicyConfigMap, crlFile, ocspMode, ocspResponder, auditLogPath, auditWebhookURL string
+  var leaderElect, migrateConfigMapState bool
+  var leaseDuration, renewDeadline, retryPeriod, authorizationCacheTTL, tlsReloadInterval, ocspTimeout, auditWebhookTimeout time.Duration
+  var reconcileWorkers, auditLogMaxBackups, historyLimit int
+  var auditLogMaxSizeMB int64
 
   flag.StringVar(&tlsPrivateKeyFile, "tls_private_key_file", "", "path to server private key")
   flag.StringVar(&caCertFile, "ca_cert_file", "", "path to ca root certificate")
   flag.StringVar(&tlsCertFile, "tls_cert_file", "", "path to server certificate")
+  flag.DurationVar(&tlsReloadInterval, "tls_reload_interval", server.DefaultTLSReloadInterval, "interval the certificate, private key and ca files are checked for changes and reloaded")
+  flag.StringVar(&crlFile, "crl_file", "", "path to a PEM or DER CRL of the client CA, revoked client certificates are rejected and the file is reloaded on change")
+  flag.StringVar(&ocspMode, "ocsp_mode", server.OCSPModeOff, "OCSP check of client certificates, off, soft (reject revoked) or hard (also reject unknown status and unreachable responders)")
+  flag.StringVar(&ocspResponder, "ocsp_responder_url", "", "OCSP responder URL, defaults to the OCSP server of the client certificate")
+  flag.DurationVar(&ocspTimeout, "ocsp_timeout", server.DefaultOCSPTimeout, "timeout of OCSP responder requests")
   flag.StringVar(&listenAddress, "listen_address", ":8443", "server port")
   flag.StringVar(&healthAddress, "health_address", ":8080", "health check port")
   flag.StringVar(&kubeconfig, "kubeconfig", kubeconfig, "Full path to a kubeconfig. Only required if out-of-cluster.")
   flag.StringVar(&masterURL, "master", "", "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
+  flag.StringVar(&stateBackend, "state_backend", server.StateBackendConfigMap, "state backend for desired replicas, one of configmap, memory or crd")
+  flag.BoolVar(&migrateConfigMapState, "migrate_configmap_state", false, "on startup create a ReplicaPolicy for every deployment in the state configmap, requires --state_backend=crd")
+  flag.IntVar(&historyLimit, "history_limit", server.DefaultHistoryLimit, "number of replicas changes kept in the history of every workload")
+  flag.IntVar(&reconcileWorkers, "reconcile_workers", server.DefaultReconcileWorkers, "number of workers processing the reconcile queue")
+  flag.StringVar(&reconcileResources, "reconcile_resources", "", "comma separated <resource>.<group> custom resources with a scale subresource to reconcile in addition to deployments and statefulsets, e.g. rollouts.argoproj.io")
+  flag.StringVar(&authorizationMode, "authorization_mode", server.AuthorizationModeNone, "API authorization mode by client certificate identity, one of none, policy or sar (kubernetes SubjectAccessReview on the scale subresource)")
+  flag.StringVar(&authorizationPolicyFile, "authorization_policy_file", "", "path to the YAML authorization policy file, requires --authorization_mode=policy")
+  flag.StringVar(&authorizationPolicyConfigMap, "authorization_policy_configmap", "", "name of the configmap in the server namespace with the authorization policies in its policies.yaml key, used when --authorization_policy_file is not set")
+  flag.DurationVar(&authorizationCacheTTL, "authorization_cache_ttl", authz.DefaultSubjectAccessReviewCacheTTL, "duration SubjectAccessReview decisions are cached, requires --authorization_mode=sar")
+  flag.StringVar(&auditLogPath, "audit_log_path", "", "file the audit records of mutating API requests are written to, - for stdout, audit logging to a file is disabled when empty")
+  flag.Int64Var(&auditLogMaxSizeMB, "audit_log_max_size_mb", audit.DefaultMaxSize/1024/1024, "size in megabytes the audit log file is rotated at")
+  flag.IntVar(&auditLogMaxBackups, "audit_log_max_backups", audit.DefaultMaxBackups, "number of rotated audit log files to keep")
+  flag.StringVar(&auditWebhookURL, "audit_webhook_url", "", "URL every audit record is posted to as JSON, e.g. a local log collector")
+  flag.DurationVar(&auditWebhookTimeout, "audit_webhook_timeout", audit.DefaultWebhookTimeout, "timeout of audit webhook requests")
+  flag.BoolVar(&leaderElect, "leader_elect", true, "Run the reconcile loop only on the replica holding the leader election lease.")
+  flag.StringVar(&leaseName, "leader_election_lease_name", server.LeaderElectionLeaseName, "name of the lease object used for leader election")
+  flag.DurationVar(&leaseDuration, "leader_election_lease_duration", server.LeaderElectionLeaseDuration, "duration non-leader replicas wait before trying to acquire the lease")
+  flag.DurationVar(&renewDeadline, "leader_election_renew_deadline", server.LeaderElectionRenewDeadline, "duration the leader retries refreshing the lease before giving up leadership")
+  flag.DurationVar(&retryPeriod, "leader_election_retry_period", server.LeaderElectionRetryPeriod, "duration between leader election actions")
 
   flag.Parse()
 
@@ -106,15 +132,110 @@ func run(args []string) error {
     return errors.New("--tls_cert_file or --tls_private_key_file or --ca_cert_file flags are missing")
   }
 
+  certificates, err := server.NewCertificateReloader(tlsCertFile, tlsPrivateKeyFile, caCertFile)
+  if err != nil {
+    return err
+  }
+  if crlFile != "" || ocspMode != server.OCSPModeOff {
+    certificates.Revocation, err = server.NewRevocationChecker(crlFile, ocspMode, ocspResponder, ocspTimeout)
+    if err != nil {
+      return err
+    }
+  }
+
   client, err := server.NewClient(kubeconfig)
   if err != nil {
     return err
   }
 
-  // Start reconcile loop
-  go client.StartReconcileLoop(ctx, stopCh)
+  client.Certificates = certificates
+
+  // events on reconciled workloads are flushed on shutdown
+  recorder, stopEvents := server.NewEventRecorder(client.Clientset)
+  defer stopEvents()
+  client.Recorder = recorder
+
+  client.ReconcileWorkers = reconcileWorkers
+  client.HistoryLimit = historyLimit
+  for _, resource := range strings.Split(reconcileResources, ",") {
+    if resource = strings.TrimSpace(resource); resource == "" {
+      continue
+    }
+    normalized, err := server.NormalizeResource(resource)
+    if err != nil {
+      return err
+    }
+    if normalized != "" && normalized != server.ResourceStatefulSets {
+      client.ReconcileResources = append(client.ReconcileResources, normalized)
+    }
+  }
+  client.Authorizer, err = server.NewAuthorizer(ctx, authorizationMode, authorizationPolicyFile, authorizationPolicyConfigMap, authorizationCacheTTL, client)
+  if err != nil {
+    return err
+  }
+  client.Audit, err = server.NewAuditLogger(auditLogPath, auditLogMaxSizeMB*1024*1024, auditLogMaxBackups, auditWebhookURL, auditWebhookTimeout)
+  if err != nil {
+    return err
+  }
+  if client.Audit != nil {
+    defer client.Audit.Close()
+  }
+  client.State, err = server.NewStateStore(stateBackend, client)
+  if err != nil {
+    return err
+  }
+
+  // rewrite state configmap keys from older schema versions in place
+  if configMapState, ok := client.State.(*server.ConfigMapStateStore); ok {
+    if _, err = configMapState.Migrate(ctx); err != nil {
+      return err
+    }
+  }
+
+  if migrateConfigMapState {
+    crdState, ok := client.State.(*server.CRDStateStore)
+    if !ok {
+      return errors.New("--migrate_configmap_state requires --state_backend=crd")
+    }
+    if _, err = crdState.MigrateFromConfigMap(ctx, &server.ConfigMapStateStore{Client: client}); err != nil {
+      return err
+    }
+  }
+
+  // the informer factory is shared by the API read routes and the reconcile loop
+  client.InformerFactory = informers.NewSharedInformerFactory(client.Clientset, 0)
+  client.StartSharedInformers(stopCh)
+
+  // Start reconcile loop, with leader election only the lease holder reconciles while all replicas serve the API
+  reconcileDone := make(chan struct{})
+  if leaderElect {
+    client.LeaderElection, err = server.NewLeaderElection(leaseName, client.Namespace)
+    if err != nil {
+      return err
+    }
+    client.LeaderElection.LeaseDuration = leaseDuration
+    client.LeaderElection.RenewDeadline = renewDeadline
+    client.LeaderElection.RetryPeriod = retryPeriod
+
+    go func() {
+      defer close(reconcileDone)
+      err := client.RunLeaderElection(ctx, stopCh, func(ctx context.Context) {
+        client.StartReconcileLoop(ctx, ctx.Done())
+      })
+      if err != nil {
+        klog.Errorf("leader election failed: %v", err)
+      }
+    }()
+  } else {
+    go func() {
+      defer close(reconcileDone)
+      client.StartReconcileLoop(ctx, stopCh)
+    }()
+  }
 
-  startServer(ctx, client, stopCh, healthAddress, listenAddress, caCertFile, tlsCertFile, tlsPrivateKeyFile)
+  startServer(ctx, client, stopCh, healthAddress, listenAddress, certificates, tlsReloadInterval)
 
+  // wait for the lease to be released so that another replica can take over right away
+  <-reconcileDone
   return nil
 }
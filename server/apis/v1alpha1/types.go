@@ -0,0 +1,87 @@
+// Package v1alpha1 contains the portal.innovia.io/v1alpha1 API types
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// API group and version of the portal custom resources
+const (
+	GroupName = "portal.innovia.io"
+	Version   = "v1alpha1"
+)
+
+// ReplicaPolicy kind and resource names
+const (
+	ReplicaPolicyKind     = "ReplicaPolicy"
+	ReplicaPolicyListKind = "ReplicaPolicyList"
+)
+
+// condition types and reasons set on the ReplicaPolicy status by the reconcile loop
+const (
+	ConditionReconciled = "Reconciled"
+
+	ReasonInSync          = "InSync"
+	ReasonDriftReconciled = "DriftReconciled"
+	ReasonReconcileFailed = "ReconcileFailed"
+	ReasonPaused          = "Paused"
+)
+
+// SchemeGroupVersion is the group version of the portal custom resources
+var SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: Version}
+
+// ReplicaPolicyResource is the group version resource of the ReplicaPolicy custom resource
+var ReplicaPolicyResource = SchemeGroupVersion.WithResource("replicapolicies")
+
+// ReplicaPolicy holds the desired replicas of a single workload, the policy has the same namespace as the workload,
+// a deployment policy has the same name as the deployment and any other workload policy is named <name>.<resource>
+type ReplicaPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ReplicaPolicySpec   `json:"spec"`
+	Status ReplicaPolicyStatus `json:"status,omitempty"`
+}
+
+// ReplicaPolicySpec is the desired replicas of a workload
+type ReplicaPolicySpec struct {
+	Resource  string      `json:"resource,omitempty"` // Resource is empty for deployments, statefulsets or <resource>.<group> otherwise
+	Replicas  int32       `json:"replicas"`
+	Reconcile bool        `json:"reconcile"`
+	Paused    bool        `json:"paused,omitempty"` // Paused stops reconciling while keeping the desired replicas
+	Time      metav1.Time `json:"time"`             // Time is the time when the request was submitted.
+	// History is the bounded history of the replicas changes, oldest first
+	History []ReplicaPolicyHistoryEntry `json:"history,omitempty"`
+	// Expiry is the time the pin ends
+	Expiry *metav1.Time `json:"expiry,omitempty"`
+}
+
+// ReplicaPolicyHistoryEntry is a replicas change of a workload
+type ReplicaPolicyHistoryEntry struct {
+	Revision int64       `json:"revision"`
+	Time     metav1.Time `json:"time"`
+	Actor    string      `json:"actor,omitempty"`
+	Source   string      `json:"source"` // Source is api, reconcile or rollback
+	Reason   string      `json:"reason,omitempty"`
+	From     int32       `json:"from"`
+	To       int32       `json:"to"`
+}
+
+// ReplicaPolicyStatus is written back by the reconcile loop
+type ReplicaPolicyStatus struct {
+	Conditions        []metav1.Condition `json:"conditions,omitempty"`
+	LastReconcileTime *metav1.Time       `json:"lastReconcileTime,omitempty"`
+	// DriftSince, ReconcileFailures and LastReconcileError track a drift the reconcile loop has not fixed yet
+	DriftSince         *metav1.Time `json:"driftSince,omitempty"`
+	ReconcileFailures  int          `json:"reconcileFailures,omitempty"`
+	LastReconcileError string       `json:"lastReconcileError,omitempty"`
+}
+
+// ReplicaPolicyList is a list of ReplicaPolicy objects
+type ReplicaPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []ReplicaPolicy `json:"items"`
+}
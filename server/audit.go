@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gorilla/mux"
+	"github.com/innovia/portal/server/audit"
+	"github.com/innovia/portal/server/authz"
+	"github.com/innovia/portal/server/models"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// RequestIDHeader carries the request ID of audited requests, a request ID sent by the client is kept when it is
+// at most MaxRequestIDLength letters, digits, dots, dashes, underscores or colons
+const RequestIDHeader = "X-Request-ID"
+
+// MaxRequestIDLength is the length limit of a request ID sent by the client
+const MaxRequestIDLength = 128
+
+// AuditLogStdout is the audit log path that writes records to stdout
+const AuditLogStdout = "-"
+
+// NewAuditLogger returns the audit logger of the configured sinks, logPath is a file rotated at maxSize bytes
+// keeping maxBackups files or "-" for stdout and webhookURL receives every record as a JSON POST.
+// nil is returned when no sink is configured
+func NewAuditLogger(logPath string, maxSize int64, maxBackups int, webhookURL string, webhookTimeout time.Duration) (*audit.Logger, error) {
+	var sinks []audit.Sink
+	switch logPath {
+	case "":
+	case AuditLogStdout:
+		sinks = append(sinks, audit.NewWriterSink("stdout", os.Stdout))
+	default:
+		sink, err := audit.NewFileSink(logPath, maxSize, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if webhookURL != "" {
+		sinks = append(sinks, audit.NewWebhookSink(webhookURL, webhookTimeout, audit.DefaultWebhookQueueSize))
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return audit.NewLogger(sinks...), nil
+}
+
+// audit is a middleware that writes an audit record of every request to a mutating route, the record carries
+// the client certificate, the outcome and the replicas and reconcile flags set by the handler
+func (h *KubernetesClient) audit(next http.Handler) http.Handler {
+	return handlerFunc(func(res http.ResponseWriter, req *http.Request) error {
+		requestID := req.Header.Get(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		res.Header().Set(RequestIDHeader, requestID)
+
+		route := mux.CurrentRoute(req)
+		if route == nil || !isMutatingRoute(route.GetName()) {
+			next.ServeHTTP(res, req)
+			return nil
+		}
+
+		vars := mux.Vars(req)
+		record := &audit.Record{
+			Time:      time.Now().UTC(),
+			RequestID: requestID,
+			Route:     route.GetName(),
+			Method:    req.Method,
+			Path:      req.URL.Path,
+			SourceIP:  sourceIP(req),
+			Namespace: vars["namespace"],
+			Resource:  vars["resource"],
+			Name:      vars["name"],
+		}
+		if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+			cert := req.TLS.VerifiedChains[0][0]
+			record.User = &audit.User{Subject: cert.Subject.String()}
+			if cert.SerialNumber != nil {
+				record.User.Serial = cert.SerialNumber.String()
+			}
+		}
+
+		next.ServeHTTP(res, req.WithContext(audit.WithRecord(req.Context(), record)))
+
+		record.Code = http.StatusOK
+		if recorder, ok := res.(*statusRecorder); ok {
+			record.Code = recorder.status
+		}
+		switch {
+		case record.Code >= 200 && record.Code < 300:
+			record.Outcome = audit.OutcomeSuccess
+		case record.Code == http.StatusForbidden:
+			record.Outcome = audit.OutcomeDenied
+		default:
+			record.Outcome = audit.OutcomeFailure
+		}
+		h.Audit.Log(record)
+		return nil
+	})
+}
+
+// auditReplicas sets the replicas before and after a scale on the audit record of the request
+func auditReplicas(ctx context.Context, oldReplicas, newReplicas int32) {
+	if record := audit.RecordFrom(ctx); record != nil {
+		record.OldReplicas, record.NewReplicas = &oldReplicas, &newReplicas
+	}
+}
+
+// auditStatus sets the reconcile and paused flags of the written status on the audit record of the request
+func auditStatus(ctx context.Context, status *models.Status) {
+	if record := audit.RecordFrom(ctx); record != nil {
+		reconcile, paused := status.Reconcile, status.Paused
+		record.Reconcile, record.Paused = &reconcile, &paused
+	}
+}
+
+// isMutatingRoute returns true for routes that scale or change the reconcile of a workload
+func isMutatingRoute(name string) bool {
+	verb, ok := routeVerbs[name]
+	return ok && verb != authz.VerbRead
+}
+
+// sourceIP returns the IP of the client connection
+func sourceIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// validRequestID returns true when a request ID sent by the client can be copied to the audit record and the response
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MaxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '-', c == '_', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random request ID
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,100 @@
+// Package audit writes a structured JSON record of every mutating API request to one or more sinks
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/innovia/portal/server/metrics"
+	"k8s.io/klog/v2"
+	"time"
+)
+
+// outcomes of an audited request
+const (
+	OutcomeSuccess = "success"
+	OutcomeDenied  = "denied"
+	OutcomeFailure = "failure"
+)
+
+// User is the client of a request taken from its verified certificate
+type User struct {
+	Subject string `json:"subject"`
+	Serial  string `json:"serial"`
+}
+
+// Record is the audit record of a request, the replicas, reconcile and paused fields are set by the handler
+// when they apply to the request
+type Record struct {
+	Time        time.Time `json:"time"`
+	RequestID   string    `json:"requestID"`
+	Route       string    `json:"route"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	User        *User     `json:"user,omitempty"`
+	SourceIP    string    `json:"sourceIP"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Resource    string    `json:"resource,omitempty"`
+	Name        string    `json:"name,omitempty"`
+	OldReplicas *int32    `json:"oldReplicas,omitempty"`
+	NewReplicas *int32    `json:"newReplicas,omitempty"`
+	Reconcile   *bool     `json:"reconcile,omitempty"`
+	Paused      *bool     `json:"paused,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	DryRun      bool      `json:"dryRun,omitempty"`
+	Outcome     string    `json:"outcome"`
+	Code        int       `json:"code"`
+}
+
+// Sink writes audit records, Close flushes pending records
+type Sink interface {
+	Name() string
+	Write(record []byte) error
+	Close() error
+}
+
+// Logger writes every record to all of its sinks, a failed sink is logged and counted and does not fail the request
+type Logger struct {
+	Sinks []Sink
+}
+
+// NewLogger returns a logger writing to the sinks
+func NewLogger(sinks ...Sink) *Logger {
+	return &Logger{Sinks: sinks}
+}
+
+// Log writes a record as a single JSON line to every sink
+func (l *Logger) Log(record *Record) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		klog.Errorf("error encoding audit record %s: %v", record.RequestID, err)
+		return
+	}
+	for _, sink := range l.Sinks {
+		if err := sink.Write(payload); err != nil {
+			klog.Errorf("error writing audit record %s to %s: %v", record.RequestID, sink.Name(), err)
+			metrics.AuditErrors.WithLabelValues(sink.Name()).Inc()
+		}
+	}
+}
+
+// Close closes every sink
+func (l *Logger) Close() {
+	for _, sink := range l.Sinks {
+		if err := sink.Close(); err != nil {
+			klog.Errorf("error closing audit sink %s: %v", sink.Name(), err)
+		}
+	}
+}
+
+type contextKey struct{}
+
+// WithRecord returns a context carrying the audit record of a request
+func WithRecord(ctx context.Context, record *Record) context.Context {
+	return context.WithValue(ctx, contextKey{}, record)
+}
+
+// RecordFrom returns the audit record of a request, nil if the request is not audited
+func RecordFrom(ctx context.Context) *Record {
+	record, _ := ctx.Value(contextKey{}).(*Record)
+	return record
+}
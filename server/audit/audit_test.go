@@ -0,0 +1,173 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	logger := NewLogger(NewWriterSink("stdout", stdout))
+	replicas := int32(3)
+	logger.Log(&Record{RequestID: "1", Route: "scale-replicas", NewReplicas: &replicas, Outcome: OutcomeSuccess, Code: http.StatusOK})
+	logger.Log(&Record{RequestID: "2", Route: "scale-replicas", Outcome: OutcomeDenied, Code: http.StatusForbidden})
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	assert.Len(t, lines, 2)
+	record := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, "1", record["requestID"])
+	assert.Equal(t, float64(3), record["newReplicas"])
+	assert.NotContains(t, record, "oldReplicas")
+	assert.Contains(t, lines[1], `"outcome":"denied"`)
+}
+
+func TestRecordContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Nil(t, RecordFrom(ctx))
+	record := &Record{RequestID: "1"}
+	assert.Same(t, record, RecordFrom(WithRecord(ctx, record)))
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	record := []byte(`{"requestID":"0123456789"}`)
+	// every file holds two records
+	sink, err := NewFileSink(path, int64(2*(len(record)+1)), 2)
+	if err != nil {
+		t.Fatalf("error creating file sink: %v", err)
+	}
+	for i := 0; i < 7; i++ {
+		assert.NoError(t, sink.Write(record))
+	}
+	assert.NoError(t, sink.Close())
+
+	testCases := []struct {
+		title, path string
+		records     int
+	}{
+		{title: "Should write to the current file", path: path, records: 1},
+		{title: "Should rotate full files", path: path + ".1", records: 2},
+		{title: "Should keep older backups", path: path + ".2", records: 2},
+	}
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			data, err := os.ReadFile(c.path)
+			assert.NoError(t, err)
+			assert.Equal(t, c.records, strings.Count(string(data), "\n"))
+		})
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "expected at most 2 backups")
+
+	// an existing file is appended to
+	sink, err = NewFileSink(path, 1024, 2)
+	if err != nil {
+		t.Fatalf("error reopening file sink: %v", err)
+	}
+	assert.NoError(t, sink.Write(record))
+	assert.NoError(t, sink.Close())
+	data, _ := os.ReadFile(path)
+	assert.Equal(t, 2, strings.Count(string(data), "\n"))
+}
+
+func TestFileSinkRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	record := []byte(`{"requestID":"0123456789"}`)
+	// a directory in place of the backup fails the rotation
+	if err := os.Mkdir(path+".1", 0700); err != nil {
+		t.Fatalf("error creating directory: %v", err)
+	}
+	sink, err := NewFileSink(path, int64(len(record)+1), 1)
+	if err != nil {
+		t.Fatalf("error creating file sink: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, sink.Write(record))
+	}
+
+	// once the rotation succeeds again the current file is rotated
+	assert.NoError(t, os.Remove(path+".1"))
+	assert.NoError(t, sink.Write(record))
+	assert.NoError(t, sink.Close())
+
+	data, err := os.ReadFile(path + ".1")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(data), "\n"))
+	data, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), "\n"))
+}
+
+func TestWebhookSink(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		received = append(received, string(body))
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL, time.Second, 10)
+	assert.NoError(t, sink.Write([]byte(`{"requestID":"1"}`)))
+	assert.NoError(t, sink.Write([]byte(`{"requestID":"2"}`)))
+	// close sends the queued records
+	assert.NoError(t, sink.Close())
+	// records written after close are dropped and a second close is a no-op
+	assert.Error(t, sink.Write([]byte(`{"requestID":"3"}`)))
+	assert.NoError(t, sink.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{`{"requestID":"1"}`, `{"requestID":"2"}`}, received)
+}
+
+func TestWebhookSinkConcurrentClose(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL, time.Second, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				sink.Write([]byte(`{}`))
+			}
+		}()
+	}
+	assert.NoError(t, sink.Close())
+	wg.Wait()
+}
+
+func TestWebhookSinkQueueFull(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL, 5*time.Second, 1)
+	// the first record is in flight and the second fills the queue
+	assert.NoError(t, sink.Write([]byte(`{}`)))
+	assert.Eventually(t, func() bool { return len(sink.queue) == 0 }, time.Second, 10*time.Millisecond)
+	assert.NoError(t, sink.Write([]byte(`{}`)))
+	assert.Error(t, sink.Write([]byte(`{}`)))
+	close(block)
+	assert.NoError(t, sink.Close())
+}
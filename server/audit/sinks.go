@@ -0,0 +1,237 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/innovia/portal/server/metrics"
+	"io"
+	"k8s.io/klog/v2"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// file sink defaults
+const (
+	DefaultMaxSize    = 100 * 1024 * 1024
+	DefaultMaxBackups = 5
+)
+
+// webhook sink defaults
+const (
+	DefaultWebhookTimeout   = 5 * time.Second
+	DefaultWebhookQueueSize = 1000
+)
+
+// WriterSink writes records as JSON lines to a writer, e.g. stdout
+type WriterSink struct {
+	name string
+	mu   sync.Mutex
+	w    io.Writer
+}
+
+// NewWriterSink returns a sink writing to w
+func NewWriterSink(name string, w io.Writer) *WriterSink {
+	return &WriterSink{name: name, w: w}
+}
+
+func (s *WriterSink) Name() string {
+	return s.name
+}
+
+func (s *WriterSink) Write(record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(append(record, '\n'))
+	return err
+}
+
+func (s *WriterSink) Close() error {
+	return nil
+}
+
+// FileSink writes records as JSON lines to a file, the file is rotated to <path>.1 when it would grow over MaxSize
+// bytes and up to MaxBackups rotated files are kept
+type FileSink struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewFileSink opens or creates the audit file at path
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	s := &FileSink{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+func (s *FileSink) Write(record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		// the file could not be opened again after a failed rotation
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	line := append(record, '\n')
+	if s.MaxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.MaxSize {
+		if err := s.rotate(); err != nil {
+			// the record is written to the current file, rotation is retried on the next write
+			klog.Errorf("audit: %v", err)
+			if s.file == nil {
+				return err
+			}
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening audit file %s: %v", s.Path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error reading audit file %s: %v", s.Path, err)
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+// rotate shifts <path>.N to <path>.N+1 dropping the oldest backup, moves the current file to <path>.1 and opens a new file,
+// when the rotation fails the file at path is opened again so records keep being written, file is nil when that fails too
+func (s *FileSink) rotate() error {
+	if err := s.shift(); err != nil {
+		if openErr := s.open(); openErr != nil {
+			s.file = nil
+			return fmt.Errorf("%v, %v", err, openErr)
+		}
+		return err
+	}
+	return s.open()
+}
+
+// shift closes the current file and moves it and its backups one backup up
+func (s *FileSink) shift() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("error closing audit file %s: %v", s.Path, err)
+	}
+	if s.MaxBackups > 0 {
+		for i := s.MaxBackups - 1; i > 0; i-- {
+			if err := os.Rename(s.backup(i), s.backup(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("error rotating audit file %s: %v", s.backup(i), err)
+			}
+		}
+		if err := os.Rename(s.Path, s.backup(1)); err != nil {
+			return fmt.Errorf("error rotating audit file %s: %v", s.Path, err)
+		}
+	} else if err := os.Remove(s.Path); err != nil {
+		return fmt.Errorf("error rotating audit file %s: %v", s.Path, err)
+	}
+	return nil
+}
+
+func (s *FileSink) backup(i int) string {
+	return fmt.Sprintf("%s.%d", s.Path, i)
+}
+
+// WebhookSink posts every record as JSON to a URL, records are queued and sent in the background so a slow collector
+// does not delay requests, records are dropped when the queue is full
+type WebhookSink struct {
+	URL        string
+	HTTPClient *http.Client
+
+	// mu guards queue against a close while records are written to it
+	mu     sync.RWMutex
+	closed bool
+	queue  chan []byte
+	done   chan struct{}
+}
+
+// NewWebhookSink returns a webhook sink and starts sending its queue
+func NewWebhookSink(url string, timeout time.Duration, queueSize int) *WebhookSink {
+	s := &WebhookSink{
+		URL:        url,
+		HTTPClient: &http.Client{Timeout: timeout},
+		queue:      make(chan []byte, queueSize),
+		done:       make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+func (s *WebhookSink) Write(record []byte) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errors.New("webhook sink is closed, dropping record")
+	}
+	select {
+	case s.queue <- record:
+		return nil
+	default:
+		return errors.New("webhook queue is full, dropping record")
+	}
+}
+
+// Close sends the queued records and stops the sink, records written after Close are dropped
+func (s *WebhookSink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	<-s.done
+	return nil
+}
+
+func (s *WebhookSink) run() {
+	defer close(s.done)
+	for record := range s.queue {
+		if err := s.send(record); err != nil {
+			klog.Errorf("error sending audit record to webhook: %v", err)
+			metrics.AuditErrors.WithLabelValues(s.Name()).Inc()
+		}
+	}
+}
+
+func (s *WebhookSink) send(record []byte) error {
+	res, err := s.HTTPClient.Post(s.URL, "application/json", bytes.NewReader(record))
+	if err != nil {
+		return fmt.Errorf("error posting to %s: %v", s.URL, err)
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", s.URL, res.Status)
+	}
+	return nil
+}
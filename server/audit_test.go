@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"github.com/innovia/portal/server/audit"
+	"github.com/innovia/portal/server/authz"
+	"github.com/innovia/portal/server/models"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditRequests(t *testing.T) {
+	int32Ptr := func(i int32) *int32 { return &i }
+	boolPtr := func(b bool) *bool { return &b }
+
+	testCases := []struct {
+		title, method, path, body, commonName string
+		expected                              *audit.Record
+	}{
+		{
+			title:      "Should audit a scale",
+			method:     http.MethodPut,
+			path:       "/api/v1/namespaces/staging/deployments/web/replicas/3",
+			commonName: "ci",
+			expected: &audit.Record{Route: routeScaleReplicas, Namespace: "staging", Resource: "deployments", Name: "web",
+				OldReplicas: int32Ptr(1), NewReplicas: int32Ptr(3), Reconcile: boolPtr(false), Paused: boolPtr(false),
+				Outcome: audit.OutcomeSuccess, Code: http.StatusOK},
+		}, {
+			title:      "Should audit a reconcile pin",
+			method:     http.MethodPut,
+			path:       "/api/v1/namespaces/staging/deployments/web/replicas/4/reconcile",
+			commonName: "ci",
+			expected: &audit.Record{Route: routeReconcileReplicas, Namespace: "staging", Resource: "deployments", Name: "web",
+				OldReplicas: int32Ptr(1), NewReplicas: int32Ptr(4), Reconcile: boolPtr(true), Paused: boolPtr(false),
+				Outcome: audit.OutcomeSuccess, Code: http.StatusOK},
+		}, {
+			title:      "Should audit a pause of a workload that is not pinned",
+			method:     http.MethodPatch,
+			path:       "/api/v1/namespaces/staging/deployments/web/reconcile",
+			body:       `{"paused": true}`,
+			commonName: "ci",
+			expected: &audit.Record{Route: routePatchReconcile, Namespace: "staging", Resource: "deployments", Name: "web",
+				Outcome: audit.OutcomeFailure, Code: http.StatusNotFound},
+		}, {
+			title:      "Should audit a failed scale",
+			method:     http.MethodPut,
+			path:       "/api/v1/namespaces/staging/deployments/missing/replicas/3",
+			commonName: "ci",
+			expected: &audit.Record{Route: routeScaleReplicas, Namespace: "staging", Resource: "deployments", Name: "missing",
+				Outcome: audit.OutcomeFailure, Code: http.StatusNotFound},
+		}, {
+			title:      "Should audit a denied request",
+			method:     http.MethodPut,
+			path:       "/api/v1/namespaces/staging/deployments/web/replicas/30",
+			commonName: "ci",
+			expected: &audit.Record{Route: routeScaleReplicas, Namespace: "staging", Resource: "deployments", Name: "web",
+				Outcome: audit.OutcomeDenied, Code: http.StatusForbidden},
+		}, {
+			title:      "Should not audit reads",
+			method:     http.MethodGet,
+			path:       "/api/v1/namespaces/staging/deployments/web",
+			commonName: "ci",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			api := newTestAPI(t)
+			replicas := int32(1)
+			createDeployment(t, api.clientSet, &replicas, "web", "staging", "nginx")
+			output := &bytes.Buffer{}
+			maxReplicas := int32(10)
+			api.client.Audit = audit.NewLogger(audit.NewWriterSink("stdout", output))
+			api.client.Authorizer = &authz.PolicyAuthorizer{Policies: []authz.Policy{{
+				Name:        "ci",
+				Subjects:    authz.Subjects{CommonNames: []string{"ci"}},
+				Namespaces:  []string{"*"},
+				Deployments: []string{"*"},
+				Verbs:       []string{"*"},
+				MaxReplicas: &maxReplicas,
+			}}}
+
+			req := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+			req.RemoteAddr = "10.0.0.1:52000"
+			req.Header.Set(RequestIDHeader, "request-1")
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: c.commonName, OrganizationalUnit: []string{"platform"}}, SerialNumber: big.NewInt(42)}
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+			res := api.serve(req)
+			assert.Equal(t, "request-1", res.Header().Get(RequestIDHeader))
+
+			if c.expected == nil {
+				assert.Empty(t, output.String())
+				return
+			}
+			record := &audit.Record{}
+			if err := json.Unmarshal(output.Bytes(), record); err != nil {
+				t.Fatalf("error parsing audit record %q: %v", output.String(), err)
+			}
+			assert.False(t, record.Time.IsZero())
+			record.Time = c.expected.Time
+			c.expected.RequestID = "request-1"
+			c.expected.Method = c.method
+			c.expected.Path = c.path
+			c.expected.SourceIP = "10.0.0.1"
+			c.expected.User = &audit.User{Subject: "CN=ci,OU=platform", Serial: "42"}
+			assert.Equal(t, c.expected, record)
+		})
+	}
+}
+
+func TestAuditRequestID(t *testing.T) {
+	testCases := []struct {
+		title, requestID string
+		kept             bool
+	}{
+		{
+			title: "Should generate a request ID when none is sent",
+		}, {
+			title:     "Should keep a valid request ID",
+			requestID: "req-1_a.b:c",
+			kept:      true,
+		}, {
+			title:     "Should replace a request ID that is too long",
+			requestID: strings.Repeat("a", MaxRequestIDLength+1),
+		}, {
+			title:     "Should replace a request ID with characters outside the safe set",
+			requestID: "req 1\"}{\"user\":\"admin",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			api := newTestAPI(t)
+			output := &bytes.Buffer{}
+			api.client.Audit = audit.NewLogger(audit.NewWriterSink("stdout", output))
+			if err := api.client.UpdateState(context.Background(), &models.Status{Deployment: models.Deployment{Name: "web", Namespace: "staging", Replicas: 2}, Reconcile: true}); err != nil {
+				t.Fatalf("error updating state: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodDelete, "/api/v1/namespaces/staging/deployments/web/reconcile", nil)
+			if c.requestID != "" {
+				req.Header.Set(RequestIDHeader, c.requestID)
+			}
+			res := api.serve(req)
+			assert.Equal(t, http.StatusOK, res.Code)
+
+			record := &audit.Record{}
+			assert.NoError(t, json.Unmarshal(output.Bytes(), record))
+			if c.kept {
+				assert.Equal(t, c.requestID, res.Header().Get(RequestIDHeader))
+			} else {
+				assert.Len(t, res.Header().Get(RequestIDHeader), 32)
+			}
+			assert.Equal(t, res.Header().Get(RequestIDHeader), record.RequestID)
+			assert.Nil(t, record.User)
+			assert.Equal(t, false, *record.Reconcile)
+		})
+	}
+}
+
+func TestNewAuditLogger(t *testing.T) {
+	testCases := []struct {
+		title, path, webhookURL string
+		sinks                   []string
+	}{
+		{title: "Should disable audit without sinks"},
+		{title: "Should write to stdout", path: AuditLogStdout, sinks: []string{"stdout"}},
+		{title: "Should write to a file", path: filepath.Join(t.TempDir(), "audit.log"), sinks: []string{"file"}},
+		{title: "Should send to a webhook", path: AuditLogStdout, webhookURL: "http://localhost:9880/audit", sinks: []string{"stdout", "webhook"}},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			logger, err := NewAuditLogger(c.path, audit.DefaultMaxSize, audit.DefaultMaxBackups, c.webhookURL, audit.DefaultWebhookTimeout)
+			assert.NoError(t, err)
+			if c.sinks == nil {
+				assert.Nil(t, logger)
+				return
+			}
+			defer logger.Close()
+			var sinks []string
+			for _, sink := range logger.Sinks {
+				sinks = append(sinks, sink.Name())
+			}
+			assert.Equal(t, c.sinks, sinks)
+		})
+	}
+
+	_, err := NewAuditLogger(filepath.Join(t.TempDir(), "missing", "audit.log"), audit.DefaultMaxSize, audit.DefaultMaxBackups, "", audit.DefaultWebhookTimeout)
+	assert.Error(t, err)
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/innovia/portal/server/authz"
+	"github.com/innovia/portal/server/models"
+	"k8s.io/klog/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// authorization modes of the API
+const (
+	AuthorizationModeNone   = "none"
+	AuthorizationModePolicy = "policy"
+	AuthorizationModeSAR    = "sar"
+)
+
+// API route names, every route is authorized with the verb of its name in routeVerbs
+const (
+	routeListState         = "list-state"
+	routeListWorkloads     = "list-workloads"
+	routeGetWorkload       = "get-workload"
+	routeDiff              = "diff"
+	routeListDiff          = "list-diff"
+	routeUnsetReconcile    = "unset-reconcile"
+	routePatchReconcile    = "patch-reconcile"
+	routeScale             = "scale"
+	routeScaleReplicas     = "scale-replicas"
+	routeReconcileReplicas = "reconcile-replicas"
+	routeHistory           = "history"
+	routeRollback          = "rollback"
+)
+
+var routeVerbs = map[string]string{
+	routeListState:         authz.VerbRead,
+	routeListWorkloads:     authz.VerbRead,
+	routeGetWorkload:       authz.VerbRead,
+	routeDiff:              authz.VerbRead,
+	routeListDiff:          authz.VerbRead,
+	routeUnsetReconcile:    authz.VerbReconcile,
+	routePatchReconcile:    authz.VerbReconcile,
+	routeScale:             authz.VerbScale,
+	routeScaleReplicas:     authz.VerbScale,
+	routeReconcileReplicas: authz.VerbReconcile,
+	routeHistory:           authz.VerbRead,
+	routeRollback:          authz.VerbScale,
+}
+
+// NewAuthorizer returns the API authorizer for mode, policies are read from policyFile or else from the
+// policyConfigMap in the client namespace. the sar mode delegates to kubernetes SubjectAccessReviews and caches
+// decisions for cacheTTL. the none mode returns a nil authorizer which allows every request
+func NewAuthorizer(ctx context.Context, mode, policyFile, policyConfigMap string, cacheTTL time.Duration, client *KubernetesClient) (authz.Authorizer, error) {
+	switch mode {
+	case AuthorizationModeNone:
+		return nil, nil
+	case AuthorizationModePolicy:
+		if policyFile != "" {
+			return authz.LoadPolicyFile(policyFile)
+		}
+		if policyConfigMap != "" {
+			return authz.LoadPolicyConfigMap(ctx, client.Clientset, client.Namespace, policyConfigMap)
+		}
+		return nil, fmt.Errorf("authorization mode %s requires a policy file or configmap", mode)
+	case AuthorizationModeSAR:
+		return authz.NewSubjectAccessReviewAuthorizer(client.Clientset.AuthorizationV1().SubjectAccessReviews(), cacheTTL), nil
+	default:
+		return nil, fmt.Errorf("unknown authorization mode %q, valid modes are %s, %s and %s", mode, AuthorizationModeNone, AuthorizationModePolicy, AuthorizationModeSAR)
+	}
+}
+
+// authorize is a middleware that authorizes the request with the identity of the verified client certificate,
+// denied requests get a 403 response
+func (h *KubernetesClient) authorize(next http.Handler) http.Handler {
+	return handlerFunc(func(res http.ResponseWriter, req *http.Request) error {
+		route := mux.CurrentRoute(req)
+		if route == nil {
+			next.ServeHTTP(res, req)
+			return nil
+		}
+		// the scale route authorizes the verb and the replicas of its body in the handler
+		if route.GetName() == routeScale {
+			next.ServeHTTP(res, req)
+			return nil
+		}
+		verb, ok := routeVerbs[route.GetName()]
+		if !ok {
+			return models.NewHTTPError(nil, http.StatusForbidden, "forbidden: unknown route")
+		}
+		if err := h.authorizeRequest(req, verb, nil); err != nil {
+			return err
+		}
+		next.ServeHTTP(res, req)
+		return nil
+	})
+}
+
+// authorizeRequest authorizes a request with verb for the identity of the verified client certificate, replicas
+// overrides the replicas of the route for handlers that resolve the replicas themselves
+func (h *KubernetesClient) authorizeRequest(req *http.Request, verb string, replicas *int32) error {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return models.NewHTTPError(nil, http.StatusForbidden, "forbidden: a verified client certificate is required")
+	}
+
+	vars := mux.Vars(req)
+	r := authz.Request{
+		Identity:  authz.IdentityFromCertificate(req.TLS.VerifiedChains[0][0]),
+		Verb:      verb,
+		Namespace: vars["namespace"],
+		Resource:  vars["resource"],
+		Name:      vars["name"],
+		Replicas:  replicas,
+	}
+	// the state routes have no resource, their statuses are authorized as deployments
+	if resource, err := NormalizeResource(vars["resource"]); err == nil {
+		groupResource := GroupResource(resource)
+		r.Group, r.Resource = groupResource.Group, groupResource.Resource
+	}
+	if value, ok := vars["replicas"]; ok && replicas == nil {
+		// invalid replicas are rejected by the handler
+		if replicas, err := strconv.ParseInt(value, 10, 32); err == nil {
+			replicas32 := int32(replicas)
+			r.Replicas = &replicas32
+		}
+	}
+
+	allowed, reason, err := h.Authorizer.Authorize(req.Context(), r)
+	if err != nil {
+		return models.NewHTTPError(err, http.StatusInternalServerError, "error authorizing request")
+	}
+	if !allowed {
+		klog.Infof("denied %s %s for %s: %s", req.Method, req.URL.Path, r.Identity, reason)
+		return models.NewHTTPError(nil, http.StatusForbidden, fmt.Sprintf("forbidden: %s", reason))
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"github.com/innovia/portal/server/authz"
+	"github.com/stretchr/testify/assert"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeRequests(t *testing.T) {
+	api := newTestAPI(t)
+	replicas := int32(1)
+	createDeployment(t, api.clientSet, &replicas, "web", "staging", "nginx")
+	maxReplicas := int32(5)
+	api.client.Authorizer = &authz.PolicyAuthorizer{Policies: []authz.Policy{{
+		Name:        "ci",
+		Subjects:    authz.Subjects{CommonNames: []string{"ci"}},
+		Namespaces:  []string{"staging"},
+		Deployments: []string{"web*"},
+		Verbs:       []string{authz.VerbRead, authz.VerbScale},
+		MaxReplicas: &maxReplicas,
+	}}}
+
+	testCases := []struct {
+		title, method, path, commonName string
+		expectedStatus                  int
+	}{
+		{title: "Should allow reading an allowed deployment", method: http.MethodGet, path: "/api/v1/namespaces/staging/deployments/web", commonName: "ci", expectedStatus: http.StatusOK},
+		{title: "Should allow listing an allowed namespace", method: http.MethodGet, path: "/api/v1/namespaces/staging/deployments", commonName: "ci", expectedStatus: http.StatusOK},
+		{title: "Should allow scaling up to max replicas", method: http.MethodPut, path: "/api/v1/namespaces/staging/deployments/web/replicas/5", commonName: "ci", expectedStatus: http.StatusOK},
+		{title: "Should deny scaling above max replicas", method: http.MethodPut, path: "/api/v1/namespaces/staging/deployments/web/replicas/6", commonName: "ci", expectedStatus: http.StatusForbidden},
+		{title: "Should deny a verb not in the policy", method: http.MethodPut, path: "/api/v1/namespaces/staging/deployments/web/replicas/2/reconcile", commonName: "ci", expectedStatus: http.StatusForbidden},
+		{title: "Should deny another namespace", method: http.MethodGet, path: "/api/v1/namespaces/prod/deployments", commonName: "ci", expectedStatus: http.StatusForbidden},
+		{title: "Should deny the state of all namespaces", method: http.MethodGet, path: "/api/v1/state", commonName: "ci", expectedStatus: http.StatusForbidden},
+		{title: "Should deny an unknown client", method: http.MethodGet, path: "/api/v1/namespaces/staging/deployments/web", commonName: "other", expectedStatus: http.StatusForbidden},
+		{title: "Should deny a request without a client certificate", method: http.MethodGet, path: "/api/v1/namespaces/staging/deployments/web", expectedStatus: http.StatusForbidden},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, c.path, nil)
+			if c.commonName != "" {
+				cert := &x509.Certificate{Subject: pkix.Name{CommonName: c.commonName}}
+				req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+			}
+			res := api.serve(req)
+			assert.Equal(t, c.expectedStatus, res.Code, fmt.Sprintf("%s %s: %s", c.method, c.path, res.Body.String()))
+		})
+	}
+}
+
+func TestNewAuthorizer(t *testing.T) {
+	ctx := context.Background()
+	client := &KubernetesClient{Clientset: newFakeClientset(&coreV1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "portal-authorization", Namespace: "default"},
+		Data:       map[string]string{authz.PolicyConfigMapKey: "policies:\n- name: ci\n  subjects:\n    commonNames: [ci]\n  namespaces: [\"*\"]\n  verbs: [read]\n"},
+	}), Namespace: "default"}
+
+	authorizer, err := NewAuthorizer(ctx, AuthorizationModeNone, "", "", 0, client)
+	assert.NoError(t, err)
+	assert.Nil(t, authorizer)
+
+	authorizer, err = NewAuthorizer(ctx, AuthorizationModePolicy, "", "portal-authorization", 0, client)
+	assert.NoError(t, err)
+	allowed, _, err := authorizer.Authorize(ctx, authz.Request{Identity: authz.Identity{CommonName: "ci"}, Verb: authz.VerbRead})
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	_, err = NewAuthorizer(ctx, AuthorizationModePolicy, "", "missing", 0, client)
+	assert.Error(t, err)
+
+	_, err = NewAuthorizer(ctx, AuthorizationModePolicy, "", "", 0, client)
+	assert.Error(t, err)
+
+	authorizer, err = NewAuthorizer(ctx, AuthorizationModeSAR, "", "", time.Second, client)
+	assert.NoError(t, err)
+	assert.IsType(t, &authz.SubjectAccessReviewAuthorizer{}, authorizer)
+
+	_, err = NewAuthorizer(ctx, "rbac", "", "", 0, client)
+	assert.Error(t, err)
+}
+
+func TestAuthorizeWithSubjectAccessReview(t *testing.T) {
+	api := newTestAPI(t)
+	var attrs []authorizationv1.ResourceAttributes
+	api.clientSet.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attrs = append(attrs, *review.Spec.ResourceAttributes)
+		review.Status.Allowed = review.Spec.User == "ci"
+		return true, review, nil
+	})
+	api.client.Authorizer, _ = NewAuthorizer(context.Background(), AuthorizationModeSAR, "", "", time.Minute, api.client)
+
+	for _, commonName := range []string{"ci", "other"} {
+		req := httptest.NewRequest(http.MethodPut, "/api/v1/namespaces/staging/statefulsets/web/replicas/3", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: commonName}}}}}
+		res := api.serve(req)
+		if commonName == "ci" {
+			// allowed requests reach the handler which does not find the statefulset
+			assert.Equal(t, http.StatusNotFound, res.Code)
+		} else {
+			assert.Equal(t, http.StatusForbidden, res.Code)
+		}
+	}
+	assert.Equal(t, []authorizationv1.ResourceAttributes{
+		{Namespace: "staging", Verb: "update", Group: "apps", Resource: "statefulsets", Subresource: "scale", Name: "web"},
+		{Namespace: "staging", Verb: "update", Group: "apps", Resource: "statefulsets", Subresource: "scale", Name: "web"},
+	}, attrs)
+}
@@ -0,0 +1,175 @@
+// Package authz authorizes API requests by the identity of the verified mTLS client certificate
+package authz
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"path"
+	"sigs.k8s.io/yaml"
+)
+
+// request verbs, read covers list, get, diff and state, scale sets replicas and reconcile pins, pauses or unpins
+const (
+	VerbRead      = "read"
+	VerbScale     = "scale"
+	VerbReconcile = "reconcile"
+)
+
+// Identity is the identity of a client taken from its verified certificate
+type Identity struct {
+	CommonName          string
+	OrganizationalUnits []string
+	URIs                []string
+}
+
+// IdentityFromCertificate returns the identity of a client certificate
+func IdentityFromCertificate(cert *x509.Certificate) Identity {
+	identity := Identity{
+		CommonName:          cert.Subject.CommonName,
+		OrganizationalUnits: cert.Subject.OrganizationalUnit,
+	}
+	for _, uri := range cert.URIs {
+		identity.URIs = append(identity.URIs, uri.String())
+	}
+	return identity
+}
+
+// String returns the identity used in logs and denial messages
+func (i Identity) String() string {
+	return fmt.Sprintf("CN=%s", i.CommonName)
+}
+
+// Request is an API request to authorize, Name is empty for list requests and Namespace is empty for
+// requests across all namespaces. Group and Resource are the API group and resource of the workload,
+// Replicas is set for requests that scale.
+type Request struct {
+	Identity  Identity
+	Verb      string
+	Namespace string
+	Group     string
+	Resource  string
+	Name      string
+	Replicas  *int32
+}
+
+// Authorizer decides if a request is allowed, reason explains a denial
+type Authorizer interface {
+	Authorize(ctx context.Context, r Request) (allowed bool, reason string, err error)
+}
+
+// Subjects are the client identities a policy applies to, every entry is a glob pattern
+// and an identity matches if any of its common name, organizational units or URI SANs matches
+type Subjects struct {
+	CommonNames         []string `json:"commonNames,omitempty"`
+	OrganizationalUnits []string `json:"organizationalUnits,omitempty"`
+	URIs                []string `json:"uris,omitempty"`
+}
+
+// Policy grants the verbs on the deployments matching the namespaces and deployments glob patterns
+// to the subjects, a scale above MaxReplicas is denied
+type Policy struct {
+	Name        string   `json:"name"`
+	Subjects    Subjects `json:"subjects"`
+	Namespaces  []string `json:"namespaces"`
+	Deployments []string `json:"deployments"`
+	Verbs       []string `json:"verbs"`
+	MaxReplicas *int32   `json:"maxReplicas,omitempty"`
+}
+
+// Policies is the policy file format
+type Policies struct {
+	Policies []Policy `json:"policies"`
+}
+
+// ParsePolicies parses a YAML or JSON policy file and validates the policies
+func ParsePolicies(data []byte) ([]Policy, error) {
+	policies := Policies{}
+	if err := yaml.UnmarshalStrict(data, &policies); err != nil {
+		return nil, fmt.Errorf("error parsing authorization policies: %v", err)
+	}
+
+	for i, p := range policies.Policies {
+		if p.Name == "" {
+			return nil, fmt.Errorf("authorization policy %d has no name", i)
+		}
+		for _, verb := range p.Verbs {
+			if verb != VerbRead && verb != VerbScale && verb != VerbReconcile && verb != "*" {
+				return nil, fmt.Errorf("authorization policy %s has unknown verb %q", p.Name, verb)
+			}
+		}
+		for _, patterns := range [][]string{p.Namespaces, p.Deployments, p.Subjects.CommonNames, p.Subjects.OrganizationalUnits, p.Subjects.URIs} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("authorization policy %s has invalid pattern %q: %v", p.Name, pattern, err)
+				}
+			}
+		}
+	}
+	return policies.Policies, nil
+}
+
+// PolicyAuthorizer allows a request if any policy of the client identity allows it
+type PolicyAuthorizer struct {
+	Policies []Policy
+}
+
+// Authorize implements Authorizer
+func (a *PolicyAuthorizer) Authorize(_ context.Context, r Request) (bool, string, error) {
+	reason := fmt.Sprintf("no policy allows %s to %s", r.Identity, r.Verb)
+	for _, p := range a.Policies {
+		if !p.Subjects.Matches(r.Identity) || !matchAny(p.Verbs, r.Verb) || !matchAny(p.Namespaces, namespaceOf(r)) {
+			continue
+		}
+		// list requests are authorized by namespace only
+		if r.Name != "" && !matchAny(p.Deployments, r.Name) {
+			continue
+		}
+		if r.Replicas != nil && p.MaxReplicas != nil && *r.Replicas > *p.MaxReplicas {
+			reason = fmt.Sprintf("policy %s allows at most %d replicas", p.Name, *p.MaxReplicas)
+			continue
+		}
+		return true, "", nil
+	}
+	return false, reason, nil
+}
+
+// Matches returns true if any of the identity attributes matches the subjects
+func (s Subjects) Matches(identity Identity) bool {
+	if identity.CommonName != "" && matchAny(s.CommonNames, identity.CommonName) {
+		return true
+	}
+	for _, ou := range identity.OrganizationalUnits {
+		if matchAny(s.OrganizationalUnits, ou) {
+			return true
+		}
+	}
+	for _, uri := range identity.URIs {
+		if matchAny(s.URIs, uri) {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceOf returns the namespace matched against policies, requests across all namespaces
+// are only allowed by a "*" namespace pattern
+func namespaceOf(r Request) string {
+	if r.Namespace == "" {
+		return "*"
+	}
+	return r.Namespace
+}
+
+// matchAny returns true if value matches any of the glob patterns
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			return true
+		}
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
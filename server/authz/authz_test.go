@@ -0,0 +1,134 @@
+package authz
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"testing"
+)
+
+const testPolicies = `
+policies:
+- name: ci
+  subjects:
+    commonNames: ["ci-*"]
+  namespaces: ["staging"]
+  deployments: ["web-*"]
+  verbs: ["read", "scale"]
+  maxReplicas: 5
+- name: platform
+  subjects:
+    organizationalUnits: ["platform"]
+    uris: ["spiffe://cluster.local/ns/ops/sa/*"]
+  namespaces: ["*"]
+  deployments: ["*"]
+  verbs: ["*"]
+`
+
+func TestParsePolicies(t *testing.T) {
+	testCases := []struct {
+		title, data string
+		expectError bool
+	}{
+		{title: "Should parse policies", data: testPolicies},
+		{title: "Should reject unknown fields", data: "policies:\n- name: a\n  verb: [read]\n", expectError: true},
+		{title: "Should reject a policy without a name", data: "policies:\n- verbs: [read]\n", expectError: true},
+		{title: "Should reject unknown verbs", data: "policies:\n- name: a\n  verbs: [delete]\n", expectError: true},
+		{title: "Should reject invalid patterns", data: "policies:\n- name: a\n  namespaces: [\"[\"]\n", expectError: true},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			_, err := ParsePolicies([]byte(c.data))
+			if c.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestPolicyAuthorizer(t *testing.T) {
+	policies, err := ParsePolicies([]byte(testPolicies))
+	if err != nil {
+		t.Fatalf("error parsing policies: %v", err)
+	}
+	authorizer := &PolicyAuthorizer{Policies: policies}
+	ci := Identity{CommonName: "ci-deployer"}
+	three, ten := int32(3), int32(10)
+
+	testCases := []struct {
+		title    string
+		request  Request
+		expected bool
+	}{
+		{
+			title:    "Should allow a matching verb, namespace and deployment",
+			request:  Request{Identity: ci, Verb: VerbScale, Namespace: "staging", Name: "web-api", Replicas: &three},
+			expected: true,
+		}, {
+			title:    "Should deny a scale above max replicas",
+			request:  Request{Identity: ci, Verb: VerbScale, Namespace: "staging", Name: "web-api", Replicas: &ten},
+			expected: false,
+		}, {
+			title:    "Should deny a verb not in the policy",
+			request:  Request{Identity: ci, Verb: VerbReconcile, Namespace: "staging", Name: "web-api", Replicas: &three},
+			expected: false,
+		}, {
+			title:    "Should deny a deployment not matching the policy",
+			request:  Request{Identity: ci, Verb: VerbRead, Namespace: "staging", Name: "db"},
+			expected: false,
+		}, {
+			title:    "Should deny another namespace",
+			request:  Request{Identity: ci, Verb: VerbRead, Namespace: "prod", Name: "web-api"},
+			expected: false,
+		}, {
+			title:    "Should allow listing an allowed namespace",
+			request:  Request{Identity: ci, Verb: VerbRead, Namespace: "staging"},
+			expected: true,
+		}, {
+			title:    "Should deny listing all namespaces without a wildcard namespace",
+			request:  Request{Identity: ci, Verb: VerbRead},
+			expected: false,
+		}, {
+			title:    "Should match organizational units",
+			request:  Request{Identity: Identity{CommonName: "alice", OrganizationalUnits: []string{"platform"}}, Verb: VerbReconcile, Namespace: "prod", Name: "db"},
+			expected: true,
+		}, {
+			title:    "Should match URI SANs",
+			request:  Request{Identity: Identity{URIs: []string{"spiffe://cluster.local/ns/ops/sa/deployer"}}, Verb: VerbRead},
+			expected: true,
+		}, {
+			title:    "Should deny unknown identities",
+			request:  Request{Identity: Identity{CommonName: "bob"}, Verb: VerbRead, Namespace: "staging"},
+			expected: false,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			allowed, reason, err := authorizer.Authorize(context.Background(), c.request)
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, allowed)
+			if !allowed {
+				assert.NotEmpty(t, reason)
+			}
+		})
+	}
+}
+
+func TestIdentityFromCertificate(t *testing.T) {
+	uri, _ := url.Parse("spiffe://cluster.local/ns/ops/sa/deployer")
+	cert := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "ci-deployer", OrganizationalUnit: []string{"ci"}},
+		URIs:    []*url.URL{uri},
+	}
+	assert.Equal(t, Identity{
+		CommonName:          "ci-deployer",
+		OrganizationalUnits: []string{"ci"},
+		URIs:                []string{"spiffe://cluster.local/ns/ops/sa/deployer"},
+	}, IdentityFromCertificate(cert))
+}
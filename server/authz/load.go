@@ -0,0 +1,42 @@
+package authz
+
+import (
+	"context"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"os"
+)
+
+// PolicyConfigMapKey is the key of the policies in the authorization policy configmap
+const PolicyConfigMapKey = "policies.yaml"
+
+// LoadPolicyFile returns a PolicyAuthorizer with the policies of a YAML or JSON file
+func LoadPolicyFile(path string) (*PolicyAuthorizer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading authorization policy file %s: %v", path, err)
+	}
+	policies, err := ParsePolicies(data)
+	if err != nil {
+		return nil, err
+	}
+	return &PolicyAuthorizer{Policies: policies}, nil
+}
+
+// LoadPolicyConfigMap returns a PolicyAuthorizer with the policies of the PolicyConfigMapKey of a configmap
+func LoadPolicyConfigMap(ctx context.Context, clientset kubernetes.Interface, namespace, name string) (*PolicyAuthorizer, error) {
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error reading authorization policy configmap %s/%s: %v", namespace, name, err)
+	}
+	data, ok := cm.Data[PolicyConfigMapKey]
+	if !ok {
+		return nil, fmt.Errorf("authorization policy configmap %s/%s has no %s key", namespace, name, PolicyConfigMapKey)
+	}
+	policies, err := ParsePolicies([]byte(data))
+	if err != nil {
+		return nil, err
+	}
+	return &PolicyAuthorizer{Policies: policies}, nil
+}
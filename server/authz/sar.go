@@ -0,0 +1,112 @@
+package authz
+
+import (
+	"context"
+	"fmt"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	authorizationclient "k8s.io/client-go/kubernetes/typed/authorization/v1"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSubjectAccessReviewCacheTTL is the default duration SubjectAccessReview decisions are cached
+const DefaultSubjectAccessReviewCacheTTL = 10 * time.Second
+
+// subjectAccessReviewVerbs are the kubernetes verbs on the scale subresource a request verb is reviewed with
+var subjectAccessReviewVerbs = map[string]string{
+	VerbRead:      "get",
+	VerbScale:     "update",
+	VerbReconcile: "update",
+}
+
+// SubjectAccessReviewAuthorizer delegates authorization to kubernetes, the client certificate CN is the user
+// and its OUs are the groups, a request is allowed if the user may access the scale subresource of the
+// workload in its namespace. decisions are cached for TTL, create it with NewSubjectAccessReviewAuthorizer
+type SubjectAccessReviewAuthorizer struct {
+	Client authorizationclient.SubjectAccessReviewInterface
+	TTL    time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedDecision
+	now   func() time.Time
+}
+
+type cachedDecision struct {
+	allowed bool
+	reason  string
+	expires time.Time
+}
+
+// NewSubjectAccessReviewAuthorizer returns a SubjectAccessReviewAuthorizer caching decisions for ttl
+func NewSubjectAccessReviewAuthorizer(client authorizationclient.SubjectAccessReviewInterface, ttl time.Duration) *SubjectAccessReviewAuthorizer {
+	return &SubjectAccessReviewAuthorizer{
+		Client: client,
+		TTL:    ttl,
+		cache:  map[string]cachedDecision{},
+		now:    time.Now,
+	}
+}
+
+// Authorize implements Authorizer
+func (a *SubjectAccessReviewAuthorizer) Authorize(ctx context.Context, r Request) (bool, string, error) {
+	verb, ok := subjectAccessReviewVerbs[r.Verb]
+	if !ok {
+		return false, fmt.Sprintf("unknown verb %s", r.Verb), nil
+	}
+	review := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   r.Identity.CommonName,
+			Groups: r.Identity.OrganizationalUnits,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   r.Namespace,
+				Verb:        verb,
+				Group:       r.Group,
+				Resource:    r.Resource,
+				Subresource: "scale",
+				Name:        r.Name,
+			},
+		},
+	}
+
+	key := reviewKey(review.Spec)
+	a.mu.Lock()
+	decision, found := a.cache[key]
+	a.mu.Unlock()
+	if found && a.now().Before(decision.expires) {
+		return decision.allowed, decision.reason, nil
+	}
+
+	result, err := a.Client.Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return false, "", fmt.Errorf("error creating subject access review: %v", err)
+	}
+	decision = cachedDecision{allowed: result.Status.Allowed, expires: a.now().Add(a.TTL)}
+	if !decision.allowed {
+		decision.reason = fmt.Sprintf("%s may not %s %s/scale in namespace %q", r.Identity, verb, r.Resource, r.Namespace)
+		if result.Status.Reason != "" {
+			decision.reason = fmt.Sprintf("%s: %s", decision.reason, result.Status.Reason)
+		}
+	}
+
+	a.mu.Lock()
+	// drop expired decisions so the cache does not grow with every identity ever seen
+	for k, d := range a.cache {
+		if !a.now().Before(d.expires) {
+			delete(a.cache, k)
+		}
+	}
+	a.cache[key] = decision
+	a.mu.Unlock()
+	return decision.allowed, decision.reason, nil
+}
+
+// reviewKey returns the cache key of a subject access review
+func reviewKey(spec authorizationv1.SubjectAccessReviewSpec) string {
+	groups := append([]string{}, spec.Groups...)
+	sort.Strings(groups)
+	attrs := spec.ResourceAttributes
+	return strings.Join([]string{spec.User, strings.Join(groups, ","), attrs.Verb, attrs.Namespace, attrs.Group, attrs.Resource, attrs.Name}, "|")
+}
@@ -0,0 +1,89 @@
+package authz
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"testing"
+	"time"
+)
+
+func TestSubjectAccessReviewAuthorizer(t *testing.T) {
+	clientSet := fake.NewSimpleClientset()
+	var reviews []authorizationv1.SubjectAccessReviewSpec
+	clientSet.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		reviews = append(reviews, review.Spec)
+		attrs := review.Spec.ResourceAttributes
+		// the deployers group may scale in staging, everyone may read
+		review.Status.Allowed = attrs.Verb == "get" ||
+			(attrs.Namespace == "staging" && len(review.Spec.Groups) > 0 && review.Spec.Groups[0] == "deployers")
+		if !review.Status.Allowed {
+			review.Status.Reason = "no RBAC policy matched"
+		}
+		return true, review, nil
+	})
+
+	now := time.Now()
+	authorizer := NewSubjectAccessReviewAuthorizer(clientSet.AuthorizationV1().SubjectAccessReviews(), time.Minute)
+	authorizer.now = func() time.Time { return now }
+	deployer := Identity{CommonName: "ci", OrganizationalUnits: []string{"deployers"}}
+
+	testCases := []struct {
+		title           string
+		request         Request
+		expected        bool
+		expectedReviews int
+	}{
+		{
+			title:           "Should review the scale subresource of the workload",
+			request:         Request{Identity: deployer, Verb: VerbScale, Namespace: "staging", Group: "apps", Resource: "deployments", Name: "web"},
+			expected:        true,
+			expectedReviews: 1,
+		}, {
+			title:           "Should cache decisions",
+			request:         Request{Identity: deployer, Verb: VerbScale, Namespace: "staging", Group: "apps", Resource: "deployments", Name: "web"},
+			expected:        true,
+			expectedReviews: 1,
+		}, {
+			title:           "Should review reconcile as an update",
+			request:         Request{Identity: deployer, Verb: VerbReconcile, Namespace: "prod", Group: "apps", Resource: "statefulsets", Name: "db"},
+			expected:        false,
+			expectedReviews: 2,
+		}, {
+			title:           "Should review read as a get",
+			request:         Request{Identity: Identity{CommonName: "viewer"}, Verb: VerbRead, Namespace: "prod", Group: "apps", Resource: "deployments"},
+			expected:        true,
+			expectedReviews: 3,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			allowed, reason, err := authorizer.Authorize(context.Background(), c.request)
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, allowed)
+			assert.Equal(t, c.expectedReviews, len(reviews))
+			if !allowed {
+				assert.Contains(t, reason, "no RBAC policy matched")
+			}
+
+			spec := reviews[len(reviews)-1]
+			assert.Equal(t, c.request.Identity.CommonName, spec.User)
+			assert.Equal(t, c.request.Namespace, spec.ResourceAttributes.Namespace)
+			assert.Equal(t, c.request.Resource, spec.ResourceAttributes.Resource)
+			assert.Equal(t, "scale", spec.ResourceAttributes.Subresource)
+		})
+	}
+
+	// decisions are reviewed again once expired
+	now = now.Add(2 * time.Minute)
+	allowed, _, err := authorizer.Authorize(context.Background(), testCases[0].request)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, 4, len(reviews))
+	assert.Equal(t, 1, len(authorizer.cache))
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/innovia/portal/server/models"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/klog/v2"
+	"net/http"
+)
+
+// ConsistentQueryParam forces a live read from the API server on the read routes served from the informer cache
+const ConsistentQueryParam = "consistent"
+
+// StartSharedInformers registers the deployment, statefulset and horizontal pod autoscaler informers of the shared
+// informer factory and starts them, the read routes are served from their cache once synced. Start is non-blocking
+func (h *KubernetesClient) StartSharedInformers(stopCh <-chan struct{}) {
+	if h.InformerFactory == nil {
+		return
+	}
+	h.InformerFactory.Apps().V1().Deployments().Informer()
+	h.InformerFactory.Apps().V1().StatefulSets().Informer()
+	h.InformerFactory.Autoscaling().V1().HorizontalPodAutoscalers().Informer()
+	h.InformerFactory.Start(stopCh)
+	klog.Info("Started shared deployment, statefulset and horizontal pod autoscaler informers")
+}
+
+// readWorkloadsForRequest returns the normalized resource and workload client of a read route, deployments and
+// statefulsets are read from the shared informer cache once it synced unless ?consistent=true asks for a live read.
+// custom resources are always read from the API server
+func (h *KubernetesClient) readWorkloadsForRequest(req *http.Request) (string, workloadClient, error) {
+	resource, workloads, err := h.workloadsForRequest(mux.Vars(req))
+	if err != nil {
+		return "", nil, err
+	}
+	workloads, err = h.readWorkloads(req, resource, workloads)
+	if err != nil {
+		return "", nil, err
+	}
+	return resource, workloads, nil
+}
+
+// readWorkloads returns the informer cache client of a deployments or statefulsets workload client
+// when the cache synced and ?consistent=true is not set, otherwise the given client
+func (h *KubernetesClient) readWorkloads(req *http.Request, resource string, workloads workloadClient) (workloadClient, error) {
+	consistent, err := boolQueryParam(req, ConsistentQueryParam)
+	if err != nil {
+		return nil, err
+	}
+	if h.InformerFactory == nil || (consistent != nil && *consistent) {
+		return workloads, nil
+	}
+
+	switch resource {
+	case "":
+		informer := h.InformerFactory.Apps().V1().Deployments()
+		if informer.Informer().HasSynced() {
+			return &cachedDeploymentWorkloads{deploymentWorkloads: workloads.(*deploymentWorkloads), lister: informer.Lister()}, nil
+		}
+	case ResourceStatefulSets:
+		informer := h.InformerFactory.Apps().V1().StatefulSets()
+		if informer.Informer().HasSynced() {
+			return &cachedStatefulSetWorkloads{statefulSetWorkloads: workloads.(*statefulSetWorkloads), lister: informer.Lister()}, nil
+		}
+	}
+	return workloads, nil
+}
+
+// cachedList returns the label selector of list options that can be served from the informer cache,
+// field selectors and pages are only supported by the API server
+func cachedList(opts metav1.ListOptions) (labels.Selector, bool) {
+	if opts.FieldSelector != "" || opts.Limit > 0 || opts.Continue != "" {
+		return nil, false
+	}
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, false
+	}
+	return selector, true
+}
+
+// cachedDeploymentWorkloads reads deployments from the informer cache, scales go to the API server
+type cachedDeploymentWorkloads struct {
+	*deploymentWorkloads
+	lister appslisters.DeploymentLister
+}
+
+func (c *cachedDeploymentWorkloads) Get(_ context.Context, namespace, name string) (*Workload, error) {
+	d, err := c.lister.Deployments(namespace).Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return deploymentWorkload(d), nil
+}
+
+func (c *cachedDeploymentWorkloads) List(ctx context.Context, namespace string, opts metav1.ListOptions) ([]Workload, string, error) {
+	selector, ok := cachedList(opts)
+	if !ok {
+		return c.deploymentWorkloads.List(ctx, namespace, opts)
+	}
+	var list []*appsv1.Deployment
+	var err error
+	if namespace == "" {
+		list, err = c.lister.List(selector)
+	} else {
+		list, err = c.lister.Deployments(namespace).List(selector)
+	}
+	if err != nil {
+		return nil, "", models.NewHTTPError(err, http.StatusInternalServerError, "error listing deployments from cache")
+	}
+	workloads := make([]Workload, 0, len(list))
+	for _, d := range list {
+		workloads = append(workloads, *deploymentWorkload(d))
+	}
+	// lists of the API server are ordered by namespace and name
+	sortWorkloads(workloads, SortByNamespace)
+	return workloads, "", nil
+}
+
+// cachedStatefulSetWorkloads reads statefulsets from the informer cache, scales go to the API server
+type cachedStatefulSetWorkloads struct {
+	*statefulSetWorkloads
+	lister appslisters.StatefulSetLister
+}
+
+func (c *cachedStatefulSetWorkloads) Get(_ context.Context, namespace, name string) (*Workload, error) {
+	s, err := c.lister.StatefulSets(namespace).Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return statefulSetWorkload(s), nil
+}
+
+func (c *cachedStatefulSetWorkloads) List(ctx context.Context, namespace string, opts metav1.ListOptions) ([]Workload, string, error) {
+	selector, ok := cachedList(opts)
+	if !ok {
+		return c.statefulSetWorkloads.List(ctx, namespace, opts)
+	}
+	var list []*appsv1.StatefulSet
+	var err error
+	if namespace == "" {
+		list, err = c.lister.List(selector)
+	} else {
+		list, err = c.lister.StatefulSets(namespace).List(selector)
+	}
+	if err != nil {
+		return nil, "", models.NewHTTPError(err, http.StatusInternalServerError, "error listing statefulsets from cache")
+	}
+	workloads := make([]Workload, 0, len(list))
+	for _, s := range list {
+		workloads = append(workloads, *statefulSetWorkload(s))
+	}
+	// lists of the API server are ordered by namespace and name
+	sortWorkloads(workloads, SortByNamespace)
+	return workloads, "", nil
+}
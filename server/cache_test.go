@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/innovia/portal/server/models"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestReadsFromInformerCache(t *testing.T) {
+	testCases := []struct {
+		title, path   string
+		start         bool
+		expectedCode  int
+		expectedCalls int
+	}{
+		{
+			title:         "Should get a deployment from the cache",
+			path:          "/api/v1/namespaces/test/deployments/nginx",
+			start:         true,
+			expectedCode:  http.StatusOK,
+			expectedCalls: 0,
+		}, {
+			title:         "Should get a deployment from the API server with consistent",
+			path:          "/api/v1/namespaces/test/deployments/nginx?consistent=true",
+			start:         true,
+			expectedCode:  http.StatusOK,
+			expectedCalls: 1,
+		}, {
+			title:         "Should get a deployment from the API server before the cache synced",
+			path:          "/api/v1/namespaces/test/deployments/nginx",
+			expectedCode:  http.StatusOK,
+			expectedCalls: 1,
+		}, {
+			title:         "Should return 404 for a deployment missing from the cache",
+			path:          "/api/v1/namespaces/test/deployments/missing",
+			start:         true,
+			expectedCode:  http.StatusNotFound,
+			expectedCalls: 0,
+		}, {
+			title:         "Should list deployments from the cache",
+			path:          "/api/v1/namespaces/test/deployments",
+			start:         true,
+			expectedCode:  http.StatusOK,
+			expectedCalls: 0,
+		}, {
+			title:         "Should list deployments from the cache with a label selector",
+			path:          "/api/v1/namespaces/deployments?labelSelector=app%3Dnginx",
+			start:         true,
+			expectedCode:  http.StatusOK,
+			expectedCalls: 0,
+		}, {
+			title:         "Should list pages from the API server",
+			path:          "/api/v1/namespaces/test/deployments?limit=10",
+			start:         true,
+			expectedCode:  http.StatusOK,
+			expectedCalls: 1,
+		}, {
+			title:         "Should get a statefulset from the cache",
+			path:          "/api/v1/namespaces/test/statefulsets/web",
+			start:         true,
+			expectedCode:  http.StatusOK,
+			expectedCalls: 0,
+		}, {
+			title:         "Should reject an invalid consistent value",
+			path:          "/api/v1/namespaces/test/deployments/nginx?consistent=maybe",
+			start:         true,
+			expectedCode:  http.StatusBadRequest,
+			expectedCalls: 0,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			api := newTestAPI(t)
+			clientSet := api.clientSet
+			replicas := int32(3)
+			createDeployment(t, clientSet, &replicas, "nginx", "test", "nginx")
+			createStatefulSet(t, clientSet, &replicas, "web", "test", "nginx")
+
+			// count the reads that reach the API server, the reactors are added before the informers run
+			var mu sync.Mutex
+			calls := 0
+			for _, verb := range []string{"get", "list"} {
+				for _, resource := range []string{"deployments", "statefulsets"} {
+					clientSet.PrependReactor(verb, resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+						mu.Lock()
+						defer mu.Unlock()
+						calls++
+						return false, nil, nil
+					})
+				}
+			}
+
+			api.client.InformerFactory = informers.NewSharedInformerFactory(clientSet, 0)
+			if c.start {
+				stopCh := make(chan struct{})
+				defer close(stopCh)
+				api.client.StartSharedInformers(stopCh)
+				if !cache.WaitForCacheSync(stopCh,
+					api.client.InformerFactory.Apps().V1().Deployments().Informer().HasSynced,
+					api.client.InformerFactory.Apps().V1().StatefulSets().Informer().HasSynced) {
+					t.Fatal("informer cache did not sync")
+				}
+			}
+			// the lists of the informers are not counted
+			mu.Lock()
+			calls = 0
+			mu.Unlock()
+
+			res := api.serve(httptest.NewRequest(http.MethodGet, c.path, nil))
+			assert.Equal(t, c.expectedCode, res.Code)
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, c.expectedCalls, calls)
+		})
+	}
+}
+
+func TestDiffFromInformerCache(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+	clientSet := api.clientSet
+	replicas := int32(3)
+	createDeployment(t, clientSet, &replicas, "nginx", "test", "nginx")
+	// the cached deployment is served while the API server fails to get it
+	clientSet.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, assert.AnError
+	})
+	api.client.InformerFactory = informers.NewSharedInformerFactory(clientSet, 0)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	api.client.StartSharedInformers(stopCh)
+	cache.WaitForCacheSync(stopCh, api.client.InformerFactory.Apps().V1().Deployments().Informer().HasSynced)
+	assert.NoError(t, api.client.UpdateState(ctx, &models.Status{Deployment: models.Deployment{Name: "nginx", Namespace: "test", Replicas: 2}}))
+	res := api.serve(httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/test/deployments/nginx/diff", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	diff := &models.Diff{}
+	assert.NoError(t, json.Unmarshal(res.Body.Bytes(), diff))
+	assert.Equal(t, "replicas: 2 => 3", diff.Diff)
+
+	res = api.serve(httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/test/deployments/nginx/diff?consistent=true", nil))
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/innovia/portal/server/metrics"
+	"k8s.io/klog/v2"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultTLSReloadInterval is the default interval the TLS files are checked for changes
+const DefaultTLSReloadInterval = 10 * time.Second
+
+// TLS material reloaded by CertificateReloader, used as the material metrics label
+const (
+	tlsMaterialCertificate = "certificate"
+	tlsMaterialCA          = "ca"
+)
+
+// tlsMaterial is a TLS file reloaded by CertificateReloader, reload returns true if the file changed and was loaded
+type tlsMaterial struct {
+	name   string
+	reload func() (bool, error)
+}
+
+// CertificateReloader serves the server keypair and the client CA pool from files and reloads them when the files change,
+// the previous material is kept when the new files fail to parse. files are compared by content so the symlink swaps of
+// mounted secrets are picked up
+type CertificateReloader struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// Revocation rejects revoked client certificates when set, its CRL is reloaded with the certificates
+	Revocation *RevocationChecker
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	caPool      *x509.CertPool
+	certPEM     []byte
+	keyPEM      []byte
+	caPEM       []byte
+}
+
+// NewCertificateReloader returns a CertificateReloader with the keypair and CA bundle loaded, the initial load must succeed
+func NewCertificateReloader(certFile, keyFile, caFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{CertFile: certFile, KeyFile: keyFile, CAFile: caFile}
+	if _, err := r.reloadCertificate(); err != nil {
+		return nil, err
+	}
+	if _, err := r.reloadCA(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns the mTLS server config serving the current keypair and verifying clients with the current CA pool,
+// HTTP/2 and HTTP/1.1 are negotiated with ALPN
+func (r *CertificateReloader) TLSConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: r.GetCertificate,
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return r.configForClient(base), nil
+	}
+	return base
+}
+
+// GetCertificate returns the current server keypair
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.certificate, nil
+}
+
+// configForClient returns the config of a connection with the current client CA pool, the protocols and the minimum
+// version are taken from the base config
+func (r *CertificateReloader) configForClient(base *tls.Config) *tls.Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	config := &tls.Config{
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		ClientCAs:      r.caPool,
+		MinVersion:     base.MinVersion,
+		NextProtos:     base.NextProtos,
+		GetCertificate: r.GetCertificate,
+	}
+	if r.Revocation != nil {
+		config.VerifyPeerCertificate = r.Revocation.VerifyPeerCertificate
+	}
+	return config
+}
+
+// Run reloads changed files every interval until stopCh is closed
+func (r *CertificateReloader) Run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			r.Reload()
+		}
+	}
+}
+
+// Reload reloads the keypair, the CA bundle and the CRL if their files changed, failures are logged and counted
+func (r *CertificateReloader) Reload() {
+	materials := []tlsMaterial{{tlsMaterialCertificate, r.reloadCertificate}, {tlsMaterialCA, r.reloadCA}}
+	if r.Revocation != nil {
+		materials = append(materials, tlsMaterial{tlsMaterialCRL, r.Revocation.reloadCRL})
+	}
+	for _, material := range materials {
+		reloaded, err := material.reload()
+		if err != nil {
+			klog.Errorf("error reloading TLS %s, keeping the previous one: %v", material.name, err)
+			metrics.TLSReloads.WithLabelValues(material.name, "error").Inc()
+			continue
+		}
+		if reloaded {
+			klog.Infof("reloaded TLS %s", material.name)
+			metrics.TLSReloads.WithLabelValues(material.name, "success").Inc()
+		}
+	}
+}
+
+// reloadCertificate loads the keypair if the files changed since the last successful load
+func (r *CertificateReloader) reloadCertificate() (bool, error) {
+	certPEM, err := os.ReadFile(r.CertFile)
+	if err != nil {
+		return false, fmt.Errorf("error reading certificate file %s: %v", r.CertFile, err)
+	}
+	keyPEM, err := os.ReadFile(r.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("error reading private key file %s: %v", r.KeyFile, err)
+	}
+
+	r.mu.RLock()
+	unchanged := bytes.Equal(certPEM, r.certPEM) && bytes.Equal(keyPEM, r.keyPEM)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("error parsing keypair %s %s: %v", r.CertFile, r.KeyFile, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.certificate, r.certPEM, r.keyPEM = &certificate, certPEM, keyPEM
+	return true, nil
+}
+
+// reloadCA loads the client CA bundle if the file changed since the last successful load
+func (r *CertificateReloader) reloadCA() (bool, error) {
+	caPEM, err := os.ReadFile(r.CAFile)
+	if err != nil {
+		return false, fmt.Errorf("error reading CA file %s: %v", r.CAFile, err)
+	}
+
+	r.mu.RLock()
+	unchanged := bytes.Equal(caPEM, r.caPEM)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return false, fmt.Errorf("no certificates found in CA file %s", r.CAFile)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.caPool, r.caPEM = pool, caPEM
+	return true, nil
+}
+
+// Check returns an error if the keypair or the CA pool is not loaded or the server certificate is not valid at the current time
+func (r *CertificateReloader) Check() error {
+	r.mu.RLock()
+	certificate, caPool := r.certificate, r.caPool
+	r.mu.RUnlock()
+	if certificate == nil || len(certificate.Certificate) == 0 {
+		return fmt.Errorf("server certificate %s is not loaded", r.CertFile)
+	}
+	if caPool == nil {
+		return fmt.Errorf("client CA %s is not loaded", r.CAFile)
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("error parsing server certificate %s: %v", r.CertFile, err)
+	}
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return fmt.Errorf("server certificate %s is only valid from %s to %s", r.CertFile, leaf.NotBefore, leaf.NotAfter)
+	}
+	return nil
+}
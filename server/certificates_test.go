@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/innovia/portal/server/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	serverCert := newTestCertificate(t, "localhost", ca)
+	certFile := writeFile(t, dir, "server.crt", serverCert.CertPEM)
+	keyFile := writeFile(t, dir, "server.key", serverCert.KeyPEM)
+	caFile := writeFile(t, dir, "ca_cert.pem", ca.CertPEM)
+
+	reloader, err := NewCertificateReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("error loading certificates: %v", err)
+	}
+	handshake := newTestTLSServer(t, reloader, ca)
+
+	client := newTestCertificate(t, "client", ca)
+	serial, err := handshake(client)
+	assert.NoError(t, err)
+	assert.Equal(t, serverCert.Cert.SerialNumber.String(), serial)
+
+	// rotate the keypair
+	certificateReloads := testutil.ToFloat64(metrics.TLSReloads.WithLabelValues(tlsMaterialCertificate, "success"))
+	rotated := newTestCertificate(t, "localhost", ca)
+	writeFile(t, dir, "server.crt", rotated.CertPEM)
+	writeFile(t, dir, "server.key", rotated.KeyPEM)
+	reloader.Reload()
+	serial, err = handshake(client)
+	assert.NoError(t, err)
+	assert.Equal(t, rotated.Cert.SerialNumber.String(), serial)
+	assert.Equal(t, certificateReloads+1, testutil.ToFloat64(metrics.TLSReloads.WithLabelValues(tlsMaterialCertificate, "success")))
+
+	// unchanged files are not reloaded
+	reloader.Reload()
+	assert.Equal(t, certificateReloads+1, testutil.ToFloat64(metrics.TLSReloads.WithLabelValues(tlsMaterialCertificate, "success")))
+
+	// invalid files keep the previous keypair and CA pool
+	certificateErrors := testutil.ToFloat64(metrics.TLSReloads.WithLabelValues(tlsMaterialCertificate, "error"))
+	caErrors := testutil.ToFloat64(metrics.TLSReloads.WithLabelValues(tlsMaterialCA, "error"))
+	writeFile(t, dir, "server.key", []byte("not a key"))
+	writeFile(t, dir, "ca_cert.pem", []byte("not a certificate"))
+	reloader.Reload()
+	serial, err = handshake(client)
+	assert.NoError(t, err)
+	assert.Equal(t, rotated.Cert.SerialNumber.String(), serial)
+	assert.Equal(t, certificateErrors+1, testutil.ToFloat64(metrics.TLSReloads.WithLabelValues(tlsMaterialCertificate, "error")))
+	assert.Equal(t, caErrors+1, testutil.ToFloat64(metrics.TLSReloads.WithLabelValues(tlsMaterialCA, "error")))
+
+	// rotate the CA, clients of the previous CA are rejected
+	newCA := newTestCertificate(t, "new-ca", nil)
+	writeFile(t, dir, "ca_cert.pem", newCA.CertPEM)
+	reloader.Reload()
+	_, err = handshake(client)
+	assert.Error(t, err)
+	_, err = handshake(newTestCertificate(t, "client", newCA))
+	assert.NoError(t, err)
+}
+
+func TestNewCertificateReloaderRequiresValidFiles(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	certFile := writeFile(t, dir, "server.crt", ca.CertPEM)
+	keyFile := writeFile(t, dir, "server.key", ca.KeyPEM)
+
+	_, err := NewCertificateReloader(certFile, keyFile, writeFile(t, dir, "ca_cert.pem", []byte("invalid")))
+	assert.Error(t, err)
+	_, err = NewCertificateReloader(certFile, writeFile(t, dir, "invalid.key", []byte("invalid")), writeFile(t, dir, "ca.pem", ca.CertPEM))
+	assert.Error(t, err)
+}
+
+func TestCertificateReloaderNegotiatesHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	serverCert := newTestCertificate(t, "localhost", ca)
+	reloader, err := NewCertificateReloader(writeFile(t, dir, "server.crt", serverCert.CertPEM),
+		writeFile(t, dir, "server.key", serverCert.KeyPEM), writeFile(t, dir, "ca_cert.pem", ca.CertPEM))
+	if err != nil {
+		t.Fatalf("error loading certificates: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	srv := &http.Server{Handler: http.NotFoundHandler(), TLSConfig: reloader.TLSConfig()}
+	go srv.ServeTLS(listener, "", "")
+	defer srv.Close()
+
+	client := newTestCertificate(t, "client", ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	testCases := []struct {
+		title                string
+		maxVersion           uint16
+		expectedProtocol     string
+		expectedHandshakeErr bool
+	}{
+		{title: "Should negotiate HTTP/2", expectedProtocol: "h2"},
+		{title: "Should reject TLS versions below the minimum version", maxVersion: tls.VersionTLS11, expectedHandshakeErr: true},
+	}
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+				RootCAs:      roots,
+				ServerName:   "localhost",
+				MaxVersion:   c.maxVersion,
+				NextProtos:   []string{"h2", "http/1.1"},
+				Certificates: []tls.Certificate{{Certificate: [][]byte{client.Cert.Raw}, PrivateKey: client.Key}},
+			})
+			if c.expectedHandshakeErr {
+				assert.Error(t, err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+			assert.Equal(t, c.expectedProtocol, conn.ConnectionState().NegotiatedProtocol)
+		})
+	}
+}
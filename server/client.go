@@ -2,16 +2,48 @@ package server
 
 import (
 	"fmt"
+	"github.com/innovia/portal/server/audit"
+	"github.com/innovia/portal/server/authz"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/scale"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"os"
 )
 
 // KubernetesClient is a struct that holds a Clientset interface that can be replaced
 // with fake clientset for testing
 type KubernetesClient struct {
-	Clientset kubernetes.Interface
-	Namespace string
+	Clientset      kubernetes.Interface
+	Dynamic        dynamic.Interface
+	Scales         scale.ScalesGetter // Scales scales any resource with a scale subresource
+	Mapper         meta.RESTMapper    // Mapper resolves the version of resources that are not deployments or statefulsets
+	Namespace      string
+	LeaderElection *LeaderElection // LeaderElection is nil when leader election is disabled
+	State          StateStore      // State is the desired replicas state backend, defaults to the state configmap
+	// ReconcileWorkers is the number of reconcile queue workers, defaults to DefaultReconcileWorkers
+	ReconcileWorkers int
+	// ReconcileResources are the normalized resources reconciled in addition to deployments and statefulsets
+	ReconcileResources []string
+	// Authorizer authorizes API requests by client certificate identity, every request is allowed when nil
+	Authorizer authz.Authorizer
+	// Audit writes a record of every mutating API request, requests are not audited when nil
+	Audit *audit.Logger
+	// Recorder records events on reconciled workloads, no events are recorded when nil
+	Recorder record.EventRecorder
+	// Informers tracks the informer sync of the reconcile loop for the readiness check, not checked when nil
+	Informers *InformerStatus
+	// Certificates is the TLS material of the API server for the readiness check, not checked when nil
+	Certificates *CertificateReloader
+	// InformerFactory is shared by the read routes and the reconcile loop, reads go to the API server when nil
+	InformerFactory informers.SharedInformerFactory
+	// HistoryLimit is the number of replicas changes kept per workload, defaults to DefaultHistoryLimit
+	HistoryLimit int
 }
 
 // NewClient returns kubernetes initialized client
@@ -19,6 +51,7 @@ func NewClient(kubeconfig string) (*KubernetesClient, error) {
 	namespace := getEnv("POD_NAMESPACE", StateConfigMapNamespace)
 	client := &KubernetesClient{
 		Namespace: namespace,
+		Informers: &InformerStatus{},
 	}
 
 	// use the current context in kubeconfig
@@ -31,7 +64,24 @@ func NewClient(kubeconfig string) (*KubernetesClient, error) {
 		return nil, fmt.Errorf("error intializing kubernetes client: %v", err)
 	}
 
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("error intializing kubernetes dynamic client: %v", err)
+	}
+
+	// resources are resolved through a cached discovery client, the cache is reset when a resource is not found
+	// so custom resources installed after startup are picked up
+	cachedDiscovery := memory.NewMemCacheClient(clientset.Discovery())
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(cachedDiscovery)
+	scaleClient, err := scale.NewForConfig(config, mapper, dynamic.LegacyAPIPathResolverFunc, scale.NewDiscoveryScaleKindResolver(cachedDiscovery))
+	if err != nil {
+		return nil, fmt.Errorf("error intializing kubernetes scale client: %v", err)
+	}
+
 	client.Clientset = clientset
+	client.Dynamic = dynamicClient
+	client.Scales = scaleClient
+	client.Mapper = mapper
 	return client, nil
 }
 
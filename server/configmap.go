@@ -26,8 +26,9 @@ func (h *KubernetesClient) GetConfigMap(ctx context.Context, name, namespace str
 // CreateConfigMap creates a new configmap in kubernetes
 func (h *KubernetesClient) CreateConfigMap(ctx context.Context, cfgMap *corev1.ConfigMap, namespace string) (*corev1.ConfigMap, error) {
 	cfg, err := h.Clientset.CoreV1().ConfigMaps(namespace).Create(ctx, cfgMap, metav1.CreateOptions{})
+	// another writer created the configmap first, return the existing one
 	if k8serrors.IsAlreadyExists(err) {
-		return cfg, nil
+		return h.GetConfigMap(ctx, cfgMap.Name, namespace)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("error creating configmap in %s namespace: %v", namespace, err)
@@ -39,7 +40,7 @@ func (h *KubernetesClient) CreateConfigMap(ctx context.Context, cfgMap *corev1.C
 func (h *KubernetesClient) UpdateConfigMap(ctx context.Context, cfgMap *corev1.ConfigMap, namespace string) (*corev1.ConfigMap, error) {
 	cfg, err := h.Clientset.CoreV1().ConfigMaps(namespace).Update(ctx, cfgMap, metav1.UpdateOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("error updating configmap in %s namespace: %v", namespace, err)
+		return nil, fmt.Errorf("error updating configmap in %s namespace: %w", namespace, err)
 	}
 	return cfg, nil
 }
@@ -0,0 +1,373 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/innovia/portal/server/apis/v1alpha1"
+	"github.com/innovia/portal/server/metrics"
+	"github.com/innovia/portal/server/models"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+	"strings"
+	"time"
+)
+
+// ConditionRecorder is implemented by state stores that can report the reconcile outcome back on the state object
+type ConditionRecorder interface {
+	RecordCondition(ctx context.Context, resource, name, namespace string, condition metav1.Condition) error
+}
+
+// DriftRecorder is implemented by state stores that write the drift tracking of a workload without writing back
+// the rest of its status, a pin set since the status was read is kept
+type DriftRecorder interface {
+	RecordDrift(ctx context.Context, status *models.Status) error
+}
+
+// CRDStateStore is a StateStore that keeps the status of every workload in a ReplicaPolicy custom resource
+// in the namespace of the workload, see policyName for the name of the policy
+type CRDStateStore struct {
+	Client dynamic.Interface
+}
+
+// Read returns the status from the ReplicaPolicy of a given workload resource, name and namespace
+func (s *CRDStateStore) Read(ctx context.Context, resource, name, namespace string) (*models.Status, error) {
+	policy, err := s.get(ctx, policyName(resource, name), namespace)
+	if k8sErrors.IsNotFound(err) {
+		klog.V(3).Infof("did not find replica policy %s/%s", namespace, policyName(resource, name))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if policy.Spec.Resource != resource {
+		// a deployment with a dotted name can have the name of a policy that belongs to another resource
+		klog.V(3).Infof("replica policy %s/%s belongs to %s", namespace, policy.Name, ResourcePath(policy.Spec.Resource))
+		return nil, nil
+	}
+	return policyToStatus(policy), nil
+}
+
+// List returns the status of every ReplicaPolicy in all namespaces
+func (s *CRDStateStore) List(ctx context.Context) ([]models.Status, error) {
+	list, err := s.Client.Resource(v1alpha1.ReplicaPolicyResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing replica policies: %v", err)
+	}
+
+	statuses := []models.Status{}
+	for _, item := range list.Items {
+		policy := &v1alpha1.ReplicaPolicy{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, policy); err != nil {
+			return nil, fmt.Errorf("error parsing replica policy %s/%s: %v", item.GetNamespace(), item.GetName(), err)
+		}
+		statuses = append(statuses, *policyToStatus(policy))
+	}
+	sortStatuses(statuses)
+	return statuses, nil
+}
+
+// Update creates or updates the ReplicaPolicy of a workload, the update is retried on conflict
+func (s *CRDStateStore) Update(ctx context.Context, status *models.Status) error {
+	status.Time = time.Now()
+	return s.write(ctx, status)
+}
+
+// write creates or updates the ReplicaPolicy spec of a workload keeping the time of the given status,
+// the drift tracking is written to the policy status when it changed
+func (s *CRDStateStore) write(ctx context.Context, status *models.Status) error {
+	name := policyName(status.Resource, status.Name)
+	err := retry.RetryOnConflict(StateUpdateBackoff, func() error {
+		policy, err := s.get(ctx, name, status.Namespace)
+		if k8sErrors.IsNotFound(err) {
+			policy = &v1alpha1.ReplicaPolicy{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: v1alpha1.SchemeGroupVersion.String(),
+					Kind:       v1alpha1.ReplicaPolicyKind,
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: status.Namespace,
+				},
+			}
+			policy.Spec = statusToPolicySpec(status)
+			obj, err := toUnstructured(policy)
+			if err != nil {
+				return err
+			}
+			created, err := s.Client.Resource(v1alpha1.ReplicaPolicyResource).Namespace(status.Namespace).Create(ctx, obj, metav1.CreateOptions{})
+			if k8sErrors.IsAlreadyExists(err) {
+				// created concurrently, retry as an update
+				metrics.StateConflicts.WithLabelValues(StateBackendCRD).Inc()
+				return k8sErrors.NewConflict(v1alpha1.ReplicaPolicyResource.GroupResource(), name, err)
+			}
+			if err != nil {
+				return err
+			}
+			return s.writeDrift(ctx, created, status)
+		}
+		if err != nil {
+			return err
+		}
+		if policy.Spec.Resource != status.Resource {
+			return fmt.Errorf("replica policy %s already exists for %s", name, ResourcePath(policy.Spec.Resource))
+		}
+
+		policy.Spec = statusToPolicySpec(status)
+		obj, err := toUnstructured(policy)
+		if err != nil {
+			return err
+		}
+		updated, err := s.Client.Resource(v1alpha1.ReplicaPolicyResource).Namespace(status.Namespace).Update(ctx, obj, metav1.UpdateOptions{})
+		if k8sErrors.IsConflict(err) {
+			metrics.StateConflicts.WithLabelValues(StateBackendCRD).Inc()
+		}
+		if err != nil {
+			return err
+		}
+		return s.writeDrift(ctx, updated, status)
+	})
+	if err != nil {
+		return fmt.Errorf("error writing replica policy %s/%s: %v", status.Namespace, name, err)
+	}
+	return nil
+}
+
+// writeDrift writes the drift tracking of a status to the status of the written policy obj when it changed
+func (s *CRDStateStore) writeDrift(ctx context.Context, obj *unstructured.Unstructured, status *models.Status) error {
+	policy := &v1alpha1.ReplicaPolicy{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, policy); err != nil {
+		return fmt.Errorf("error parsing replica policy %s/%s: %v", obj.GetNamespace(), obj.GetName(), err)
+	}
+	if !setPolicyDrift(policy, status) {
+		return nil
+	}
+
+	obj, err := toUnstructured(policy)
+	if err != nil {
+		return err
+	}
+	_, err = s.Client.Resource(v1alpha1.ReplicaPolicyResource).Namespace(policy.Namespace).UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+	return err
+}
+
+// RecordDrift sets the drift tracking of a status on the ReplicaPolicy status without writing the policy spec,
+// the status is only written when the drift tracking changed
+func (s *CRDStateStore) RecordDrift(ctx context.Context, status *models.Status) error {
+	name := policyName(status.Resource, status.Name)
+	err := retry.RetryOnConflict(StateUpdateBackoff, func() error {
+		obj, err := s.Client.Resource(v1alpha1.ReplicaPolicyResource).Namespace(status.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if k8sErrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return s.writeDrift(ctx, obj, status)
+	})
+	if err != nil {
+		return fmt.Errorf("error writing drift of replica policy %s/%s: %v", status.Namespace, name, err)
+	}
+	return nil
+}
+
+// Delete removes the ReplicaPolicy of a workload
+func (s *CRDStateStore) Delete(ctx context.Context, resource, name, namespace string) error {
+	status, err := s.Read(ctx, resource, name, namespace)
+	if err != nil || status == nil {
+		return err
+	}
+
+	err = s.Client.Resource(v1alpha1.ReplicaPolicyResource).Namespace(namespace).Delete(ctx, policyName(resource, name), metav1.DeleteOptions{})
+	if err != nil && !k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting replica policy %s/%s: %v", namespace, policyName(resource, name), err)
+	}
+	return nil
+}
+
+// RecordCondition sets a condition on the ReplicaPolicy status, the status is only written when the condition changed
+func (s *CRDStateStore) RecordCondition(ctx context.Context, resource, name, namespace string, condition metav1.Condition) error {
+	return retry.RetryOnConflict(StateUpdateBackoff, func() error {
+		policy, err := s.get(ctx, policyName(resource, name), namespace)
+		if k8sErrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if policy.Spec.Resource != resource {
+			return nil
+		}
+
+		current := meta.FindStatusCondition(policy.Status.Conditions, condition.Type)
+		if current != nil && current.Status == condition.Status && current.Reason == condition.Reason &&
+			current.Message == condition.Message && current.ObservedGeneration == policy.Generation {
+			return nil
+		}
+
+		condition.ObservedGeneration = policy.Generation
+		meta.SetStatusCondition(&policy.Status.Conditions, condition)
+		if condition.Reason == v1alpha1.ReasonDriftReconciled {
+			now := metav1.Now()
+			policy.Status.LastReconcileTime = &now
+		}
+
+		obj, err := toUnstructured(policy)
+		if err != nil {
+			return err
+		}
+		_, err = s.Client.Resource(v1alpha1.ReplicaPolicyResource).Namespace(namespace).UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// MigrateFromConfigMap creates a ReplicaPolicy for every workload in the state configmap,
+// policies that already exist are left untouched and the configmap is kept so the migration can be rolled back
+func (s *CRDStateStore) MigrateFromConfigMap(ctx context.Context, from *ConfigMapStateStore) (int, error) {
+	statuses, err := from.List(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error reading configmap state for migration: %v", err)
+	}
+
+	migrated := 0
+	for i := range statuses {
+		status := &statuses[i]
+		existing, err := s.Read(ctx, status.Resource, status.Name, status.Namespace)
+		if err != nil {
+			return migrated, err
+		}
+		if existing != nil {
+			klog.V(3).Infof("replica policy %s/%s already exists, skipping migration", status.Namespace, policyName(status.Resource, status.Name))
+			continue
+		}
+
+		if err := s.write(ctx, status); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	klog.Infof("migrated %d workloads from state configmap to replica policies", migrated)
+	return migrated, nil
+}
+
+func (s *CRDStateStore) get(ctx context.Context, name, namespace string) (*v1alpha1.ReplicaPolicy, error) {
+	obj, err := s.Client.Resource(v1alpha1.ReplicaPolicyResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &v1alpha1.ReplicaPolicy{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, policy); err != nil {
+		return nil, fmt.Errorf("error parsing replica policy %s/%s: %v", namespace, name, err)
+	}
+	return policy, nil
+}
+
+func toUnstructured(policy *v1alpha1.ReplicaPolicy) (*unstructured.Unstructured, error) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(policy)
+	if err != nil {
+		return nil, fmt.Errorf("error converting replica policy %s/%s: %v", policy.Namespace, policy.Name, err)
+	}
+	return &unstructured.Unstructured{Object: obj}, nil
+}
+
+// policyName returns the ReplicaPolicy name of a workload
+func policyName(resource, name string) string {
+	if resource == "" {
+		return name
+	}
+	return name + "." + resource
+}
+
+func policyToStatus(policy *v1alpha1.ReplicaPolicy) *models.Status {
+	var lastReconcileTime *time.Time
+	if policy.Status.LastReconcileTime != nil {
+		lastReconcileTime = &policy.Status.LastReconcileTime.Time
+	}
+	var driftSince *time.Time
+	if policy.Status.DriftSince != nil {
+		driftSince = &policy.Status.DriftSince.Time
+	}
+	var expiry *time.Time
+	if policy.Spec.Expiry != nil {
+		expiry = &policy.Spec.Expiry.Time
+	}
+	var history []models.HistoryEntry
+	for _, entry := range policy.Spec.History {
+		history = append(history, models.HistoryEntry{
+			Revision: entry.Revision,
+			Time:     entry.Time.Time,
+			Actor:    entry.Actor,
+			Source:   entry.Source,
+			Reason:   entry.Reason,
+			From:     entry.From,
+			To:       entry.To,
+		})
+	}
+	return &models.Status{
+		Deployment: models.Deployment{
+			Name:      strings.TrimSuffix(policy.Name, "."+policy.Spec.Resource),
+			Namespace: policy.Namespace,
+			Replicas:  policy.Spec.Replicas,
+			Resource:  policy.Spec.Resource,
+		},
+		Reconcile:          policy.Spec.Reconcile,
+		Paused:             policy.Spec.Paused,
+		Time:               policy.Spec.Time.Time,
+		LastReconcileTime:  lastReconcileTime,
+		History:            history,
+		DriftSince:         driftSince,
+		ReconcileFailures:  policy.Status.ReconcileFailures,
+		LastReconcileError: policy.Status.LastReconcileError,
+		Expiry:             expiry,
+	}
+}
+
+func statusToPolicySpec(status *models.Status) v1alpha1.ReplicaPolicySpec {
+	spec := v1alpha1.ReplicaPolicySpec{
+		Resource:  status.Resource,
+		Replicas:  status.Replicas,
+		Reconcile: status.Reconcile,
+		Paused:    status.Paused,
+		Time:      metav1.NewTime(status.Time),
+	}
+	if status.Expiry != nil {
+		expiry := metav1.NewTime(*status.Expiry)
+		spec.Expiry = &expiry
+	}
+	for _, entry := range status.History {
+		spec.History = append(spec.History, v1alpha1.ReplicaPolicyHistoryEntry{
+			Revision: entry.Revision,
+			Time:     metav1.NewTime(entry.Time),
+			Actor:    entry.Actor,
+			Source:   entry.Source,
+			Reason:   entry.Reason,
+			From:     entry.From,
+			To:       entry.To,
+		})
+	}
+	return spec
+}
+
+// setPolicyDrift sets the drift tracking of a status on a policy status and returns true when it changed
+func setPolicyDrift(policy *v1alpha1.ReplicaPolicy, status *models.Status) bool {
+	var driftSince *metav1.Time
+	if status.DriftSince != nil {
+		t := metav1.NewTime(*status.DriftSince)
+		driftSince = &t
+	}
+	current := &policy.Status
+	if current.DriftSince.Equal(driftSince) && current.ReconcileFailures == status.ReconcileFailures &&
+		current.LastReconcileError == status.LastReconcileError {
+		return false
+	}
+	current.DriftSince = driftSince
+	current.ReconcileFailures = status.ReconcileFailures
+	current.LastReconcileError = status.LastReconcileError
+	return true
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"github.com/innovia/portal/server/apis/v1alpha1"
+	"github.com/innovia/portal/server/models"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func TestReplicaPolicyConditions(t *testing.T) {
+	testCases := []struct {
+		title                             string
+		originalReplicas, desiredReplicas int32
+		expectedReason                    string
+	}{
+		{
+			title:            "Should record drift reconciled condition",
+			originalReplicas: int32(5),
+			desiredReplicas:  int32(3),
+			expectedReason:   v1alpha1.ReasonDriftReconciled,
+		}, {
+			title:            "Should record in sync condition",
+			originalReplicas: int32(3),
+			desiredReplicas:  int32(3),
+			expectedReason:   v1alpha1.ReasonInSync,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			ctx := context.Background()
+			clientSet := newFakeClientset()
+			store := &CRDStateStore{Client: newFakeDynamicClient()}
+			client := KubernetesClient{Clientset: clientSet, Namespace: "default", State: store}
+			deployment := createDeployment(t, clientSet, &c.originalReplicas, "nginx", "test", "nginx")
+
+			status := &models.Status{
+				Deployment: models.Deployment{Name: "nginx", Namespace: "test", Replicas: c.desiredReplicas},
+				Reconcile:  true,
+			}
+			if err := store.Update(ctx, status); err != nil {
+				t.Fatalf("error updating state: %v", err)
+			}
+
+			r := ReplicasReconcile{Client: &client}
+			if err := r.Reconcile(ctx, status, deploymentWorkload(deployment)); err != nil {
+				t.Fatalf("error reconciling deployment: %v", err)
+			}
+
+			policy, err := store.get(ctx, "nginx", "test")
+			if err != nil {
+				t.Fatalf("error getting replica policy: %v", err)
+			}
+			condition := meta.FindStatusCondition(policy.Status.Conditions, v1alpha1.ConditionReconciled)
+			if condition == nil {
+				t.Fatalf("reconciled condition was not recorded")
+			}
+			assert.Equal(t, metav1.ConditionTrue, condition.Status)
+			assert.Equal(t, c.expectedReason, condition.Reason)
+			assert.Equal(t, c.expectedReason == v1alpha1.ReasonDriftReconciled, policy.Status.LastReconcileTime != nil)
+		})
+	}
+}
+
+func TestReplicaPolicyDrift(t *testing.T) {
+	ctx := context.Background()
+	store := &CRDStateStore{Client: newFakeDynamicClient()}
+	driftSince := time.Now().Add(-time.Minute).Truncate(time.Second)
+	status := &models.Status{
+		Deployment: models.Deployment{Name: "nginx", Namespace: "test", Replicas: 3},
+		Reconcile:  true,
+		DriftSince: &driftSince,
+	}
+	if err := store.Update(ctx, status); err != nil {
+		t.Fatalf("error updating state: %v", err)
+	}
+	policy, err := store.get(ctx, "nginx", "test")
+	if err != nil {
+		t.Fatalf("error getting replica policy: %v", err)
+	}
+	assert.True(t, policy.Status.DriftSince.Time.Equal(driftSince))
+	spec := policy.Spec
+
+	// the drift is recorded on the status and the spec is left as is
+	status.ReconcileFailures, status.LastReconcileError = 2, "the server is currently unable to handle the request"
+	assert.NoError(t, store.RecordDrift(ctx, status))
+	policy, err = store.get(ctx, "nginx", "test")
+	if err != nil {
+		t.Fatalf("error getting replica policy: %v", err)
+	}
+	assert.Equal(t, spec, policy.Spec)
+	assert.Equal(t, 2, policy.Status.ReconcileFailures)
+	assert.Equal(t, status.LastReconcileError, policy.Status.LastReconcileError)
+
+	read, err := store.Read(ctx, "", "nginx", "test")
+	assert.NoError(t, err)
+	assert.True(t, read.DriftSince.Equal(driftSince))
+	assert.Equal(t, 2, read.ReconcileFailures)
+
+	// a missing policy has no drift to record
+	assert.NoError(t, store.RecordDrift(ctx, &models.Status{Deployment: models.Deployment{Name: "web", Namespace: "test"}, ReconcileFailures: 1}))
+}
+
+func TestMigrateConfigMapStateToReplicaPolicies(t *testing.T) {
+	ctx := context.Background()
+	client := &KubernetesClient{Clientset: newFakeClientset(), Namespace: "default"}
+	from := &ConfigMapStateStore{Client: client}
+	to := &CRDStateStore{Client: newFakeDynamicClient()}
+
+	for _, status := range []*models.Status{
+		{Deployment: models.Deployment{Name: "nginx", Namespace: "test", Replicas: 3}, Reconcile: true},
+		{Deployment: models.Deployment{Name: "api", Namespace: "prod", Replicas: 5}},
+	} {
+		if err := from.Update(ctx, status); err != nil {
+			t.Fatalf("error updating configmap state: %v", err)
+		}
+	}
+
+	// an existing policy is newer than the configmap entry and must not be overwritten
+	existing := &models.Status{Deployment: models.Deployment{Name: "api", Namespace: "prod", Replicas: 7}}
+	if err := to.Update(ctx, existing); err != nil {
+		t.Fatalf("error updating replica policy: %v", err)
+	}
+
+	migrated, err := to.MigrateFromConfigMap(ctx, from)
+	if err != nil {
+		t.Fatalf("error migrating state: %v", err)
+	}
+	assert.Equal(t, 1, migrated)
+
+	nginx, err := to.Read(ctx, "", "nginx", "test")
+	if err != nil {
+		t.Fatalf("error reading replica policy: %v", err)
+	}
+	assert.Equal(t, int32(3), nginx.Replicas)
+	assert.True(t, nginx.Reconcile)
+
+	api, err := to.Read(ctx, "", "api", "prod")
+	if err != nil {
+		t.Fatalf("error reading replica policy: %v", err)
+	}
+	assert.Equal(t, int32(7), api.Replicas)
+
+	// the configmap state is kept
+	statuses, err := from.List(ctx)
+	if err != nil {
+		t.Fatalf("error listing configmap state: %v", err)
+	}
+	assert.Len(t, statuses, 2)
+}
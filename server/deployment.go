@@ -7,21 +7,37 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/innovia/portal/server/models"
 	v1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 )
 
-// ListDeployments list deployments in kubernetes by namespace,
-// if namespace is set to an empty string returns all deployments from all namespaces
-func (h *KubernetesClient) ListDeployments(ctx context.Context, namespace string) (*v1.DeploymentList, error) {
-	deploymentsList, err := h.Clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+// sort orders of workload lists, lists are returned in the namespace and name order of the API server by default
+const (
+	SortByName      = "name"
+	SortByNamespace = "namespace"
+	SortByReplicas  = "replicas"
+)
+
+// ListDeployments list deployments in kubernetes by namespace with the label and field selectors and the limit and
+// continue token of opts, if namespace is set to an empty string returns all deployments from all namespaces
+func (h *KubernetesClient) ListDeployments(ctx context.Context, namespace string, opts metav1.ListOptions) (*v1.DeploymentList, error) {
+	deploymentsList, err := h.Clientset.AppsV1().Deployments(namespace).List(ctx, opts)
 	if err != nil {
-		return nil, fmt.Errorf("error listing deployments: %v", err)
+		return nil, fmt.Errorf("error listing deployments: %w", err)
 	}
 	return deploymentsList, nil
 }
 
-// GetDeployments returns list of deployments for HTTP request
+// GetDeployments returns list of deployments, statefulsets or custom resources with a scale subresource for HTTP request,
+// the labelSelector, fieldSelector, limit and continue query parameters are passed to the API server and the sort
+// query parameter orders the list by name, namespace or replicas, sort is rejected with limit or continue since only
+// the page would be ordered. ?view=full returns the full view of every workload
 func (h *KubernetesClient) GetDeployments(res http.ResponseWriter, req *http.Request) error {
 	if req.Method != http.MethodGet {
 		return models.NewHTTPError(nil, 405, "Method not allowed.")
@@ -29,24 +45,58 @@ func (h *KubernetesClient) GetDeployments(res http.ResponseWriter, req *http.Req
 
 	vars := mux.Vars(req)
 	ns := vars["namespace"]
-	deploymentsList, err := h.ListDeployments(req.Context(), ns)
+	resource, workloads, err := h.readWorkloadsForRequest(req)
+	if err != nil {
+		return err
+	}
 
+	query := req.URL.Query()
+	opts, err := listOptions(query)
+	if err != nil {
+		return err
+	}
+	sortBy := query.Get("sort")
+	if sortBy != "" && sortBy != SortByName && sortBy != SortByNamespace && sortBy != SortByReplicas {
+		return models.NewHTTPError(nil, http.StatusBadRequest, fmt.Sprintf("unknown sort %q, valid sorts are %s, %s and %s", sortBy, SortByName, SortByNamespace, SortByReplicas))
+	}
+	if sortBy != "" && (opts.Limit > 0 || opts.Continue != "") {
+		return models.NewHTTPError(nil, http.StatusBadRequest, "sort can not be combined with limit or continue, the API server pages are in namespace and name order.")
+	}
+	view, err := viewOf(req)
 	if err != nil {
-		return fmt.Errorf("error listing deployments: %v", err)
+		return err
 	}
 
-	deployments := models.Deployments{
-		Count: len(deploymentsList.Items),
-		Items: []models.Deployment{},
+	workloadList, continueToken, err := workloads.List(req.Context(), ns, opts)
+	if errors.IsResourceExpired(err) || errors.IsGone(err) {
+		return models.NewHTTPError(err, http.StatusGone, "continue token expired, restart the list without it")
 	}
+	if errors.IsBadRequest(err) {
+		return models.NewHTTPError(err, http.StatusBadRequest, fmt.Sprintf("invalid list options for %s", ResourcePath(resource)))
+	}
+	if err != nil {
+		return fmt.Errorf("error listing %s: %v", ResourcePath(resource), err)
+	}
+
+	sortWorkloads(workloadList, sortBy)
 
-	for _, d := range deploymentsList.Items {
-		deployment := models.Deployment{
-			Name:      d.ObjectMeta.Name,
-			Namespace: d.ObjectMeta.Namespace,
-			Replicas:  *d.Spec.Replicas,
+	var deployments interface{}
+	if view == ViewFull {
+		details, err := h.workloadDetails(req, resource, ns, workloadList)
+		if err != nil {
+			return err
 		}
-		deployments.Items = append(deployments.Items, deployment)
+		deployments = models.DeploymentDetails{Count: len(details), Items: details, Continue: continueToken}
+	} else {
+		list := models.Deployments{
+			Count:    len(workloadList),
+			Items:    []models.Deployment{},
+			Continue: continueToken,
+		}
+		for _, w := range workloadList {
+			list.Items = append(list.Items, w.Model())
+		}
+		deployments = list
 	}
 
 	payload, err := json.Marshal(deployments)
@@ -58,7 +108,64 @@ func (h *KubernetesClient) GetDeployments(res http.ResponseWriter, req *http.Req
 	return nil
 }
 
-// GetDeployment returns a deployment scale object for HTTP request
+// listOptions returns the list options of the labelSelector, fieldSelector, limit and continue query parameters,
+// the selectors are parsed so invalid selectors are rejected before listing
+func listOptions(query url.Values) (metav1.ListOptions, error) {
+	opts := metav1.ListOptions{
+		LabelSelector: query.Get("labelSelector"),
+		FieldSelector: query.Get("fieldSelector"),
+		Continue:      query.Get("continue"),
+	}
+	if _, err := labels.Parse(opts.LabelSelector); err != nil {
+		return opts, models.NewHTTPError(err, http.StatusBadRequest, fmt.Sprintf("invalid labelSelector %q", opts.LabelSelector))
+	}
+	if _, err := fields.ParseSelector(opts.FieldSelector); err != nil {
+		return opts, models.NewHTTPError(err, http.StatusBadRequest, fmt.Sprintf("invalid fieldSelector %q", opts.FieldSelector))
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit < 0 {
+			return opts, models.NewHTTPError(err, http.StatusBadRequest, fmt.Sprintf("invalid limit %q, must be a positive number", value))
+		}
+		opts.Limit = limit
+	}
+	return opts, nil
+}
+
+// sortWorkloads orders workloads by name, namespace or replicas with ties ordered by namespace and name,
+// the order is kept when sortBy is empty
+func sortWorkloads(workloads []Workload, sortBy string) {
+	byNamespaceName := func(a, b Workload) bool {
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	}
+
+	switch sortBy {
+	case SortByName:
+		sort.SliceStable(workloads, func(i, j int) bool {
+			if workloads[i].Name != workloads[j].Name {
+				return workloads[i].Name < workloads[j].Name
+			}
+			return workloads[i].Namespace < workloads[j].Namespace
+		})
+	case SortByNamespace:
+		sort.SliceStable(workloads, func(i, j int) bool {
+			return byNamespaceName(workloads[i], workloads[j])
+		})
+	case SortByReplicas:
+		sort.SliceStable(workloads, func(i, j int) bool {
+			if workloads[i].Replicas != workloads[j].Replicas {
+				return workloads[i].Replicas < workloads[j].Replicas
+			}
+			return byNamespaceName(workloads[i], workloads[j])
+		})
+	}
+}
+
+// GetDeployment returns a deployment, statefulset or custom resource scale object for HTTP request,
+// ?view=full returns the full view with the live status, HPA and pin status
 func (h *KubernetesClient) GetDeployment(res http.ResponseWriter, req *http.Request) error {
 	if req.Method != http.MethodGet {
 		return models.NewHTTPError(nil, http.StatusMethodNotAllowed, "Only GET method is allowed")
@@ -67,20 +174,28 @@ func (h *KubernetesClient) GetDeployment(res http.ResponseWriter, req *http.Requ
 	vars := mux.Vars(req)
 	namespace := vars["namespace"]
 	name := vars["name"]
+	resource, workloads, err := h.readWorkloadsForRequest(req)
+	if err != nil {
+		return err
+	}
 
-	d, err := h.Clientset.AppsV1().Deployments(namespace).Get(req.Context(), name, metav1.GetOptions{})
+	view, err := viewOf(req)
 	if err != nil {
-		return models.NewHTTPError(err, http.StatusNotFound, fmt.Sprintf("deployment %s not found in namespace %s.", name, namespace))
+		return err
 	}
 
-	if d.Spec.Replicas == nil {
-		return models.NewHTTPError(nil, http.StatusInternalServerError, fmt.Sprintf("spec replicas for deployment set %v is nil, this is unexpected", d.Name))
+	w, err := workloads.Get(req.Context(), namespace, name)
+	if err != nil {
+		return models.NewHTTPError(err, http.StatusNotFound, fmt.Sprintf("%s %s not found in namespace %s.", resourceKind(resource), name, namespace))
 	}
 
-	deployment := &models.Deployment{
-		Name:      d.ObjectMeta.Name,
-		Namespace: d.ObjectMeta.Namespace,
-		Replicas:  *d.Spec.Replicas,
+	var deployment interface{} = w.Model()
+	if view == ViewFull {
+		details, err := h.workloadDetails(req, resource, namespace, []Workload{*w})
+		if err != nil {
+			return err
+		}
+		deployment = details[0]
 	}
 	payload, err := json.Marshal(deployment)
 	if err != nil {
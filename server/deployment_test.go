@@ -7,9 +7,14 @@ import (
 	"github.com/innovia/portal/server/models"
 	"github.com/stretchr/testify/assert"
 	"io"
-	"k8s.io/client-go/kubernetes/fake"
+	v1 "k8s.io/api/apps/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 )
 
@@ -17,7 +22,7 @@ func TestGetAllDeploymentsFromAllNamespaces(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/api/v1/namespaces/deployments", nil)
 	res := httptest.NewRecorder()
 
-	clientSet := fake.NewSimpleClientset()
+	clientSet := newFakeClientset()
 	replicas := int32(3)
 	expectedDeployment := createDeployment(t, clientSet, &replicas, "default", "testers-choice", "nginx")
 
@@ -45,7 +50,7 @@ func TestGetAllDeploymentsFromAllNamespacesNoDeploymentsFound(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/api/v1/namespaces/deployments", nil)
 	res := httptest.NewRecorder()
 
-	clientSet := fake.NewSimpleClientset()
+	clientSet := newFakeClientset()
 	client := KubernetesClient{Clientset: clientSet}
 	err := client.GetDeployments(res, req)
 	if err != nil {
@@ -74,7 +79,7 @@ func TestGetAllDeploymentsFromSpecificNamespace(t *testing.T) {
 	}
 	req = mux.SetURLVars(req, vars)
 
-	clientSet := fake.NewSimpleClientset()
+	clientSet := newFakeClientset()
 	replicas := int32(3)
 	expectedDeployment1 := createDeployment(t, clientSet, &replicas, "example-1", namespace, "nginx")
 	expectedDeployment2 := createDeployment(t, clientSet, &replicas, "example-2", namespace, "nginx")
@@ -116,7 +121,7 @@ func TestGetAllDeploymentsFromSpecificNamespaceNotFound(t *testing.T) {
 	}
 	req = mux.SetURLVars(req, vars)
 
-	clientSet := fake.NewSimpleClientset()
+	clientSet := newFakeClientset()
 	client := KubernetesClient{Clientset: clientSet}
 	if err := client.GetDeployments(res, req); err != nil {
 		t.Fatalf("error getting deployments: %v", err)
@@ -144,7 +149,7 @@ func TestGetAllDeploymentsFromNonExistNamespace(t *testing.T) {
 	}
 	req = mux.SetURLVars(req, vars)
 
-	clientSet := fake.NewSimpleClientset()
+	clientSet := newFakeClientset()
 	client := KubernetesClient{Clientset: clientSet}
 	if err := client.GetDeployments(res, req); err != nil {
 		t.Fatalf("error getting deployments: %v", err)
@@ -177,7 +182,7 @@ func TestGetSingleDeploymentFromNamespace(t *testing.T) {
 
 	res := httptest.NewRecorder()
 
-	clientSet := fake.NewSimpleClientset()
+	clientSet := newFakeClientset()
 	expectedDeployment := createDeployment(t, clientSet, &replicas, name, namespace, image)
 
 	client := KubernetesClient{Clientset: clientSet}
@@ -211,7 +216,7 @@ func TestGetSingleDeploymentFromSpecificNamespaceNotFound(t *testing.T) {
 	}
 	req = mux.SetURLVars(req, vars)
 
-	clientSet := fake.NewSimpleClientset()
+	clientSet := newFakeClientset()
 	client := KubernetesClient{Clientset: clientSet}
 	if err := client.GetDeployments(res, req); err != nil {
 		t.Fatalf("error getting deployments: %v", err)
@@ -229,3 +234,144 @@ func TestGetSingleDeploymentFromSpecificNamespaceNotFound(t *testing.T) {
 	assert.Empty(t, actualDeployments.Items)
 	assert.Equal(t, 0, actualDeployments.Count)
 }
+
+func TestGetDeploymentsListOptions(t *testing.T) {
+	int32Ptr := func(i int32) *int32 { return &i }
+	// the fake clientset filters the listed items by the label selector
+	labels := map[string]string{"app": "web"}
+	items := []v1.Deployment{
+		{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "a", Labels: labels}, Spec: v1.DeploymentSpec{Replicas: int32Ptr(3)}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "b", Labels: labels}, Spec: v1.DeploymentSpec{Replicas: int32Ptr(1)}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "b", Labels: labels}, Spec: v1.DeploymentSpec{Replicas: int32Ptr(1)}},
+	}
+
+	testCases := []struct {
+		title, query                   string
+		listContinue                   string
+		listErr                        error
+		expectedCode                   int
+		expectedLabels, expectedFields string
+		expectedNames                  []string
+	}{
+		{
+			title:         "Should list without options",
+			expectedCode:  http.StatusOK,
+			expectedNames: []string{"a/web", "b/api", "b/web"},
+		}, {
+			title:          "Should pass selectors to the API server and return the continue token",
+			query:          "labelSelector=app%3Dweb,tier!=db&fieldSelector=metadata.name%3Dweb&limit=3&continue=page-1",
+			listContinue:   "page-2",
+			expectedCode:   http.StatusOK,
+			expectedLabels: "app=web,tier!=db",
+			expectedFields: "metadata.name=web",
+			expectedNames:  []string{"a/web", "b/api", "b/web"},
+		}, {
+			title:         "Should sort by name",
+			query:         "sort=name",
+			expectedCode:  http.StatusOK,
+			expectedNames: []string{"b/api", "a/web", "b/web"},
+		}, {
+			title:         "Should sort by namespace",
+			query:         "sort=namespace",
+			expectedCode:  http.StatusOK,
+			expectedNames: []string{"a/web", "b/api", "b/web"},
+		}, {
+			title:         "Should sort by replicas",
+			query:         "sort=replicas",
+			expectedCode:  http.StatusOK,
+			expectedNames: []string{"b/api", "b/web", "a/web"},
+		}, {
+			title:        "Should reject an unknown sort",
+			query:        "sort=age",
+			expectedCode: http.StatusBadRequest,
+		}, {
+			title:        "Should reject a sort of a page",
+			query:        "limit=3&sort=replicas",
+			expectedCode: http.StatusBadRequest,
+		}, {
+			title:        "Should reject a sort of a continued page",
+			query:        "continue=page-1&sort=name",
+			expectedCode: http.StatusBadRequest,
+		}, {
+			title:        "Should reject an invalid label selector",
+			query:        "labelSelector=app%3D%3D%3Dweb",
+			expectedCode: http.StatusBadRequest,
+		}, {
+			title:        "Should reject an invalid field selector",
+			query:        "fieldSelector=metadata.name",
+			expectedCode: http.StatusBadRequest,
+		}, {
+			title:        "Should return 410 for an expired continue token",
+			query:        "continue=expired",
+			listErr:      k8serrors.NewResourceExpired("continue token expired"),
+			expectedCode: http.StatusGone,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			api := newTestAPI(t)
+			var restrictions *k8stesting.ListRestrictions
+			api.clientSet.PrependReactor("list", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				r := action.(k8stesting.ListAction).GetListRestrictions()
+				restrictions = &r
+				if c.listErr != nil {
+					return true, nil, c.listErr
+				}
+				list := &v1.DeploymentList{Items: items}
+				list.Continue = c.listContinue
+				return true, list, nil
+			})
+
+			res := api.serve(httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/deployments?"+c.query, nil))
+			assert.Equal(t, c.expectedCode, res.Code)
+			if c.expectedCode != http.StatusOK {
+				assert.Equal(t, c.listErr != nil, restrictions != nil, "invalid options should not be sent to the API server")
+				return
+			}
+			assert.Equal(t, c.expectedLabels, restrictions.Labels.String())
+			assert.Equal(t, c.expectedFields, restrictions.Fields.String())
+
+			deployments := &models.Deployments{}
+			if err := json.Unmarshal(res.Body.Bytes(), deployments); err != nil {
+				t.Fatalf("error parsing json: %v", err)
+			}
+			var names []string
+			for _, d := range deployments.Items {
+				names = append(names, d.Namespace+"/"+d.Name)
+			}
+			assert.Equal(t, c.expectedNames, names)
+			assert.Equal(t, c.listContinue, deployments.Continue)
+		})
+	}
+}
+
+func TestListOptions(t *testing.T) {
+	testCases := []struct {
+		title, query string
+		expected     metav1.ListOptions
+		err          bool
+	}{
+		{title: "Should return empty options", expected: metav1.ListOptions{}},
+		{
+			title:    "Should set every option",
+			query:    "labelSelector=app%3Dweb&fieldSelector=metadata.namespace%3Dprod&limit=50&continue=token",
+			expected: metav1.ListOptions{LabelSelector: "app=web", FieldSelector: "metadata.namespace=prod", Limit: 50, Continue: "token"},
+		},
+		{title: "Should reject a negative limit", query: "limit=-1", err: true},
+		{title: "Should reject an invalid limit", query: "limit=all", err: true},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			query, _ := url.ParseQuery(c.query)
+			opts, err := listOptions(query)
+			if c.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, opts)
+		})
+	}
+}
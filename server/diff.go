@@ -9,6 +9,16 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"net/http"
+	"time"
+)
+
+// reconcile states of a diff
+const (
+	DiffReconcileInSync   = "in-sync"
+	DiffReconcilePending  = "pending"
+	DiffReconcileBackoff  = "backoff"
+	DiffReconcilePaused   = "paused"
+	DiffReconcileDisabled = "disabled"
 )
 
 // ReplicasDiff returns a replica diff information from what stored in state
@@ -20,43 +30,37 @@ func (h *KubernetesClient) ReplicasDiff(res http.ResponseWriter, req *http.Reque
 	vars := mux.Vars(req)
 	namespace := vars["namespace"]
 	name := vars["name"]
+	resource, workloads, err := h.readWorkloadsForRequest(req)
+	if err != nil {
+		return err
+	}
 
-	// Read current state for the given deployment name and namespace
-	status, err := h.ReadDeploymentState(req.Context(), name, namespace)
+	// Read current state for the given workload resource, name and namespace
+	status, err := h.ReadWorkloadState(req.Context(), resource, name, namespace)
 	if err != nil {
 		return models.NewHTTPError(err, http.StatusBadRequest, "error reading configmap for state")
 	}
 
 	if status == nil {
-		return models.NewHTTPError(nil, http.StatusNotFound, "No state found for given deployment and namespace")
+		return models.NewHTTPError(nil, http.StatusNotFound, fmt.Sprintf("No state found for given %s and namespace", resourceKind(resource)))
 	}
-	// Get the actual deployment
-	d, err := h.Clientset.AppsV1().Deployments(namespace).Get(req.Context(), name, metav1.GetOptions{})
+	// Get the actual workload
+	w, err := workloads.Get(req.Context(), namespace, name)
 	if errors.IsNotFound(err) {
-		return models.NewHTTPError(err, http.StatusNotFound, "deployment not found")
+		return models.NewHTTPError(err, http.StatusNotFound, fmt.Sprintf("%s not found", resourceKind(resource)))
 	}
 
 	if err != nil {
-		return models.NewHTTPError(err, http.StatusInternalServerError, "error getting deployment")
+		return models.NewHTTPError(err, http.StatusInternalServerError, fmt.Sprintf("error getting %s", resourceKind(resource)))
 	}
 
-	diff := &models.Diff{}
-	diff.Name = d.Name
-	diff.Namespace = d.Namespace
+	diff := diffOf(status, w, time.Now())
 
 	// json.Marshall has built in html escaping so that the JSON could be safely embedded in HTML/ script tags, the following section will render it without HTML escaping
 	var payload bytes.Buffer
 	enc := json.NewEncoder(&payload)
 	enc.SetEscapeHTML(false)
 
-	actualReplicas := *d.Spec.Replicas
-	expectedReplicas := status.Replicas
-
-	if actualReplicas != expectedReplicas {
-		diff.Diff = fmt.Sprintf("replicas: %d => %d", expectedReplicas, actualReplicas)
-	} else {
-		diff.Diff = "No Changes"
-	}
 	err = enc.Encode(diff)
 	if err != nil {
 		return models.NewHTTPError(err, http.StatusInternalServerError, "'could not encode diff changes to JSON")
@@ -66,3 +70,122 @@ func (h *KubernetesClient) ReplicasDiff(res http.ResponseWriter, req *http.Reque
 	res.Write(payload.Bytes())
 	return nil
 }
+
+// ListDiff returns the diff of every pinned workload whose replicas drifted from state for HTTP request,
+// if namespace is set only the workloads of that namespace are returned
+func (h *KubernetesClient) ListDiff(res http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return models.NewHTTPError(nil, http.StatusMethodNotAllowed, "only GET Method allowed.")
+	}
+
+	namespace := mux.Vars(req)["namespace"]
+	statuses, err := h.stateStore().List(req.Context())
+	if err != nil {
+		return models.NewHTTPError(err, http.StatusInternalServerError, "could not list state")
+	}
+
+	// workloads by resource and namespace/name, every resource in state is listed once
+	live := map[string]map[string]Workload{}
+	now := time.Now()
+	diffs := models.Diffs{Items: []models.Diff{}}
+	for i := range statuses {
+		status := &statuses[i]
+		if !status.Reconcile || pinExpired(status, now) || (namespace != "" && status.Namespace != namespace) {
+			continue
+		}
+
+		workloads, ok := live[status.Resource]
+		if !ok {
+			workloads, err = h.listDiffWorkloads(req, status.Resource, namespace)
+			if err != nil {
+				return err
+			}
+			live[status.Resource] = workloads
+		}
+
+		// a deleted workload is removed from state by the reconcile loop
+		w, found := workloads[status.Namespace+"/"+status.Name]
+		if !found {
+			continue
+		}
+		if diff := diffOf(status, &w, now); diff.Drifted {
+			diffs.Items = append(diffs.Items, *diff)
+		}
+	}
+	diffs.Count = len(diffs.Items)
+
+	var payload bytes.Buffer
+	enc := json.NewEncoder(&payload)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(diffs); err != nil {
+		return models.NewHTTPError(err, http.StatusInternalServerError, "'could not encode diff changes to JSON")
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(payload.Bytes())
+	return nil
+}
+
+// listDiffWorkloads returns the workloads of a resource in a namespace by namespace/name,
+// deployments and statefulsets are read from the informer cache like the other read routes
+func (h *KubernetesClient) listDiffWorkloads(req *http.Request, resource, namespace string) (map[string]Workload, error) {
+	workloads, err := h.workloads(resource)
+	if err == nil {
+		workloads, err = h.readWorkloads(req, resource, workloads)
+	}
+	if err != nil {
+		return nil, err
+	}
+	list, _, err := workloads.List(req.Context(), namespace, metav1.ListOptions{})
+	if err != nil {
+		return nil, models.NewHTTPError(err, http.StatusInternalServerError, fmt.Sprintf("error listing %s", ResourcePath(resource)))
+	}
+
+	byKey := make(map[string]Workload, len(list))
+	for _, w := range list {
+		byKey[w.Namespace+"/"+w.Name] = w
+	}
+	return byKey, nil
+}
+
+// diffOf compares the live replicas of a workload with the desired replicas in state
+func diffOf(status *models.Status, w *Workload, now time.Time) *models.Diff {
+	diff := &models.Diff{
+		Name:      w.Name,
+		Namespace: w.Namespace,
+		Resource:  w.Resource,
+		Diff:      "No Changes",
+		Expected:  status.Replicas,
+		Actual:    w.Replicas,
+		Ready:     w.ReadyReplicas,
+		Delta:     w.Replicas - status.Replicas,
+		Drifted:   w.Replicas != status.Replicas,
+		Reconcile: DiffReconcileInSync,
+	}
+	// an expired pin is no longer reconciled
+	pinned := status.Reconcile && !pinExpired(status, now)
+	if !diff.Drifted {
+		if !pinned {
+			diff.Reconcile = DiffReconcileDisabled
+		}
+		return diff
+	}
+
+	diff.Diff = fmt.Sprintf("replicas: %d => %d", status.Replicas, w.Replicas)
+	if status.DriftSince != nil {
+		diff.DriftSince = status.DriftSince
+		diff.DriftSeconds = int64(now.Sub(*status.DriftSince).Seconds())
+	}
+	diff.ReconcileFailures = status.ReconcileFailures
+	diff.LastReconcileError = status.LastReconcileError
+	switch {
+	case !pinned:
+		diff.Reconcile = DiffReconcileDisabled
+	case status.Paused:
+		diff.Reconcile = DiffReconcilePaused
+	case status.ReconcileFailures > 0:
+		diff.Reconcile = DiffReconcileBackoff
+	default:
+		diff.Reconcile = DiffReconcilePending
+	}
+	return diff
+}
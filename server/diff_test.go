@@ -7,9 +7,10 @@ import (
 	"github.com/innovia/portal/server/models"
 	"github.com/stretchr/testify/assert"
 	"io"
-	"k8s.io/client-go/kubernetes/fake"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestGetReplicasDiff(t *testing.T) {
@@ -37,7 +38,7 @@ func TestGetReplicasDiff(t *testing.T) {
 
 	for _, c := range testCases {
 		t.Run(c.title, func(t *testing.T) {
-			clientSet := fake.NewSimpleClientset()
+			clientSet := newFakeClientset()
 			client := KubernetesClient{Clientset: clientSet, Namespace: "default"}
 			r := int32(1)
 			deployment := createDeployment(t, clientSet, &r, c.name, c.namespace, c.image)
@@ -57,7 +58,7 @@ func TestGetReplicasDiff(t *testing.T) {
 			}
 
 			// scale replicas outside the server scope
-			_, err = client.ScaleDeploymentReplicas(context.Background(), deployment, &c.desiredReplicas)
+			_, err = client.ScaleDeploymentReplicas(context.Background(), deployment.Namespace, deployment.Name, c.desiredReplicas)
 			if err != nil {
 				t.Fatalf("error scaling replicas: %v", err)
 			}
@@ -93,3 +94,122 @@ func TestGetReplicasDiff(t *testing.T) {
 		})
 	}
 }
+
+func TestDiffOf(t *testing.T) {
+	now := time.Date(2022, 8, 30, 4, 20, 11, 0, time.UTC)
+	driftSince := now.Add(-90 * time.Second)
+	testCases := []struct {
+		title    string
+		status   models.Status
+		replicas int32
+		expected models.Diff
+	}{
+		{
+			title:    "Should report a workload in sync",
+			status:   models.Status{Deployment: models.Deployment{Replicas: 3}, Reconcile: true},
+			replicas: 3,
+			expected: models.Diff{Diff: "No Changes", Expected: 3, Actual: 3, Ready: 3, Reconcile: DiffReconcileInSync},
+		}, {
+			title:    "Should report a pending reconcile",
+			status:   models.Status{Deployment: models.Deployment{Replicas: 3}, Reconcile: true, DriftSince: &driftSince},
+			replicas: 5,
+			expected: models.Diff{
+				Diff: "replicas: 3 => 5", Expected: 3, Actual: 5, Ready: 5, Delta: 2, Drifted: true,
+				DriftSince: &driftSince, DriftSeconds: 90, Reconcile: DiffReconcilePending,
+			},
+		}, {
+			title: "Should report a reconcile backing off",
+			status: models.Status{
+				Deployment: models.Deployment{Replicas: 3}, Reconcile: true, DriftSince: &driftSince,
+				ReconcileFailures: 2, LastReconcileError: "forbidden",
+			},
+			replicas: 1,
+			expected: models.Diff{
+				Diff: "replicas: 3 => 1", Expected: 3, Actual: 1, Ready: 1, Delta: -2, Drifted: true,
+				DriftSince: &driftSince, DriftSeconds: 90, Reconcile: DiffReconcileBackoff,
+				ReconcileFailures: 2, LastReconcileError: "forbidden",
+			},
+		}, {
+			title:    "Should report a paused reconcile",
+			status:   models.Status{Deployment: models.Deployment{Replicas: 3}, Reconcile: true, Paused: true},
+			replicas: 4,
+			expected: models.Diff{Diff: "replicas: 3 => 4", Expected: 3, Actual: 4, Ready: 4, Delta: 1, Drifted: true, Reconcile: DiffReconcilePaused},
+		}, {
+			title:    "Should report a workload that is not pinned",
+			status:   models.Status{Deployment: models.Deployment{Replicas: 3}},
+			replicas: 4,
+			expected: models.Diff{Diff: "replicas: 3 => 4", Expected: 3, Actual: 4, Ready: 4, Delta: 1, Drifted: true, Reconcile: DiffReconcileDisabled},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			w := &Workload{Replicas: c.replicas, ReadyReplicas: c.replicas}
+			assert.Equal(t, &c.expected, diffOf(&c.status, w, now))
+		})
+	}
+}
+
+func TestListDiff(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+	clientSet := api.clientSet
+
+	replicas := int32(1)
+	for _, d := range []struct{ name, namespace string }{{"nginx", "test"}, {"web", "test"}, {"api", "prod"}, {"worker", "prod"}} {
+		createDeployment(t, clientSet, &replicas, d.name, d.namespace, "nginx")
+	}
+	createStatefulSet(t, clientSet, &replicas, "db", "prod", "postgres")
+	for _, status := range []models.Status{
+		{Deployment: models.Deployment{Name: "nginx", Namespace: "test", Replicas: 3}, Reconcile: true},
+		{Deployment: models.Deployment{Name: "web", Namespace: "test", Replicas: 3}},
+		{Deployment: models.Deployment{Name: "api", Namespace: "prod", Replicas: 2}, Reconcile: true, ReconcileFailures: 1},
+		{Deployment: models.Deployment{Name: "worker", Namespace: "prod", Replicas: 1}, Reconcile: true},
+		{Deployment: models.Deployment{Name: "db", Namespace: "prod", Replicas: 2, Resource: ResourceStatefulSets}, Reconcile: true},
+		{Deployment: models.Deployment{Name: "deleted", Namespace: "prod", Replicas: 2}, Reconcile: true},
+	} {
+		if err := api.client.UpdateState(ctx, &status); err != nil {
+			t.Fatalf("error updating state: %v", err)
+		}
+	}
+
+	testCases := []struct {
+		title, path  string
+		expectedCode int
+		expected     []string
+	}{
+		{
+			title:        "Should list every drifted pinned workload",
+			path:         "/api/v1/diff",
+			expectedCode: http.StatusOK,
+			expected:     []string{"prod/api pending=false", "prod/db pending=true", "test/nginx pending=true"},
+		}, {
+			title:        "Should list the drifted pinned workloads of a namespace",
+			path:         "/api/v1/namespaces/test/diff",
+			expectedCode: http.StatusOK,
+			expected:     []string{"test/nginx pending=true"},
+		}, {
+			title:        "Should return an empty list without drift",
+			path:         "/api/v1/namespaces/staging/diff",
+			expectedCode: http.StatusOK,
+			expected:     []string{},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			res := api.serve(httptest.NewRequest(http.MethodGet, c.path, nil))
+			assert.Equal(t, c.expectedCode, res.Code)
+
+			diffs := models.Diffs{}
+			assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &diffs))
+			actual := []string{}
+			for _, diff := range diffs.Items {
+				assert.True(t, diff.Drifted)
+				actual = append(actual, fmt.Sprintf("%s/%s pending=%t", diff.Namespace, diff.Name, diff.Reconcile == DiffReconcilePending))
+			}
+			assert.Equal(t, c.expected, actual)
+			assert.Equal(t, len(c.expected), diffs.Count)
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"github.com/innovia/portal/server/apis/v1alpha1"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+// EventComponent is the reporting component of the events recorded on reconciled workloads
+const EventComponent = "portal-replica-controller"
+
+// reasons of the events recorded on reconciled workloads
+const (
+	EventReasonDriftDetected   = "DriftDetected"
+	EventReasonDriftReconciled = v1alpha1.ReasonDriftReconciled
+	EventReasonReconcileFailed = v1alpha1.ReasonReconcileFailed
+	EventReasonStateRemoved    = "StateRemoved"
+)
+
+// NewEventRecorder returns an event recorder that writes events to the kubernetes API with the portal component
+// and the pod name as reporting instance, the returned func stops the recorder and flushes pending events
+func NewEventRecorder(clientset kubernetes.Interface) (record.EventRecorder, func()) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, coreV1.EventSource{Component: EventComponent, Host: getEnv("POD_NAME", "")})
+	return recorder, broadcaster.Shutdown
+}
+
+// recordEvent records an event on a workload, events are skipped when the client has no recorder
+// or the kind of the workload resource can not be resolved
+func (h *KubernetesClient) recordEvent(resource, namespace, name string, uid types.UID, eventType, reason, messageFmt string, args ...interface{}) {
+	if h.Recorder == nil {
+		return
+	}
+	ref, err := h.objectReference(resource, namespace, name, uid)
+	if err != nil {
+		klog.Errorf("error recording %s event for %s %s in namespace %s: %v", reason, resourceKind(resource), name, namespace, err)
+		return
+	}
+	h.Recorder.Eventf(ref, eventType, reason, messageFmt, args...)
+}
+
+// objectReference returns the reference of a workload that events are recorded on, the kind of custom resources
+// is resolved with the client rest mapper
+func (h *KubernetesClient) objectReference(resource, namespace, name string, uid types.UID) (*coreV1.ObjectReference, error) {
+	ref := &coreV1.ObjectReference{Namespace: namespace, Name: name, UID: uid}
+	switch resource {
+	case "":
+		ref.APIVersion, ref.Kind = "apps/v1", "Deployment"
+	case ResourceStatefulSets:
+		ref.APIVersion, ref.Kind = "apps/v1", "StatefulSet"
+	default:
+		gvk, err := h.Mapper.KindFor(GroupResource(resource).WithVersion(""))
+		if err != nil {
+			return nil, err
+		}
+		ref.APIVersion, ref.Kind = gvk.GroupVersion().String(), gvk.Kind
+	}
+	return ref, nil
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"github.com/innovia/portal/server/models"
+	"github.com/stretchr/testify/assert"
+	coreV1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+// waitForEvents waits until the fake clientset has the given number of events in a namespace and returns them
+func waitForEvents(t *testing.T, clientSet *fake.Clientset, namespace string, count int) []coreV1.Event {
+	var events []coreV1.Event
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		list, err := clientSet.CoreV1().Events(namespace).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			return false, err
+		}
+		events = list.Items
+		return len(events) >= count, nil
+	})
+	if err != nil {
+		t.Fatalf("expected %d events in namespace %s, got %d: %v", count, namespace, len(events), err)
+	}
+	return events
+}
+
+func TestReconcileEvents(t *testing.T) {
+	testCases := []struct {
+		title      string
+		deployment bool
+		replicas   int32
+		pinned     bool
+		deleted    bool
+		expected   []string
+	}{
+		{
+			title:      "Should record drift detected and reconciled events",
+			deployment: true,
+			replicas:   5,
+			pinned:     true,
+			expected:   []string{EventReasonDriftDetected, EventReasonDriftReconciled},
+		}, {
+			title:    "Should record reconcile failed event",
+			replicas: 5,
+			pinned:   true,
+			expected: []string{EventReasonDriftDetected, EventReasonReconcileFailed},
+		}, {
+			title:    "Should record state removed event",
+			pinned:   true,
+			deleted:  true,
+			expected: []string{EventReasonStateRemoved},
+		}, {
+			title:    "Should not record events for deleted workloads without state",
+			deleted:  true,
+			expected: []string{},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			ctx := context.Background()
+			clientSet := newFakeClientset()
+			recorder, stop := NewEventRecorder(clientSet)
+			defer stop()
+			client := KubernetesClient{Clientset: clientSet, Namespace: "default", State: NewMemoryStateStore(), Recorder: recorder}
+			r := ReplicasReconcile{Client: &client}
+
+			status := &models.Status{Deployment: models.Deployment{Name: "nginx", Namespace: "test", Replicas: 3}, Reconcile: true}
+			if c.pinned {
+				if err := client.UpdateState(ctx, status); err != nil {
+					t.Fatalf("error updating state: %v", err)
+				}
+			}
+			w := &Workload{Name: "nginx", Namespace: "test", Replicas: c.replicas, ReadyReplicas: c.replicas}
+			if c.deployment {
+				d := createDeployment(t, clientSet, &c.replicas, "nginx", "test", "nginx")
+				d.UID = types.UID("nginx-uid")
+				if _, err := clientSet.AppsV1().Deployments("test").Update(ctx, d, metav1.UpdateOptions{}); err != nil {
+					t.Fatalf("error updating deployment: %v", err)
+				}
+				w = deploymentWorkload(d)
+			}
+
+			if c.deleted {
+				assert.NoError(t, r.onDelete(ctx, reconcileKey{Namespace: "test", Name: "nginx"}))
+			} else {
+				_ = r.Reconcile(ctx, status, w)
+			}
+
+			// the broadcaster writes events asynchronously, it is stopped once the events were written
+			events := waitForEvents(t, clientSet, "test", len(c.expected))
+			reasons := []string{}
+			for _, event := range events {
+				reasons = append(reasons, event.Reason)
+				assert.Equal(t, EventComponent, event.Source.Component)
+				assert.Equal(t, "Deployment", event.InvolvedObject.Kind)
+				assert.Equal(t, "apps/v1", event.InvolvedObject.APIVersion)
+				assert.Equal(t, "nginx", event.InvolvedObject.Name)
+				assert.Equal(t, w.UID, event.InvolvedObject.UID)
+			}
+			assert.ElementsMatch(t, c.expected, reasons)
+		})
+	}
+}
+
+func TestObjectReference(t *testing.T) {
+	client := KubernetesClient{Mapper: newFakeRESTMapper()}
+	testCases := []struct {
+		title, resource, apiVersion, kind string
+	}{
+		{title: "Should reference deployments", resource: "", apiVersion: "apps/v1", kind: "Deployment"},
+		{title: "Should reference statefulsets", resource: ResourceStatefulSets, apiVersion: "apps/v1", kind: "StatefulSet"},
+		{title: "Should resolve the kind of custom resources", resource: "rollouts.argoproj.io", apiVersion: "argoproj.io/v1alpha1", kind: "Rollout"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			ref, err := client.objectReference(c.resource, "test", "web", "uid")
+			assert.NoError(t, err)
+			assert.Equal(t, c.apiVersion, ref.APIVersion)
+			assert.Equal(t, c.kind, ref.Kind)
+			assert.Equal(t, "test", ref.Namespace)
+			assert.Equal(t, "web", ref.Name)
+		})
+	}
+
+	_, err := client.objectReference("widgets.example.com", "test", "web", "")
+	assert.Error(t, err)
+}
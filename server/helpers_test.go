@@ -0,0 +1,410 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/innovia/portal/server/apis/v1alpha1"
+	"io"
+	v1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	coreV1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	fakescale "k8s.io/client-go/scale/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newFakeClientset returns a fake clientset that serves the scale subresource of deployments and statefulsets,
+// the object tracker of the fake clientset does not know about subresources
+func newFakeClientset(objects ...runtime.Object) *fake.Clientset {
+	c := fake.NewSimpleClientset(objects...)
+	addScaleReactors(c, "deployments")
+	addScaleReactors(c, "statefulsets")
+	return c
+}
+
+// addScaleReactors serves get and update of the scale subresource of a resource from the parent object,
+// an update carrying a stale resourceVersion is rejected with a conflict and every update bumps the resourceVersion
+func addScaleReactors(c *fake.Clientset, resource string) {
+	var mu sync.Mutex
+
+	c.PrependReactor("get", resource+"/scale", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj, err := c.Tracker().Get(action.GetResource(), action.GetNamespace(), action.(k8stesting.GetAction).GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		return true, objectScale(obj), nil
+	})
+
+	c.PrependReactor("update", resource+"/scale", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		scale := action.(k8stesting.UpdateAction).GetObject().(*autoscalingv1.Scale)
+		obj, err := c.Tracker().Get(action.GetResource(), action.GetNamespace(), scale.Name)
+		if err != nil {
+			return true, nil, err
+		}
+		objMeta, err := meta.Accessor(obj)
+		if err != nil {
+			return true, nil, err
+		}
+		if scale.ResourceVersion != "" && scale.ResourceVersion != objMeta.GetResourceVersion() {
+			return true, nil, k8serrors.NewConflict(action.GetResource().GroupResource(), scale.Name, fmt.Errorf("the object has been modified"))
+		}
+
+		replicas := scale.Spec.Replicas
+		switch o := obj.(type) {
+		case *v1.Deployment:
+			o.Spec.Replicas = &replicas
+		case *v1.StatefulSet:
+			o.Spec.Replicas = &replicas
+		}
+		version, _ := strconv.Atoi(objMeta.GetResourceVersion())
+		objMeta.SetResourceVersion(strconv.Itoa(version + 1))
+		if err := c.Tracker().Update(action.GetResource(), obj, action.GetNamespace()); err != nil {
+			return true, nil, err
+		}
+		return true, objectScale(obj), nil
+	})
+}
+
+// objectScale returns the scale subresource of a deployment or statefulset
+func objectScale(obj runtime.Object) *autoscalingv1.Scale {
+	scale := &autoscalingv1.Scale{}
+	var replicas *int32
+	switch o := obj.(type) {
+	case *v1.Deployment:
+		scale.ObjectMeta = metav1.ObjectMeta{Name: o.Name, Namespace: o.Namespace, UID: o.UID, ResourceVersion: o.ResourceVersion}
+		replicas = o.Spec.Replicas
+		scale.Status.Replicas = o.Status.Replicas
+	case *v1.StatefulSet:
+		scale.ObjectMeta = metav1.ObjectMeta{Name: o.Name, Namespace: o.Namespace, UID: o.UID, ResourceVersion: o.ResourceVersion}
+		replicas = o.Spec.Replicas
+		scale.Status.Replicas = o.Status.Replicas
+	}
+	scale.Spec.Replicas = 1
+	if replicas != nil {
+		scale.Spec.Replicas = *replicas
+	}
+	return scale
+}
+
+// testAPI is the API handler of a client over a fake clientset and a memory state store
+type testAPI struct {
+	t         *testing.T
+	clientSet *fake.Clientset
+	client    *KubernetesClient
+	handler   http.Handler
+}
+
+// newTestAPI returns a test API over a fake clientset holding objects, the optional fields of the client are set
+// before the first request since the handler is created on the first request
+func newTestAPI(t *testing.T, objects ...runtime.Object) *testAPI {
+	clientSet := newFakeClientset(objects...)
+	return &testAPI{
+		t:         t,
+		clientSet: clientSet,
+		client:    &KubernetesClient{Clientset: clientSet, Namespace: "default", State: NewMemoryStateStore()},
+	}
+}
+
+// serve serves req with the API handler and returns the recorded response
+func (a *testAPI) serve(req *http.Request) *httptest.ResponseRecorder {
+	if a.handler == nil {
+		handler, err := ApiHandler(a.client)
+		if err != nil {
+			a.t.Fatalf("error creating API handler: %v", err)
+		}
+		a.handler = handler
+	}
+	res := httptest.NewRecorder()
+	a.handler.ServeHTTP(res, req)
+	return res
+}
+
+// enforceResourceVersion adds reactors to the fake clientset that behave like the API server optimistic concurrency,
+// every write bumps the resourceVersion and an update carrying a stale resourceVersion is rejected with a conflict
+func enforceResourceVersion(c *fake.Clientset, resource string) {
+	var mu sync.Mutex
+
+	c.PrependReactor("create", resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		obj := action.(k8stesting.CreateAction).GetObject().DeepCopyObject()
+		objMeta, err := meta.Accessor(obj)
+		if err != nil {
+			return true, nil, err
+		}
+		objMeta.SetResourceVersion("1")
+		if err := c.Tracker().Create(action.GetResource(), obj, action.GetNamespace()); err != nil {
+			return true, nil, err
+		}
+		return true, obj, nil
+	})
+
+	c.PrependReactor("update", resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		obj := action.(k8stesting.UpdateAction).GetObject().DeepCopyObject()
+		objMeta, err := meta.Accessor(obj)
+		if err != nil {
+			return true, nil, err
+		}
+
+		current, err := c.Tracker().Get(action.GetResource(), action.GetNamespace(), objMeta.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		currentMeta, err := meta.Accessor(current)
+		if err != nil {
+			return true, nil, err
+		}
+
+		if objMeta.GetResourceVersion() != currentMeta.GetResourceVersion() {
+			return true, nil, k8serrors.NewConflict(action.GetResource().GroupResource(), objMeta.GetName(), fmt.Errorf("the object has been modified"))
+		}
+
+		version, _ := strconv.Atoi(currentMeta.GetResourceVersion())
+		objMeta.SetResourceVersion(strconv.Itoa(version + 1))
+		if err := c.Tracker().Update(action.GetResource(), obj, action.GetNamespace()); err != nil {
+			return true, nil, err
+		}
+		return true, obj, nil
+	})
+}
+
+// rolloutsResource is a custom resource with a scale subresource used in tests
+var rolloutsResource = schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"}
+
+// newFakeDynamicClient returns a fake dynamic client that knows how to list the portal custom resources and rollouts
+func newFakeDynamicClient(objects ...runtime.Object) *fakedynamic.FakeDynamicClient {
+	return fakedynamic.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		v1alpha1.ReplicaPolicyResource: v1alpha1.ReplicaPolicyListKind,
+		rolloutsResource:               "RolloutList",
+	}, objects...)
+}
+
+// newFakeRESTMapper returns a RESTMapper that resolves rollouts
+func newFakeRESTMapper() meta.RESTMapper {
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{rolloutsResource.GroupVersion()})
+	mapper.Add(rolloutsResource.GroupVersion().WithKind("Rollout"), meta.RESTScopeNamespace)
+	return mapper
+}
+
+// newFakeScaleClient returns a fake scale client that serves the scale subresource of rollouts
+// from the objects of a fake dynamic client, spec.replicas and status.replicas are the scale replicas
+func newFakeScaleClient(dynamicClient *fakedynamic.FakeDynamicClient) *fakescale.FakeScaleClient {
+	scales := &fakescale.FakeScaleClient{}
+	rollouts := func(namespace string) dynamic.ResourceInterface {
+		return dynamicClient.Resource(rolloutsResource).Namespace(namespace)
+	}
+
+	scales.AddReactor("get", rolloutsResource.Resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		get := action.(k8stesting.GetAction)
+		obj, err := rollouts(get.GetNamespace()).Get(context.Background(), get.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return true, nil, err
+		}
+		return true, unstructuredScale(obj), nil
+	})
+
+	scales.AddReactor("update", rolloutsResource.Resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		scale := action.(k8stesting.UpdateAction).GetObject().(*autoscalingv1.Scale)
+		obj, err := rollouts(action.GetNamespace()).Get(context.Background(), scale.Name, metav1.GetOptions{})
+		if err != nil {
+			return true, nil, err
+		}
+		if err := unstructured.SetNestedField(obj.Object, int64(scale.Spec.Replicas), "spec", "replicas"); err != nil {
+			return true, nil, err
+		}
+		obj, err = rollouts(action.GetNamespace()).Update(context.Background(), obj, metav1.UpdateOptions{})
+		if err != nil {
+			return true, nil, err
+		}
+		return true, unstructuredScale(obj), nil
+	})
+	return scales
+}
+
+func unstructuredScale(obj *unstructured.Unstructured) *autoscalingv1.Scale {
+	replicas, _, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	statusReplicas, _, _ := unstructured.NestedInt64(obj.Object, "status", "replicas")
+	return &autoscalingv1.Scale{
+		ObjectMeta: metav1.ObjectMeta{Name: obj.GetName(), Namespace: obj.GetNamespace()},
+		Spec:       autoscalingv1.ScaleSpec{Replicas: int32(replicas)},
+		Status:     autoscalingv1.ScaleStatus{Replicas: int32(statusReplicas)},
+	}
+}
+
+// newRollout returns a rollout custom resource with the given spec and status replicas
+func newRollout(name, namespace string, replicas int64) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": rolloutsResource.GroupVersion().String(),
+		"kind":       "Rollout",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": namespace,
+		},
+		"spec":   map[string]interface{}{"replicas": replicas},
+		"status": map[string]interface{}{"replicas": replicas},
+	}}
+}
+
+func createStatefulSet(t *testing.T, c *fake.Clientset, replicas *int32, name, namespace, image string) *v1.StatefulSet {
+	statefulSet := &v1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: v1.StatefulSetSpec{
+			Replicas: replicas,
+			Template: coreV1.PodTemplateSpec{
+				Spec: coreV1.PodSpec{
+					Containers: []coreV1.Container{
+						{
+							Name:  name,
+							Image: image,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	s, err := c.AppsV1().StatefulSets(namespace).Create(context.Background(), statefulSet, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("error creating statefulset: %v", err)
+	}
+	return s
+}
+
+// testCertificate is a certificate and its private key generated for tests
+type testCertificate struct {
+	Cert    *x509.Certificate
+	Key     *ecdsa.PrivateKey
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// newTestCertificate returns a certificate for commonName signed by parent, a nil parent returns a self-signed CA
+func newTestCertificate(t *testing.T, commonName string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("error generating serial: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	issuer, issuerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		issuer, issuerKey = parent.Cert, parent.Key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("error parsing certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("error marshaling key: %v", err)
+	}
+	return &testCertificate{
+		Cert:    cert,
+		Key:     key,
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writeFile writes data to name in dir and returns the path of the file
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("error writing %s: %v", path, err)
+	}
+	return path
+}
+
+// newTestTLSServer serves TLS with the config of reloader and returns a handshake function, handshake returns the serial
+// of the served certificate, or an error if the client certificate is rejected
+func newTestTLSServer(t *testing.T, reloader *CertificateReloader, ca *testCertificate) func(client *testCertificate) (string, error) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", reloader.TLSConfig())
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	return func(client *testCertificate) (string, error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.Cert)
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "localhost",
+			Certificates: []tls.Certificate{{Certificate: [][]byte{client.Cert.Raw}, PrivateKey: client.Key}},
+		})
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		// the server verifies the client certificate after the client finished the handshake
+		if _, err := conn.Read(make([]byte, 1)); err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.String(), nil
+	}
+}
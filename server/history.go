@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/innovia/portal/server/authz"
+	"github.com/innovia/portal/server/models"
+	"k8s.io/klog/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultHistoryLimit is the default number of replicas changes kept in the history of a workload
+const DefaultHistoryLimit = 10
+
+// sources of history entries
+const (
+	HistorySourceAPI       = "api"
+	HistorySourceReconcile = "reconcile"
+	HistorySourceRollback  = "rollback"
+)
+
+// historyLimit returns the number of history entries kept per workload
+func (h *KubernetesClient) historyLimit() int {
+	if h.HistoryLimit <= 0 {
+		return DefaultHistoryLimit
+	}
+	return h.HistoryLimit
+}
+
+// recordHistory appends a replicas change to the status history and drops the oldest entries over the limit,
+// the history is copied so statuses sharing the slice are not modified
+func (h *KubernetesClient) recordHistory(status *models.Status, actor, source, reason string, from, to int32) {
+	revision := int64(1)
+	if n := len(status.History); n > 0 {
+		revision = status.History[n-1].Revision + 1
+	}
+
+	history := make([]models.HistoryEntry, 0, len(status.History)+1)
+	history = append(history, status.History...)
+	history = append(history, models.HistoryEntry{
+		Revision: revision,
+		Time:     time.Now().UTC(),
+		Actor:    actor,
+		Source:   source,
+		Reason:   reason,
+		From:     from,
+		To:       to,
+	})
+	if limit := h.historyLimit(); len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	status.History = history
+}
+
+// actorOf returns the subject of the verified client certificate of a request, empty without one
+func actorOf(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return req.TLS.VerifiedChains[0][0].Subject.String()
+}
+
+// GetHistory returns the replicas history of a workload for HTTP GET requests, oldest first
+func (h *KubernetesClient) GetHistory(res http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return models.NewHTTPError(nil, http.StatusMethodNotAllowed, "only GET Method allowed.")
+	}
+
+	vars := mux.Vars(req)
+	namespace := vars["namespace"]
+	name := vars["name"]
+	resource, _, err := h.workloadsForRequest(vars)
+	if err != nil {
+		return err
+	}
+
+	status, err := h.ReadWorkloadState(req.Context(), resource, name, namespace)
+	if err != nil {
+		return models.NewHTTPError(err, http.StatusInternalServerError, "error reading configmap for state")
+	}
+	if status == nil {
+		return models.NewHTTPError(nil, http.StatusNotFound, fmt.Sprintf("No state found for given %s and namespace", resourceKind(resource)))
+	}
+
+	history := models.History{Count: len(status.History), Items: status.History}
+	if history.Items == nil {
+		history.Items = []models.HistoryEntry{}
+	}
+	payload, err := json.Marshal(history)
+	if err != nil {
+		return models.NewHTTPError(err, http.StatusInternalServerError, "invalid JSON for history.")
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(payload)
+	return nil
+}
+
+// RollbackReplicas scales a workload back to the replicas set by a history revision for HTTP POST requests,
+// a pinned workload stays pinned at the rolled back replicas. the target replicas are authorized like a scale
+// since they are not part of the route
+func (h *KubernetesClient) RollbackReplicas(res http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodPost {
+		return models.NewHTTPError(nil, http.StatusMethodNotAllowed, "only POST Method allowed.")
+	}
+
+	vars := mux.Vars(req)
+	namespace := vars["namespace"]
+	name := vars["name"]
+	revision, err := strconv.ParseInt(vars["revision"], 10, 64)
+	if err != nil {
+		return models.NewHTTPError(err, http.StatusBadRequest, "error can not convert revision to int64")
+	}
+	resource, workloads, err := h.workloadsForRequest(vars)
+	if err != nil {
+		return err
+	}
+
+	status, err := h.ReadWorkloadState(req.Context(), resource, name, namespace)
+	if err != nil {
+		return models.NewHTTPError(err, http.StatusInternalServerError, "error reading configmap for state")
+	}
+	var entry *models.HistoryEntry
+	if status != nil {
+		for i := range status.History {
+			if status.History[i].Revision == revision {
+				entry = &status.History[i]
+			}
+		}
+	}
+	if entry == nil {
+		return models.NewHTTPError(nil, http.StatusNotFound, fmt.Sprintf("revision %d not found in the history of %s %s in %s namespace", revision, resourceKind(resource), name, namespace))
+	}
+	replicas := entry.To
+
+	verb := authz.VerbScale
+	if status.Reconcile {
+		verb = authz.VerbReconcile
+	}
+	if h.Authorizer != nil {
+		if err := h.authorizeRequest(req, verb, &replicas); err != nil {
+			return err
+		}
+	}
+
+	w, from, err := h.scaleWorkload(req.Context(), workloads, resource, name, namespace, replicas)
+	if err != nil {
+		return err
+	}
+	status.Deployment = w.Model()
+	h.recordHistory(status, actorOf(req), HistorySourceRollback, "", from, replicas)
+	if err := h.UpdateState(req.Context(), status); err != nil {
+		return models.NewHTTPError(err, http.StatusInternalServerError, fmt.Sprintf("error updating state with replicas for %s %s in namespace %s", resourceKind(resource), name, namespace))
+	}
+	auditStatus(req.Context(), status)
+	klog.Infof("rolled back %s %s in namespace %s to revision %d with %d replicas", resourceKind(resource), name, namespace, revision, replicas)
+	return writeStatus(res, status)
+}
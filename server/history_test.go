@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"github.com/innovia/portal/server/authz"
+	"github.com/innovia/portal/server/models"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecordHistory(t *testing.T) {
+	testCases := []struct {
+		title             string
+		limit, changes    int
+		expectedRevisions []int64
+	}{
+		{title: "Should start at revision 1", changes: 1, expectedRevisions: []int64{1}},
+		{title: "Should keep the default limit", changes: DefaultHistoryLimit + 2, expectedRevisions: []int64{3, 4, 5, 6, 7, 8, 9, 10, 11, 12}},
+		{title: "Should drop the oldest entries over the limit", limit: 2, changes: 5, expectedRevisions: []int64{4, 5}},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			client := KubernetesClient{HistoryLimit: c.limit}
+			status := &models.Status{}
+			for i := 0; i < c.changes; i++ {
+				client.recordHistory(status, "CN=ci", HistorySourceAPI, "", int32(i), int32(i+1))
+			}
+			var revisions []int64
+			for _, entry := range status.History {
+				revisions = append(revisions, entry.Revision)
+			}
+			assert.Equal(t, c.expectedRevisions, revisions)
+			last := status.History[len(status.History)-1]
+			assert.Equal(t, int32(c.changes), last.To)
+			assert.False(t, last.Time.IsZero())
+		})
+	}
+
+	// statuses sharing the history are not modified
+	client := KubernetesClient{}
+	status := &models.Status{}
+	client.recordHistory(status, "", HistorySourceAPI, "", 1, 2)
+	shared := *status
+	client.recordHistory(status, "", HistorySourceAPI, "", 2, 3)
+	assert.Len(t, shared.History, 1)
+}
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+	clientSet, client := api.clientSet, api.client
+	replicas := int32(1)
+	createDeployment(t, clientSet, &replicas, "web", "staging", "nginx")
+	maxReplicas := int32(10)
+	client.Authorizer = &authz.PolicyAuthorizer{Policies: []authz.Policy{{
+		Name:        "ci",
+		Subjects:    authz.Subjects{CommonNames: []string{"ci"}},
+		Namespaces:  []string{"*"},
+		Deployments: []string{"*"},
+		Verbs:       []string{"*"},
+		MaxReplicas: &maxReplicas,
+	}}}
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: "ci"}}
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return api.serve(req)
+	}
+
+	res := serve(http.MethodGet, "/api/v1/namespaces/staging/deployments/web/history")
+	assert.Equal(t, http.StatusNotFound, res.Code)
+
+	// a scale through the API, a pin and a reconcile of a drift
+	assert.Equal(t, http.StatusOK, serve(http.MethodPut, "/api/v1/namespaces/staging/deployments/web/replicas/3").Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodPut, "/api/v1/namespaces/staging/deployments/web/replicas/4/reconcile").Code)
+	status, err := client.ReadWorkloadState(ctx, "", "web", "staging")
+	if err != nil {
+		t.Fatalf("error reading state: %v", err)
+	}
+	deployment, _ := clientSet.AppsV1().Deployments("staging").Get(ctx, "web", metav1.GetOptions{})
+	drifted := int32(6)
+	deployment.Spec.Replicas = &drifted
+	r := ReplicasReconcile{Client: client}
+	if err := r.Reconcile(ctx, status, deploymentWorkload(deployment)); err != nil {
+		t.Fatalf("error reconciling: %v", err)
+	}
+
+	res = serve(http.MethodGet, "/api/v1/namespaces/staging/deployments/web/history")
+	assert.Equal(t, http.StatusOK, res.Code)
+	history := models.History{}
+	assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &history))
+	for i := range history.Items {
+		history.Items[i].Time = status.Time
+	}
+	assert.Equal(t, models.History{Count: 3, Items: []models.HistoryEntry{
+		{Revision: 1, Time: status.Time, Actor: "CN=ci", Source: HistorySourceAPI, From: 1, To: 3},
+		{Revision: 2, Time: status.Time, Actor: "CN=ci", Source: HistorySourceAPI, From: 3, To: 4},
+		{Revision: 3, Time: status.Time, Actor: EventComponent, Source: HistorySourceReconcile, From: 6, To: 4},
+	}}, history)
+
+	testCases := []struct {
+		title, path      string
+		expectedCode     int
+		expectedReplicas int32
+	}{
+		{
+			title:            "Should roll back to a revision and keep the pin",
+			path:             "/api/v1/namespaces/staging/deployments/web/history/1/rollback",
+			expectedCode:     http.StatusOK,
+			expectedReplicas: 3,
+		}, {
+			title:            "Should return 404 for an unknown revision",
+			path:             "/api/v1/namespaces/staging/deployments/web/history/42/rollback",
+			expectedCode:     http.StatusNotFound,
+			expectedReplicas: 3,
+		}, {
+			title:            "Should return 400 for an invalid revision",
+			path:             "/api/v1/namespaces/staging/deployments/web/history/latest/rollback",
+			expectedCode:     http.StatusBadRequest,
+			expectedReplicas: 3,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			res := serve(http.MethodPost, c.path)
+			assert.Equal(t, c.expectedCode, res.Code)
+			deployment, _ := clientSet.AppsV1().Deployments("staging").Get(ctx, "web", metav1.GetOptions{})
+			assert.Equal(t, c.expectedReplicas, *deployment.Spec.Replicas)
+		})
+	}
+
+	status, _ = client.ReadWorkloadState(ctx, "", "web", "staging")
+	assert.True(t, status.Reconcile)
+	assert.Equal(t, int32(3), status.Replicas)
+	last := status.History[len(status.History)-1]
+	assert.Equal(t, models.HistoryEntry{Revision: 4, Time: last.Time, Actor: "CN=ci", Source: HistorySourceRollback, From: 4, To: 3}, last)
+
+	// the replicas of the revision are authorized
+	status.History[0].To = 30
+	assert.NoError(t, client.UpdateState(ctx, status))
+	assert.Equal(t, http.StatusForbidden, serve(http.MethodPost, "/api/v1/namespaces/staging/deployments/web/history/1/rollback").Code)
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/innovia/portal/server/models"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// leader election defaults
+const (
+	LeaderElectionLeaseName     = "portal-replica-controller"
+	LeaderElectionLeaseDuration = 15 * time.Second
+	LeaderElectionRenewDeadline = 10 * time.Second
+	LeaderElectionRetryPeriod   = 2 * time.Second
+)
+
+// LeaderElection holds the lease configuration used to elect a single replica that runs the reconcile loop,
+// all replicas keep serving the HTTP API regardless of the election result
+type LeaderElection struct {
+	LeaseName      string
+	LeaseNamespace string
+	Identity       string
+	LeaseDuration  time.Duration
+	RenewDeadline  time.Duration
+	RetryPeriod    time.Duration
+
+	mu      sync.RWMutex
+	elector *leaderelection.LeaderElector
+}
+
+// NewLeaderElection returns a leader election config with the default lease timings,
+// the identity is taken from the POD_NAME env var and falls back to the hostname
+func NewLeaderElection(leaseName, leaseNamespace string) (*LeaderElection, error) {
+	identity := getEnv("POD_NAME", "")
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("error getting hostname for leader election identity: %v", err)
+		}
+		identity = hostname
+	}
+
+	return &LeaderElection{
+		LeaseName:      leaseName,
+		LeaseNamespace: leaseNamespace,
+		Identity:       identity,
+		LeaseDuration:  LeaderElectionLeaseDuration,
+		RenewDeadline:  LeaderElectionRenewDeadline,
+		RetryPeriod:    LeaderElectionRetryPeriod,
+	}, nil
+}
+
+// Leader returns the identity of the current lease holder, empty if no leader was observed yet
+func (l *LeaderElection) Leader() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.elector == nil {
+		return ""
+	}
+	return l.elector.GetLeader()
+}
+
+// IsLeader returns true if this replica currently holds the lease
+func (l *LeaderElection) IsLeader() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.elector == nil {
+		return false
+	}
+	return l.elector.IsLeader()
+}
+
+func (l *LeaderElection) setElector(elector *leaderelection.LeaderElector) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.elector = elector
+}
+
+// RunLeaderElection campaigns for the lease and calls run with a context that is cancelled once leadership is lost.
+// if leadership is lost the replica goes back to campaigning, the function returns once stopCh is closed
+// and the lease was released so that another replica can take over without waiting for the lease to expire
+func (h *KubernetesClient) RunLeaderElection(ctx context.Context, stopCh <-chan struct{}, run func(ctx context.Context)) error {
+	l := h.LeaderElection
+	if l == nil {
+		return fmt.Errorf("leader election is not configured")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      l.LeaseName,
+			Namespace: l.LeaseNamespace,
+		},
+		Client: h.Clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: l.Identity,
+		},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		Name:            l.LeaseName,
+		LeaseDuration:   l.LeaseDuration,
+		RenewDeadline:   l.RenewDeadline,
+		RetryPeriod:     l.RetryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				klog.Infof("leader election: %s acquired lease %s/%s", l.Identity, l.LeaseNamespace, l.LeaseName)
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				klog.Infof("leader election: %s stopped leading", l.Identity)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != l.Identity {
+					klog.Infof("leader election: new leader elected %s", identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating leader elector: %v", err)
+	}
+	l.setElector(elector)
+
+	for {
+		// Run blocks until leadership is lost or the context is cancelled
+		elector.Run(ctx)
+
+		select {
+		case <-ctx.Done():
+			klog.Info("leader election: stopped")
+			return nil
+		default:
+			klog.Warningf("leader election: %s lost lease %s/%s, campaigning again", l.Identity, l.LeaseNamespace, l.LeaseName)
+		}
+	}
+}
+
+// Leader is a HTTP handler that returns the leader election status of this replica
+func (h *KubernetesClient) Leader(res http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return models.NewHTTPError(nil, http.StatusMethodNotAllowed, "only GET Method allowed.")
+	}
+
+	leader := &models.Leader{}
+	if h.LeaderElection != nil {
+		leader.Enabled = true
+		leader.Identity = h.LeaderElection.Identity
+		leader.Leader = h.LeaderElection.Leader()
+		leader.IsLeader = h.LeaderElection.IsLeader()
+	}
+
+	payload, err := json.Marshal(leader)
+	if err != nil {
+		return models.NewHTTPError(err, http.StatusInternalServerError, "invalid JSON for leader status.")
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(payload)
+	return nil
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/innovia/portal/server/models"
+	"github.com/stretchr/testify/assert"
+	"io"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLeaderElection(t *testing.T) {
+	ctx := context.Background()
+	clientSet := newFakeClientset()
+	client := KubernetesClient{
+		Clientset: clientSet,
+		Namespace: "default",
+		LeaderElection: &LeaderElection{
+			LeaseName:      LeaderElectionLeaseName,
+			LeaseNamespace: "default",
+			Identity:       "portal-0",
+			LeaseDuration:  2 * time.Second,
+			RenewDeadline:  time.Second,
+			RetryPeriod:    100 * time.Millisecond,
+		},
+	}
+
+	stopCh := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := client.RunLeaderElection(ctx, stopCh, func(ctx context.Context) {
+			close(started)
+			<-ctx.Done()
+		})
+		assert.NoError(t, err)
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for leadership")
+	}
+	assert.True(t, client.LeaderElection.IsLeader())
+
+	// leader status should be exposed on the health server
+	healthHandler, err := HealthCheckHandler(&client)
+	if err != nil {
+		t.Fatalf("error getting health check handler %v", err)
+	}
+	req, _ := http.NewRequest("GET", "/leader", nil)
+	res := httptest.NewRecorder()
+	healthHandler.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	leader := &models.Leader{}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("error reading json from response: %v", err)
+	}
+	if err = json.Unmarshal(body, leader); err != nil {
+		t.Fatalf("error parsing json: %v", err)
+	}
+	assert.Equal(t, models.Leader{Enabled: true, Identity: "portal-0", Leader: "portal-0", IsLeader: true}, *leader)
+
+	// on shutdown the lease should be released for the next replica
+	close(stopCh)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for leader election to stop")
+	}
+
+	lease, err := clientSet.CoordinationV1().Leases("default").Get(ctx, LeaderElectionLeaseName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting lease: %v", err)
+	}
+	assert.Empty(t, *lease.Spec.HolderIdentity)
+}
+
+func TestLeaderElectionDisabled(t *testing.T) {
+	client := KubernetesClient{Clientset: newFakeClientset(), Namespace: "default"}
+	req, _ := http.NewRequest("GET", "/leader", nil)
+	res := httptest.NewRecorder()
+	if err := client.Leader(res, req); err != nil {
+		t.Fatalf("error getting leader status: %v", err)
+	}
+
+	leader := &models.Leader{}
+	if err := json.Unmarshal(res.Body.Bytes(), leader); err != nil {
+		t.Fatalf("error parsing json: %v", err)
+	}
+	assert.False(t, leader.Enabled)
+	assert.False(t, leader.IsLeader)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"github.com/innovia/portal/server/models"
+	"sync"
+	"time"
+)
+
+// MemoryStateStore is a StateStore that keeps the state in process memory,
+// the state is lost on restart so it is meant for tests and local development
+type MemoryStateStore struct {
+	mu       sync.RWMutex
+	statuses map[string]models.Status
+}
+
+// NewMemoryStateStore returns an empty in-memory state store
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{
+		statuses: map[string]models.Status{},
+	}
+}
+
+// Read returns a copy of the status for a given workload resource, name and namespace
+func (s *MemoryStateStore) Read(_ context.Context, resource, name, namespace string) (*models.Status, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	status, ok := s.statuses[memoryStateKey(resource, name, namespace)]
+	if !ok {
+		return nil, nil
+	}
+	return &status, nil
+}
+
+// List returns a copy of every status in state
+func (s *MemoryStateStore) List(_ context.Context) ([]models.Status, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	statuses := make([]models.Status, 0, len(s.statuses))
+	for _, status := range s.statuses {
+		statuses = append(statuses, status)
+	}
+	sortStatuses(statuses)
+	return statuses, nil
+}
+
+// Update stores a copy of the status for a workload
+func (s *MemoryStateStore) Update(_ context.Context, status *models.Status) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status.Time = time.Now()
+	s.statuses[memoryStateKey(status.Resource, status.Name, status.Namespace)] = *status
+	return nil
+}
+
+// RecordDrift sets the drift tracking of a status on the stored status of the workload, the rest of the stored
+// status and its time are kept. a workload that is not in state is ignored
+func (s *MemoryStateStore) RecordDrift(_ context.Context, status *models.Status) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := memoryStateKey(status.Resource, status.Name, status.Namespace)
+	current, ok := s.statuses[key]
+	if !ok || !setDrift(&current, status) {
+		return nil
+	}
+	s.statuses[key] = current
+	return nil
+}
+
+// Delete removes a workload from state
+func (s *MemoryStateStore) Delete(_ context.Context, resource, name, namespace string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.statuses, memoryStateKey(resource, name, namespace))
+	return nil
+}
+
+func memoryStateKey(resource, name, namespace string) string {
+	return resource + "/" + namespace + "/" + name
+}
@@ -0,0 +1,234 @@
+// Package metrics holds the prometheus registry and collectors exposed on the health server /metrics endpoint
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/client-go/util/workqueue"
+	"net/http"
+)
+
+// Namespace is the prefix of every portal metric
+const Namespace = "portal"
+
+// Registry is the prometheus registry of all portal metrics
+var Registry = prometheus.NewRegistry()
+
+// workqueue metrics, labeled by queue name
+var (
+	workqueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "workqueue",
+		Name:      "depth",
+		Help:      "Current depth of the workqueue.",
+	}, []string{"name"})
+
+	workqueueAdds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "workqueue",
+		Name:      "adds_total",
+		Help:      "Total number of adds handled by the workqueue.",
+	}, []string{"name"})
+
+	workqueueLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "workqueue",
+		Name:      "queue_duration_seconds",
+		Help:      "How long in seconds an item stays in the workqueue before being processed.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 10, 7),
+	}, []string{"name"})
+
+	workqueueWorkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "workqueue",
+		Name:      "work_duration_seconds",
+		Help:      "How long in seconds processing an item from the workqueue takes.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 10, 7),
+	}, []string{"name"})
+
+	workqueueUnfinishedWork = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "workqueue",
+		Name:      "unfinished_work_seconds",
+		Help:      "How many seconds of work has been done that is in progress and has not been observed by work_duration.",
+	}, []string{"name"})
+
+	workqueueLongestRunningProcessor = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "workqueue",
+		Name:      "longest_running_processor_seconds",
+		Help:      "How many seconds has the longest running processor for the workqueue been running.",
+	}, []string{"name"})
+
+	workqueueRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "workqueue",
+		Name:      "retries_total",
+		Help:      "Total number of retries handled by the workqueue.",
+	}, []string{"name"})
+)
+
+// TLSReloads counts reloads of the serving TLS material, material is certificate, ca or crl and result is success or error
+var TLSReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: Namespace,
+	Subsystem: "tls",
+	Name:      "reloads_total",
+	Help:      "Total number of reloads of the server certificate, client CA bundle and CRL by result.",
+}, []string{"material", "result"})
+
+// AuditErrors counts audit records that could not be written by sink, file, stdout or webhook
+var AuditErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: Namespace,
+	Subsystem: "audit",
+	Name:      "errors_total",
+	Help:      "Total number of audit records that could not be written or sent by sink.",
+}, []string{"sink"})
+
+// API metrics, route is the name of the API route
+var (
+	APIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "api",
+		Name:      "requests_total",
+		Help:      "Total number of API requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	APIRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "api",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of API requests in seconds by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+)
+
+// reconcile metrics, resource is the API path resource of the workload
+var (
+	ReconcileDrifts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "reconcile",
+		Name:      "drifts_total",
+		Help:      "Total number of detected drifts between the desired and the actual replicas.",
+	}, []string{"resource"})
+
+	ReconcileActions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "reconcile",
+		Name:      "actions_total",
+		Help:      "Total number of reconcile scale actions by result, success or failure.",
+	}, []string{"resource", "result"})
+
+	desiredReplicas = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "reconcile",
+		Name:      "desired_replicas",
+		Help:      "Desired replicas in state of a pinned workload.",
+	}, []string{"resource", "namespace", "name"})
+
+	actualReplicas = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "reconcile",
+		Name:      "actual_replicas",
+		Help:      "Replicas in the spec of a pinned workload.",
+	}, []string{"resource", "namespace", "name"})
+)
+
+// state metrics, backend is the state backend and operation one of read, list, update or delete
+var (
+	StateOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "state",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of state operations in seconds by backend, operation and result, success or failure.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "operation", "result"})
+
+	StateConflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "state",
+		Name:      "conflicts_total",
+		Help:      "Total number of state writes retried after a conflicting concurrent write.",
+	}, []string{"backend"})
+)
+
+// Result returns the result label of an operation, success or failure
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// SetReplicas sets the desired and actual replicas of a pinned workload
+func SetReplicas(resource, namespace, name string, desired, actual int32) {
+	desiredReplicas.WithLabelValues(resource, namespace, name).Set(float64(desired))
+	actualReplicas.WithLabelValues(resource, namespace, name).Set(float64(actual))
+}
+
+// DeleteReplicas removes the replicas of a workload that is no longer pinned
+func DeleteReplicas(resource, namespace, name string) {
+	desiredReplicas.DeleteLabelValues(resource, namespace, name)
+	actualReplicas.DeleteLabelValues(resource, namespace, name)
+}
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		workqueueDepth,
+		workqueueAdds,
+		workqueueLatency,
+		workqueueWorkDuration,
+		workqueueUnfinishedWork,
+		workqueueLongestRunningProcessor,
+		workqueueRetries,
+		TLSReloads,
+		AuditErrors,
+		APIRequests,
+		APIRequestDuration,
+		ReconcileDrifts,
+		ReconcileActions,
+		desiredReplicas,
+		actualReplicas,
+		StateOperationDuration,
+		StateConflicts,
+	)
+	workqueue.SetProvider(workqueueMetricsProvider{})
+}
+
+// Handler returns the HTTP handler that serves the metrics in the registry
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// workqueueMetricsProvider implements the client-go workqueue MetricsProvider with the collectors above
+type workqueueMetricsProvider struct{}
+
+func (workqueueMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return workqueueDepth.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return workqueueAdds.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return workqueueLatency.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return workqueueWorkDuration.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return workqueueUnfinishedWork.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return workqueueLongestRunningProcessor.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return workqueueRetries.WithLabelValues(name)
+}
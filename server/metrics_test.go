@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/innovia/portal/server/metrics"
+	"github.com/innovia/portal/server/models"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+	"net/http"
+	"testing"
+)
+
+// gaugeValue returns the value of a gauge in the metrics registry, nil if the gauge has no series with the labels
+func gaugeValue(t *testing.T, name string, labels map[string]string) *float64 {
+	m := findMetric(t, name, labels)
+	if m == nil {
+		return nil
+	}
+	value := m.GetGauge().GetValue()
+	return &value
+}
+
+// sampleCount returns the number of observations of a histogram in the metrics registry
+func sampleCount(t *testing.T, name string, labels map[string]string) uint64 {
+	m := findMetric(t, name, labels)
+	if m == nil {
+		return 0
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+// findMetric returns the series of a metric in the metrics registry with the labels
+func findMetric(t *testing.T, name string, labels map[string]string) *dto.Metric {
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("error gathering metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metric:
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metric
+				}
+			}
+			return m
+		}
+	}
+	return nil
+}
+
+func TestAPIMetrics(t *testing.T) {
+	clientSet := newFakeClientset()
+	client := KubernetesClient{Clientset: clientSet, Namespace: "default", State: NewMemoryStateStore()}
+	replicas := int32(1)
+	createDeployment(t, clientSet, &replicas, "nginx", "test", "nginx")
+	server := createHttpTestServer(t, client, clientSet)
+
+	testCases := []struct {
+		title, method, path, route, code string
+	}{
+		{title: "Should count successful requests", method: http.MethodGet, path: "/api/v1/namespaces/test/deployments/nginx", route: routeGetWorkload, code: "200"},
+		{title: "Should count errors", method: http.MethodGet, path: "/api/v1/namespaces/test/deployments/missing", route: routeGetWorkload, code: "404"},
+		{title: "Should count requests by route", method: http.MethodPut, path: "/api/v1/namespaces/test/deployments/nginx/replicas/2", route: routeScaleReplicas, code: "200"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			counter := metrics.APIRequests.WithLabelValues(c.route, c.method, c.code)
+			before := testutil.ToFloat64(counter)
+			req, _ := http.NewRequest(c.method, server.URL+c.path, nil)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("error calling %s: %v", c.path, err)
+			}
+			res.Body.Close()
+			assert.Equal(t, before+1, testutil.ToFloat64(counter))
+		})
+	}
+}
+
+func TestReconcileMetrics(t *testing.T) {
+	ctx := context.Background()
+	clientSet := newFakeClientset()
+	client := KubernetesClient{Clientset: clientSet, Namespace: "default", State: NewMemoryStateStore()}
+	replicas := int32(5)
+	createDeployment(t, clientSet, &replicas, "metrics", "test", "nginx")
+	status := &models.Status{Deployment: models.Deployment{Name: "metrics", Namespace: "test", Replicas: 3}, Reconcile: true}
+	if err := client.UpdateState(ctx, status); err != nil {
+		t.Fatalf("error updating state: %v", err)
+	}
+	r := ReplicasReconcile{Client: &client}
+	w := &Workload{Name: "metrics", Namespace: "test", Replicas: 5, ReadyReplicas: 5}
+	labels := map[string]string{"resource": ResourceDeployments, "namespace": "test", "name": "metrics"}
+
+	drifts := testutil.ToFloat64(metrics.ReconcileDrifts.WithLabelValues(ResourceDeployments))
+	actions := testutil.ToFloat64(metrics.ReconcileActions.WithLabelValues(ResourceDeployments, "success"))
+	if err := r.Reconcile(ctx, status, w); err != nil {
+		t.Fatalf("error reconciling: %v", err)
+	}
+	assert.Equal(t, drifts+1, testutil.ToFloat64(metrics.ReconcileDrifts.WithLabelValues(ResourceDeployments)))
+	assert.Equal(t, actions+1, testutil.ToFloat64(metrics.ReconcileActions.WithLabelValues(ResourceDeployments, "success")))
+	assert.Equal(t, float64(3), *gaugeValue(t, "portal_reconcile_desired_replicas", labels))
+	assert.Equal(t, float64(3), *gaugeValue(t, "portal_reconcile_actual_replicas", labels))
+
+	// a failed scale is counted as a failure
+	failures := testutil.ToFloat64(metrics.ReconcileActions.WithLabelValues(ResourceDeployments, "failure"))
+	missing := &Workload{Name: "missing", Namespace: "test", Replicas: 5, ReadyReplicas: 5}
+	assert.Error(t, r.Reconcile(ctx, &models.Status{Deployment: models.Deployment{Name: "missing", Namespace: "test", Replicas: 3}, Reconcile: true}, missing))
+	assert.Equal(t, failures+1, testutil.ToFloat64(metrics.ReconcileActions.WithLabelValues(ResourceDeployments, "failure")))
+
+	// unpinned workloads have no replicas gauge
+	server := createHttpTestServer(t, client, clientSet)
+	req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/api/v1/namespaces/test/deployments/metrics/reconcile", server.URL), nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error unpinning deployment: %v", err)
+	}
+	res.Body.Close()
+	assert.Nil(t, gaugeValue(t, "portal_reconcile_desired_replicas", labels))
+	assert.Nil(t, gaugeValue(t, "portal_reconcile_actual_replicas", labels))
+}
+
+func TestStateMetrics(t *testing.T) {
+	ctx := context.Background()
+	clientSet := newFakeClientset()
+	enforceResourceVersion(clientSet, "configmaps")
+	client := KubernetesClient{Clientset: clientSet, Namespace: "default"}
+	if _, err := client.GetState(ctx); err != nil {
+		t.Fatalf("error reading state: %v", err)
+	}
+
+	// modify the state configmap between the read and the write of the first update
+	writes := 0
+	clientSet.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		writes++
+		if writes > 1 {
+			return false, nil, nil
+		}
+		obj, err := clientSet.Tracker().Get(action.GetResource(), action.GetNamespace(), StateConfigMapName)
+		if err != nil {
+			return true, nil, err
+		}
+		cm := obj.(*coreV1.ConfigMap)
+		cm.ResourceVersion = "10"
+		return false, nil, clientSet.Tracker().Update(action.GetResource(), cm, action.GetNamespace())
+	})
+
+	conflicts := testutil.ToFloat64(metrics.StateConflicts.WithLabelValues(StateBackendConfigMap))
+	updates := sampleCount(t, "portal_state_operation_duration_seconds", map[string]string{"backend": StateBackendConfigMap, "operation": "update", "result": "success"})
+	status := &models.Status{Deployment: models.Deployment{Name: "nginx", Namespace: "test", Replicas: 2}}
+	if err := client.UpdateState(ctx, status); err != nil {
+		t.Fatalf("error updating state: %v", err)
+	}
+	if _, err := client.ReadDeploymentState(ctx, "nginx", "test"); err != nil {
+		t.Fatalf("error reading state: %v", err)
+	}
+	assert.Equal(t, conflicts+1, testutil.ToFloat64(metrics.StateConflicts.WithLabelValues(StateBackendConfigMap)))
+	assert.Equal(t, updates+1, sampleCount(t, "portal_state_operation_duration_seconds", map[string]string{"backend": StateBackendConfigMap, "operation": "update", "result": "success"}))
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
 )
 
 // ClientError is an error whose details to be shared with client.
@@ -22,9 +23,16 @@ type ClientError interface {
 
 // HTTPError implements ClientError interface.
 type HTTPError struct {
-	Cause  error  `json:"-"`
+	Cause  error        `json:"-"`
+	Detail string       `json:"detail"`
+	Errors []FieldError `json:"errors,omitempty"` // Errors lists the invalid fields of a request body
+	Status int          `json:"-"`
+}
+
+// FieldError is a validation error of a request body field
+type FieldError struct {
+	Field  string `json:"field"`
 	Detail string `json:"detail"`
-	Status int    `json:"-"`
 }
 
 func (e *HTTPError) Error() string {
@@ -34,6 +42,11 @@ func (e *HTTPError) Error() string {
 	return e.Detail + " : " + e.Cause.Error()
 }
 
+// Unwrap returns the underlying cause so that errors.Is and errors.As can inspect it
+func (e *HTTPError) Unwrap() error {
+	return e.Cause
+}
+
 // ResponseBody returns JSON response body.
 func (e *HTTPError) ResponseBody() ([]byte, error) {
 	body, err := json.Marshal(e)
@@ -58,3 +71,12 @@ func NewHTTPError(err error, status int, detail string) error {
 		Status: status,
 	}
 }
+
+// NewValidationError will hold the invalid fields of a request body with the 422 status code
+func NewValidationError(detail string, fieldErrors []FieldError) error {
+	return &HTTPError{
+		Detail: detail,
+		Errors: fieldErrors,
+		Status: http.StatusUnprocessableEntity,
+	}
+}
@@ -4,8 +4,9 @@ import "time"
 
 // Deployments holds a list of Deployment scale information along with count
 type Deployments struct {
-	Count int          `json:"count"`
-	Items []Deployment `json:"deployments"`
+	Count    int          `json:"count"`
+	Items    []Deployment `json:"deployments"`
+	Continue string       `json:"continue,omitempty"` // Continue is the token of the next page, empty on the last page
 }
 
 // Deployment hold the scale information for a deployment
@@ -13,18 +14,151 @@ type Deployment struct {
 	Name      string `json:"name"`
 	Namespace string `json:"namespace"`
 	Replicas  int32  `json:"replicas"`
+	Resource  string `json:"resource,omitempty"` // Resource is empty for deployments, statefulsets or <resource>.<group> otherwise
+}
+
+// DeploymentDetails holds a list of the full view of deployments along with count
+type DeploymentDetails struct {
+	Count    int                `json:"count"`
+	Items    []DeploymentDetail `json:"deployments"`
+	Continue string             `json:"continue,omitempty"` // Continue is the token of the next page, empty on the last page
+}
+
+// DeploymentDetail is the full view of a deployment, the live status, the HPA scaling it and the pin status in state
+type DeploymentDetail struct {
+	Deployment
+	StatusReplicas     int32       `json:"statusReplicas"`
+	ReadyReplicas      int32       `json:"readyReplicas"`
+	AvailableReplicas  int32       `json:"availableReplicas"`
+	UpdatedReplicas    int32       `json:"updatedReplicas"`
+	Generation         int64       `json:"generation,omitempty"`
+	ObservedGeneration int64       `json:"observedGeneration,omitempty"`
+	Conditions         []Condition `json:"conditions,omitempty"`
+	HPA                *HPA        `json:"hpa,omitempty"`   // HPA is set when a HorizontalPodAutoscaler targets the deployment
+	State              *PinStatus  `json:"state,omitempty"` // State is set when the deployment is in state
+}
+
+// Condition is a rollout condition of a deployment
+type Condition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"`
+	Reason             string    `json:"reason,omitempty"`
+	Message            string    `json:"message,omitempty"`
+	LastTransitionTime time.Time `json:"lastTransitionTime,omitempty"`
+}
+
+// HPA is the HorizontalPodAutoscaler owning the replicas of a deployment
+type HPA struct {
+	Name            string `json:"name"`
+	MinReplicas     int32  `json:"minReplicas"`
+	MaxReplicas     int32  `json:"maxReplicas"`
+	CurrentReplicas int32  `json:"currentReplicas"`
+	DesiredReplicas int32  `json:"desiredReplicas"`
+}
+
+// PinStatus is the state of a deployment, Replicas are the desired replicas
+type PinStatus struct {
+	Replicas          int32      `json:"replicas"`
+	Reconcile         bool       `json:"reconcile"`
+	Paused            bool       `json:"paused"`
+	Time              time.Time  `json:"time"`
+	LastReconcileTime *time.Time `json:"lastReconcileTime,omitempty"`
 }
 
 // Status is a struct that will be saved as the status of a deployment in the state
 type Status struct {
 	Deployment
 	Reconcile bool      `json:"reconcile"`
-	Time      time.Time `json:"time"` // Time is the time when the request was submitted.
+	Paused    bool      `json:"paused"` // Paused stops reconciling a pinned deployment while keeping the desired replicas
+	Time      time.Time `json:"time"`   // Time is the time when the request was submitted.
+	// LastReconcileTime is the time the reconcile loop last scaled the deployment back to the desired replicas
+	LastReconcileTime *time.Time `json:"lastReconcileTime,omitempty"`
+	// History holds the last replicas changes of the deployment, oldest first
+	History []HistoryEntry `json:"history,omitempty"`
+	// DriftSince is the time the reconcile loop first saw the replicas of a pinned deployment differ from the desired replicas
+	DriftSince *time.Time `json:"driftSince,omitempty"`
+	// ReconcileFailures counts the failed reconciles of the current drift, reconcile retries with backoff
+	ReconcileFailures  int    `json:"reconcileFailures,omitempty"`
+	LastReconcileError string `json:"lastReconcileError,omitempty"`
+	// Expiry is the time the reconcile loop stops reconciling a pinned deployment, the pin does not expire when nil
+	Expiry *time.Time `json:"expiry,omitempty"`
+}
+
+// HistoryEntry is a change of the replicas of a deployment
+type HistoryEntry struct {
+	Revision int64     `json:"revision"` // Revision increases with every change and is kept when older entries are dropped
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor,omitempty"`  // Actor is the client certificate subject or the controller for reconcile changes
+	Source   string    `json:"source"`           // Source is api, reconcile or rollback
+	Reason   string    `json:"reason,omitempty"` // Reason is the reason given with a scale request
+	From     int32     `json:"from"`
+	To       int32     `json:"to"`
+}
+
+// History holds the replicas history of a deployment along with count
+type History struct {
+	Count int            `json:"count"`
+	Items []HistoryEntry `json:"history"`
+}
+
+// StateEntries holds a list of statuses in state along with count
+type StateEntries struct {
+	Count int          `json:"count"`
+	Items []StateEntry `json:"state"`
+}
+
+// StateEntry is a status in state with the live replicas of the deployment
+type StateEntry struct {
+	Status
+	LiveReplicas *int32 `json:"liveReplicas"` // LiveReplicas is nil when the deployment was not found
+	Drift        bool   `json:"drift"`        // Drift is true when the live replicas differ from the desired replicas
 }
 
 // Diff holds diff information for a deployment whose replicas have changed from whats store in state
 type Diff struct {
 	Name      string `json:"name"`
 	Namespace string `json:"namespace"`
-	Diff      string `json:"diff"`
+	Resource  string `json:"resource,omitempty"`
+	Diff      string `json:"diff"`     // Diff is "replicas: <expected> => <actual>" or "No Changes"
+	Expected  int32  `json:"expected"` // Expected is the desired replicas in state
+	Actual    int32  `json:"actual"`   // Actual is the spec replicas of the deployment
+	Ready     int32  `json:"ready"`
+	Delta     int32  `json:"delta"` // Delta is actual minus expected replicas
+	Drifted   bool   `json:"drifted"`
+	// DriftSince is the time the reconcile loop first saw the drift, DriftSeconds is the time since then
+	DriftSince   *time.Time `json:"driftSince,omitempty"`
+	DriftSeconds int64      `json:"driftSeconds,omitempty"`
+	// Reconcile is in-sync, pending, backoff (a reconcile failed and is retried), paused or disabled (not pinned)
+	Reconcile          string `json:"reconcile"`
+	ReconcileFailures  int    `json:"reconcileFailures,omitempty"`
+	LastReconcileError string `json:"lastReconcileError,omitempty"`
+}
+
+// Diffs holds a list of diffs along with count
+type Diffs struct {
+	Count int    `json:"count"`
+	Items []Diff `json:"diffs"`
+}
+
+// ScaleRequest is the JSON body of PUT and PATCH requests on the scale of a deployment, on PATCH the fields
+// that are not set keep their current value
+type ScaleRequest struct {
+	Replicas  *int32     `json:"replicas"`
+	Reconcile *bool      `json:"reconcile"`        // Reconcile pins the deployment at the replicas
+	Reason    string     `json:"reason,omitempty"` // Reason is kept in the history and the audit record of the change
+	DryRun    bool       `json:"dryRun,omitempty"` // DryRun validates the request and returns the resulting state without scaling
+	Expiry    *time.Time `json:"expiry,omitempty"` // Expiry ends the pin at the given time, requires reconcile
+}
+
+// ReconcilePatch is the body of a PATCH request on the reconcile settings of a deployment
+type ReconcilePatch struct {
+	Paused *bool `json:"paused"`
+}
+
+// Leader holds the leader election status of a portal replica
+type Leader struct {
+	Enabled  bool   `json:"enabled"`
+	Identity string `json:"identity"` // Identity is the identity of this replica
+	Leader   string `json:"leader"`   // Leader is the identity of the current lease holder
+	IsLeader bool   `json:"isLeader"`
 }
@@ -0,0 +1,289 @@
+// Package pki issues the CA, server and client certificates of the portal mTLS API
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// private key types
+const (
+	KeyTypeECDSA   = "ecdsa"   // KeyTypeECDSA is an ECDSA P-256 key
+	KeyTypeEd25519 = "ed25519" // KeyTypeEd25519 is an Ed25519 key
+)
+
+// default validity of issued certificates
+const (
+	DefaultCAValidity          = 5 * 365 * 24 * time.Hour
+	DefaultCertificateValidity = 30 * 24 * time.Hour
+)
+
+// clockSkew backdates certificates so they are valid on hosts with a slightly late clock
+const clockSkew = 5 * time.Minute
+
+// Options are the subject, SANs, key type and validity of a certificate
+type Options struct {
+	KeyType             string
+	Validity            time.Duration
+	CommonName          string
+	Organization        []string
+	OrganizationalUnits []string
+	DNSNames            []string
+	IPAddresses         []net.IP
+	URIs                []*url.URL
+}
+
+// KeyPair is a certificate and its private key
+type KeyPair struct {
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+}
+
+// NewCA returns a self-signed CA
+func NewCA(opts Options) (*KeyPair, error) {
+	template, key, err := newTemplate(opts)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	return sign(template, key, template, key)
+}
+
+// IssueServer returns a server certificate signed by ca, at least one DNS name or IP address is required
+func IssueServer(ca *KeyPair, opts Options) (*KeyPair, error) {
+	if len(opts.DNSNames) == 0 && len(opts.IPAddresses) == 0 {
+		return nil, errors.New("a server certificate requires at least one DNS name or IP address")
+	}
+	if opts.CommonName == "" {
+		if len(opts.DNSNames) > 0 {
+			opts.CommonName = opts.DNSNames[0]
+		} else {
+			opts.CommonName = opts.IPAddresses[0].String()
+		}
+	}
+	return issue(ca, opts, x509.ExtKeyUsageServerAuth)
+}
+
+// IssueClient returns a client certificate signed by ca, the common name is required
+func IssueClient(ca *KeyPair, opts Options) (*KeyPair, error) {
+	if opts.CommonName == "" {
+		return nil, errors.New("a client certificate requires a common name")
+	}
+	return issue(ca, opts, x509.ExtKeyUsageClientAuth)
+}
+
+// issue returns a leaf certificate for usage signed by ca
+func issue(ca *KeyPair, opts Options, usage x509.ExtKeyUsage) (*KeyPair, error) {
+	if !ca.Certificate.IsCA {
+		return nil, fmt.Errorf("certificate %s is not a CA", ca.Certificate.Subject.CommonName)
+	}
+	template, key, err := newTemplate(opts)
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	// key encipherment is only used by RSA keys
+	template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	if template.NotAfter.After(ca.Certificate.NotAfter) {
+		return nil, fmt.Errorf("certificate expiry %s is after the CA expiry %s", template.NotAfter.Format(time.RFC3339), ca.Certificate.NotAfter.Format(time.RFC3339))
+	}
+	return sign(template, key, ca.Certificate, ca.Key)
+}
+
+// newTemplate returns the certificate template and a new private key for opts
+func newTemplate(opts Options) (*x509.Certificate, crypto.Signer, error) {
+	if opts.Validity <= 0 {
+		return nil, nil, fmt.Errorf("invalid validity %s", opts.Validity)
+	}
+	key, err := GenerateKey(opts.KeyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error generating serial number: %v", err)
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         opts.CommonName,
+			Organization:       opts.Organization,
+			OrganizationalUnit: opts.OrganizationalUnits,
+		},
+		DNSNames:    opts.DNSNames,
+		IPAddresses: opts.IPAddresses,
+		URIs:        opts.URIs,
+		NotBefore:   now.Add(-clockSkew),
+		NotAfter:    now.Add(opts.Validity),
+	}, key, nil
+}
+
+// sign signs template with the parent key and returns the parsed certificate with its key
+func sign(template *x509.Certificate, key crypto.Signer, parent *x509.Certificate, parentKey crypto.Signer) (*KeyPair, error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, fmt.Errorf("error creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate: %v", err)
+	}
+	return &KeyPair{Certificate: cert, Key: key}, nil
+}
+
+// GenerateKey returns a new private key of keyType
+func GenerateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unknown key type %q, valid key types are %s and %s", keyType, KeyTypeECDSA, KeyTypeEd25519)
+	}
+}
+
+// CertificatePEM returns the PEM encoded certificate
+func (k *KeyPair) CertificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: k.Certificate.Raw})
+}
+
+// KeyPEM returns the PEM encoded PKCS #8 private key
+func (k *KeyPair) KeyPEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.Key)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding private key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// WriteFiles writes the certificate and the private key as PEM files, the key is only readable by the owner.
+// existing files are only overwritten with overwrite, both files are written to temporary files next to them first
+// and renamed into place so a reader never sees a partial file or an overwritten key with the mode of the old file
+func (k *KeyPair) WriteFiles(certFile, keyFile string, overwrite bool) error {
+	keyPEM, err := k.KeyPEM()
+	if err != nil {
+		return err
+	}
+	if !overwrite {
+		for _, file := range []string{certFile, keyFile} {
+			if _, err := os.Stat(file); err == nil {
+				return fmt.Errorf("%s already exists", file)
+			}
+		}
+	}
+
+	keyTemp, err := writeTempFile(keyFile, keyPEM, 0600)
+	if err != nil {
+		return fmt.Errorf("error writing private key %s: %v", keyFile, err)
+	}
+	defer os.Remove(keyTemp)
+	certTemp, err := writeTempFile(certFile, k.CertificatePEM(), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing certificate %s: %v", certFile, err)
+	}
+	defer os.Remove(certTemp)
+
+	if err := os.Rename(keyTemp, keyFile); err != nil {
+		return fmt.Errorf("error writing private key %s: %v", keyFile, err)
+	}
+	if err := os.Rename(certTemp, certFile); err != nil {
+		return fmt.Errorf("error writing certificate %s: %v", certFile, err)
+	}
+	return nil
+}
+
+// writeTempFile writes data to a new temporary file in the directory of file, the temporary file is created with
+// mode 0600 and changed to perm once written. the name of the temporary file is returned
+func writeTempFile(file string, data []byte, perm os.FileMode) (string, error) {
+	temp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return "", err
+	}
+	name := temp.Name()
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Chmod(perm)
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
+
+// LoadKeyPair reads a PEM certificate and private key, PKCS #8, PKCS #1 and EC private keys are accepted
+func LoadKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading certificate %s: %v", certFile, err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in %s", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate %s: %v", certFile, err)
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading private key %s: %v", keyFile, err)
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no private key found in %s", keyFile)
+	}
+	if _, encrypted := block.Headers["Proc-Type"]; encrypted || block.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, fmt.Errorf("private key %s is encrypted, decrypt it first", keyFile)
+	}
+	key, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing private key %s: %v", keyFile, err)
+	}
+	return &KeyPair{Certificate: cert, Key: key}, nil
+}
+
+// parsePrivateKey parses a DER PKCS #8, PKCS #1 or EC private key
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("private key can not sign")
+		}
+		return signer, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key format")
+}
@@ -0,0 +1,123 @@
+package pki
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIssueCertificates(t *testing.T) {
+	for _, keyType := range []string{KeyTypeECDSA, KeyTypeEd25519} {
+		t.Run(keyType, func(t *testing.T) {
+			dir := t.TempDir()
+			ca, err := NewCA(Options{KeyType: keyType, Validity: DefaultCAValidity, CommonName: "Portal CA"})
+			if err != nil {
+				t.Fatalf("error creating CA: %v", err)
+			}
+			caCertFile, caKeyFile := filepath.Join(dir, "ca_cert.pem"), filepath.Join(dir, "ca_key.pem")
+			if err := ca.WriteFiles(caCertFile, caKeyFile, false); err != nil {
+				t.Fatalf("error writing CA: %v", err)
+			}
+			assert.Error(t, ca.WriteFiles(caCertFile, caKeyFile, false))
+			ca, err = LoadKeyPair(caCertFile, caKeyFile)
+			if err != nil {
+				t.Fatalf("error loading CA: %v", err)
+			}
+
+			server, err := IssueServer(ca, Options{KeyType: keyType, Validity: time.Hour, DNSNames: []string{"localhost"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}})
+			if err != nil {
+				t.Fatalf("error issuing server certificate: %v", err)
+			}
+			uri, _ := url.Parse("spiffe://cluster.local/ns/ci/sa/deployer")
+			client, err := IssueClient(ca, Options{KeyType: keyType, Validity: time.Hour, CommonName: "client-1", OrganizationalUnits: []string{"platform"}, URIs: []*url.URL{uri}})
+			if err != nil {
+				t.Fatalf("error issuing client certificate: %v", err)
+			}
+
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.Certificate)
+			_, err = server.Certificate.Verify(x509.VerifyOptions{Roots: roots, DNSName: "localhost", KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+			assert.NoError(t, err)
+			_, err = client.Certificate.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+			assert.NoError(t, err)
+			_, err = client.Certificate.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+			assert.Error(t, err)
+			assert.Equal(t, "localhost", server.Certificate.Subject.CommonName)
+			assert.Equal(t, []string{"platform"}, client.Certificate.Subject.OrganizationalUnit)
+			assert.Equal(t, uri.String(), client.Certificate.URIs[0].String())
+			assert.WithinDuration(t, time.Now().Add(time.Hour), client.Certificate.NotAfter, time.Minute)
+
+			// the files are accepted by the server flags
+			certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+			if err := server.WriteFiles(certFile, keyFile, false); err != nil {
+				t.Fatalf("error writing server certificate: %v", err)
+			}
+			_, err = tls.LoadX509KeyPair(certFile, keyFile)
+			assert.NoError(t, err)
+
+			// an overwritten key is only readable by the owner, whatever the mode of the old file
+			assert.NoError(t, os.Chmod(keyFile, 0644))
+			if err := server.WriteFiles(certFile, keyFile, true); err != nil {
+				t.Fatalf("error overwriting server certificate: %v", err)
+			}
+			for file, mode := range map[string]os.FileMode{keyFile: 0600, certFile: 0644} {
+				info, err := os.Stat(file)
+				if assert.NoError(t, err) {
+					assert.Equal(t, mode, info.Mode().Perm(), file)
+				}
+			}
+			_, err = tls.LoadX509KeyPair(certFile, keyFile)
+			assert.NoError(t, err)
+			temps, _ := filepath.Glob(filepath.Join(dir, ".server.*"))
+			assert.Empty(t, temps)
+		})
+	}
+}
+
+func TestIssueCertificatesValidation(t *testing.T) {
+	ca, err := NewCA(Options{KeyType: KeyTypeECDSA, Validity: time.Hour, CommonName: "Portal CA"})
+	if err != nil {
+		t.Fatalf("error creating CA: %v", err)
+	}
+	leaf, err := IssueClient(ca, Options{KeyType: KeyTypeECDSA, Validity: time.Minute, CommonName: "client"})
+	if err != nil {
+		t.Fatalf("error issuing client certificate: %v", err)
+	}
+
+	testCases := []struct {
+		title string
+		issue func() (*KeyPair, error)
+	}{
+		{title: "Should reject unknown key types", issue: func() (*KeyPair, error) {
+			return NewCA(Options{KeyType: "rsa", Validity: time.Hour})
+		}},
+		{title: "Should reject a non positive validity", issue: func() (*KeyPair, error) {
+			return NewCA(Options{KeyType: KeyTypeECDSA})
+		}},
+		{title: "Should require a SAN for server certificates", issue: func() (*KeyPair, error) {
+			return IssueServer(ca, Options{KeyType: KeyTypeECDSA, Validity: time.Minute})
+		}},
+		{title: "Should require a common name for client certificates", issue: func() (*KeyPair, error) {
+			return IssueClient(ca, Options{KeyType: KeyTypeECDSA, Validity: time.Minute})
+		}},
+		{title: "Should reject an expiry after the CA expiry", issue: func() (*KeyPair, error) {
+			return IssueClient(ca, Options{KeyType: KeyTypeECDSA, Validity: 2 * time.Hour, CommonName: "client"})
+		}},
+		{title: "Should reject signing with a leaf certificate", issue: func() (*KeyPair, error) {
+			return IssueClient(leaf, Options{KeyType: KeyTypeECDSA, Validity: time.Minute, CommonName: "client"})
+		}},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			_, err := c.issue()
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/innovia/portal/server/models"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// names of the /readyz checks
+const (
+	ReadyCheckInformerSync   = "informer-sync"
+	ReadyCheckState          = "state"
+	ReadyCheckTLS            = "tls"
+	ReadyCheckLeaderElection = "leader-election"
+)
+
+// ReadyCheck is a named readiness check, each check is served on /readyz/<name>
+type ReadyCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// InformerStatus tracks the informers of the reconcile loop running on this replica, the zero value has no loop running
+type InformerStatus struct {
+	mu      sync.RWMutex
+	running bool
+	synced  []cache.InformerSynced
+}
+
+// HasSynced returns true if a reconcile loop is running and all its informers have synced
+func (s *InformerStatus) HasSynced() (running, synced bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.running {
+		return false, false
+	}
+	for _, hasSynced := range s.synced {
+		if !hasSynced() {
+			return true, false
+		}
+	}
+	return true, true
+}
+
+func (s *InformerStatus) start(synced []cache.InformerSynced) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running, s.synced = true, synced
+}
+
+func (s *InformerStatus) stop() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running, s.synced = false, nil
+}
+
+// ReadyChecks returns the readiness checks of the server
+func (h *KubernetesClient) ReadyChecks() []ReadyCheck {
+	return []ReadyCheck{
+		{Name: ReadyCheckInformerSync, Check: h.checkInformerSync},
+		{Name: ReadyCheckState, Check: h.checkState},
+		{Name: ReadyCheckTLS, Check: h.checkTLS},
+		{Name: ReadyCheckLeaderElection, Check: h.checkLeaderElection},
+	}
+}
+
+// checkInformerSync fails until the informers of the reconcile loop have synced, replicas that do not hold the
+// leader election lease do not run the reconcile loop and pass
+func (h *KubernetesClient) checkInformerSync(context.Context) error {
+	if h.Informers == nil || (h.LeaderElection != nil && !h.LeaderElection.IsLeader()) {
+		return nil
+	}
+	running, synced := h.Informers.HasSynced()
+	if !running {
+		return errors.New("reconcile loop is not running")
+	}
+	if !synced {
+		return errors.New("reconcile informers have not synced")
+	}
+	return nil
+}
+
+// checkState fails if the state can not be read or parsed
+func (h *KubernetesClient) checkState(ctx context.Context) error {
+	_, err := h.stateStore().List(ctx)
+	return err
+}
+
+// checkTLS fails if the server certificate or the client CA is not loaded or the server certificate expired
+func (h *KubernetesClient) checkTLS(context.Context) error {
+	if h.Certificates == nil {
+		return nil
+	}
+	return h.Certificates.Check()
+}
+
+// checkLeaderElection fails while no leader was observed, the check passes when leader election is disabled
+func (h *KubernetesClient) checkLeaderElection(context.Context) error {
+	if h.LeaderElection == nil {
+		return nil
+	}
+	if h.LeaderElection.Leader() == "" {
+		return fmt.Errorf("no leader observed for lease %s/%s", h.LeaderElection.LeaseNamespace, h.LeaderElection.LeaseName)
+	}
+	return nil
+}
+
+// Readyz is a HTTP readiness check in the format of kube-apiserver, /readyz runs every check and /readyz/<name> a
+// single check. failed checks return 500, ?verbose lists every check and ?exclude=<name> skips a check.
+// failure reasons are withheld from the response and logged
+func (h *KubernetesClient) Readyz(res http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return models.NewHTTPError(nil, http.StatusMethodNotAllowed, "only GET Method allowed.")
+	}
+
+	checks := h.ReadyChecks()
+	if name := mux.Vars(req)["check"]; name != "" {
+		var found []ReadyCheck
+		for _, check := range checks {
+			if check.Name == name {
+				found = append(found, check)
+			}
+		}
+		if len(found) == 0 {
+			return models.NewHTTPError(nil, http.StatusNotFound, fmt.Sprintf("unknown readyz check %q, valid checks are %s", name, readyCheckNames(checks)))
+		}
+		checks = found
+	}
+
+	query := req.URL.Query()
+	excluded := map[string]bool{}
+	for _, name := range query["exclude"] {
+		excluded[name] = true
+	}
+	_, verbose := query["verbose"]
+
+	failed := false
+	output := &bytes.Buffer{}
+	for _, check := range checks {
+		if excluded[check.Name] {
+			fmt.Fprintf(output, "[+]%s excluded: ok\n", check.Name)
+			continue
+		}
+		if err := check.Check(req.Context()); err != nil {
+			klog.Errorf("readyz check %s failed: %v", check.Name, err)
+			fmt.Fprintf(output, "[-]%s failed: reason withheld\n", check.Name)
+			failed = true
+			continue
+		}
+		fmt.Fprintf(output, "[+]%s ok\n", check.Name)
+	}
+
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	if failed {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "%sreadyz check failed\n", output.String())
+		return nil
+	}
+	if !verbose {
+		fmt.Fprint(res, "ok")
+		return nil
+	}
+	fmt.Fprintf(res, "%sreadyz check passed\n", output.String())
+	return nil
+}
+
+// readyCheckNames returns the comma separated names of checks
+func readyCheckNames(checks []ReadyCheck) string {
+	names := make([]string, 0, len(checks))
+	for _, check := range checks {
+		names = append(names, check.Name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadyz(t *testing.T) {
+	synced := &InformerStatus{}
+	synced.start([]cache.InformerSynced{func() bool { return true }})
+	unsynced := &InformerStatus{}
+	unsynced.start([]cache.InformerSynced{func() bool { return true }, func() bool { return false }})
+
+	testCases := []struct {
+		title        string
+		path         string
+		informers    *InformerStatus
+		certificates *CertificateReloader
+		leader       *LeaderElection
+		stateFailure bool
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			title:        "Should be ready when every check passes",
+			path:         "/readyz",
+			informers:    synced,
+			expectedCode: http.StatusOK,
+			expectedBody: "ok",
+		}, {
+			title:        "Should list every check with verbose",
+			path:         "/readyz?verbose",
+			informers:    synced,
+			expectedCode: http.StatusOK,
+			expectedBody: "[+]informer-sync ok\n[+]state ok\n[+]tls ok\n[+]leader-election ok\nreadyz check passed\n",
+		}, {
+			title:        "Should not be ready until the informers have synced",
+			path:         "/readyz",
+			informers:    unsynced,
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: "[-]informer-sync failed: reason withheld\n",
+		}, {
+			title:        "Should not be ready when the reconcile loop is not running",
+			path:         "/readyz/informer-sync",
+			informers:    &InformerStatus{},
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: "[-]informer-sync failed: reason withheld\nreadyz check failed\n",
+		}, {
+			title:        "Should pass the informer check on replicas that are not the leader",
+			path:         "/readyz/informer-sync",
+			informers:    &InformerStatus{},
+			leader:       &LeaderElection{LeaseName: LeaderElectionLeaseName, LeaseNamespace: "default"},
+			expectedCode: http.StatusOK,
+			expectedBody: "ok",
+		}, {
+			title:        "Should not be ready when the state can not be read",
+			path:         "/readyz?verbose",
+			stateFailure: true,
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: "[+]informer-sync ok\n[-]state failed: reason withheld\n[+]tls ok\n[+]leader-election ok\nreadyz check failed\n",
+		}, {
+			title:        "Should skip excluded checks",
+			path:         "/readyz?exclude=state",
+			stateFailure: true,
+			expectedCode: http.StatusOK,
+			expectedBody: "ok",
+		}, {
+			title:        "Should not be ready when the TLS material is not loaded",
+			path:         "/readyz/tls",
+			certificates: &CertificateReloader{CertFile: "tls.crt", CAFile: "ca.crt"},
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: "[-]tls failed: reason withheld\nreadyz check failed\n",
+		}, {
+			title:        "Should not be ready while no leader was observed",
+			path:         "/readyz/leader-election",
+			leader:       &LeaderElection{LeaseName: LeaderElectionLeaseName, LeaseNamespace: "default"},
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: "[-]leader-election failed: reason withheld\nreadyz check failed\n",
+		}, {
+			title:        "Should return not found for unknown checks",
+			path:         "/readyz/etcd",
+			expectedCode: http.StatusNotFound,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			clientSet := newFakeClientset()
+			if c.stateFailure {
+				clientSet.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("connection refused")
+				})
+			}
+			client := KubernetesClient{
+				Clientset:      clientSet,
+				Namespace:      "default",
+				Informers:      c.informers,
+				Certificates:   c.certificates,
+				LeaderElection: c.leader,
+			}
+			healthHandler, err := HealthCheckHandler(&client)
+			if err != nil {
+				t.Fatalf("error getting health check handler %v", err)
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, c.path, nil)
+			res := httptest.NewRecorder()
+			healthHandler.ServeHTTP(res, req)
+			assert.Equal(t, c.expectedCode, res.Code)
+			if c.expectedBody != "" {
+				assert.Contains(t, res.Body.String(), c.expectedBody)
+			}
+		})
+	}
+}
+
+func TestReadyzDuringInitialSync(t *testing.T) {
+	ctx := context.Background()
+	clientSet := newFakeClientset()
+	// the deployments informer does not sync until the list is released
+	release := make(chan struct{})
+	clientSet.PrependReactor("list", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		<-release
+		return false, nil, nil
+	})
+	client := KubernetesClient{Clientset: clientSet, Namespace: "default", State: NewMemoryStateStore(), Informers: &InformerStatus{}}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	r := client.NewReplicaReconcileWatcher(ctx, informers.NewSharedInformerFactory(clientSet, 0))
+	defer r.Queue.ShutDown()
+	done := make(chan error, 1)
+	go func() { done <- r.Run(ctx, stopCh) }()
+
+	assert.Eventually(t, func() bool {
+		err := client.checkInformerSync(ctx)
+		return err != nil && err.Error() == "reconcile informers have not synced"
+	}, 5*time.Second, 10*time.Millisecond)
+	close(release)
+	assert.NoError(t, <-done)
+	assert.NoError(t, client.checkInformerSync(ctx))
+}
+
+func TestCertificateReloaderCheck(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "portal-ca", nil)
+	server := newTestCertificate(t, "portal", ca)
+	reloader, err := NewCertificateReloader(writeFile(t, dir, "tls.crt", server.CertPEM), writeFile(t, dir, "tls.key", server.KeyPEM), writeFile(t, dir, "ca.crt", ca.CertPEM))
+	if err != nil {
+		t.Fatalf("error loading certificates: %v", err)
+	}
+	assert.NoError(t, reloader.Check())
+	assert.Error(t, (&CertificateReloader{}).Check())
+}
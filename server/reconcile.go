@@ -3,200 +3,580 @@ package server
 import (
 	"context"
 	"fmt"
+	"github.com/innovia/portal/server/apis/v1alpha1"
+	"github.com/innovia/portal/server/metrics"
 	"github.com/innovia/portal/server/models"
+	"golang.org/x/time/rate"
 	v1 "k8s.io/api/apps/v1"
+	coreV1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	appsinformers "k8s.io/client-go/informers/apps/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
-	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// reconcile workqueue defaults
+const (
+	ReconcileQueueName      = "reconcile"
+	DefaultReconcileWorkers = 2
+	ReconcileBaseRetryDelay = 500 * time.Millisecond
+	ReconcileMaxRetryDelay  = 5 * time.Minute
 )
 
 // ReplicasReconcile holds informers and client information for reconcile functions
 type ReplicasReconcile struct {
-	InformerFactory informers.SharedInformerFactory
-	DeployInformer  appsinformers.DeploymentInformer
-	Client          *KubernetesClient
+	InformerFactory     informers.SharedInformerFactory
+	DeployInformer      appsinformers.DeploymentInformer
+	StatefulSetInformer appsinformers.StatefulSetInformer
+	// DynamicInformerFactory watches the client ReconcileResources, nil when there are none
+	DynamicInformerFactory dynamicinformer.DynamicSharedInformerFactory
+	Client                 *KubernetesClient
+	State                  StateStore // State defaults to the client state store when not set
+
+	// Queue holds reconcileKey items of workloads to reconcile, failed keys are requeued with exponential backoff
+	Queue   workqueue.RateLimitingInterface
+	Workers int
+
+	// listers read the workloads of every reconciled resource from the informer caches
+	listers map[string]workloadLister
+	synced  []cache.InformerSynced
+	// stopped is set once the term of the loop ended, the event handlers can not be removed from the shared
+	// informers so they skip every event from then on
+	stopped int32
+}
+
+// workloadLister returns a workload of a single resource, a NotFound error is returned for deleted workloads
+type workloadLister func(ctx context.Context, namespace, name string) (*Workload, error)
+
+// reconcileKey is the queue item of a workload, the resource is normalized with NormalizeResource
+type reconcileKey struct {
+	Resource  string
+	Namespace string
+	Name      string
+}
+
+func (k reconcileKey) String() string {
+	return fmt.Sprintf("%s %s/%s", resourceKind(k.Resource), k.Namespace, k.Name)
+}
+
+// NewReconcileQueue returns a rate limited workqueue that retries failed keys with exponential backoff
+func NewReconcileQueue() workqueue.RateLimitingInterface {
+	rateLimiter := workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(ReconcileBaseRetryDelay, ReconcileMaxRetryDelay),
+		// overall rate limit so a burst of failures does not hammer the API server
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+	)
+	return workqueue.NewNamedRateLimitingQueue(rateLimiter, ReconcileQueueName)
 }
 
-// Run starts shared informers and waits for the shared informer cache to synchronize.
-func (r *ReplicasReconcile) Run(stopCh <-chan struct{}) error {
+// state returns the state store used by the reconcile loop
+func (r *ReplicasReconcile) state() StateStore {
+	if r.State == nil {
+		return r.Client.stateStore()
+	}
+	return observeState(r.State)
+}
+
+// Run starts shared informers, waits for the shared informer cache to synchronize and starts the queue workers.
+func (r *ReplicasReconcile) Run(ctx context.Context, stopCh <-chan struct{}) error {
 	klog.Info("Starting Replica Reconcile Loop...")
 
 	// Starts all the shared informers that have been created by the factory so far.
 	// notice that there is no need to run Start methods in a separate goroutine. (i.e. go kubeInformerFactory.Start(stopCh)
 	// Start method is non-blocking and runs all registered informers in a dedicated goroutine.
 	r.InformerFactory.Start(stopCh)
+	if r.DynamicInformerFactory != nil {
+		r.DynamicInformerFactory.Start(stopCh)
+	}
+
+	// the readiness check reports the informers as running but not synced until the initial synchronization is done
+	r.Client.Informers.start(r.synced)
 
 	// wait for the initial synchronization of the local cache.
-	if !cache.WaitForCacheSync(stopCh, r.DeployInformer.Informer().HasSynced) {
+	if !cache.WaitForCacheSync(stopCh, r.synced...) {
 		return fmt.Errorf("failed to sync replicas reconcile informers")
 	}
+
+	workers := r.Workers
+	if workers <= 0 {
+		workers = DefaultReconcileWorkers
+	}
+	klog.Infof("Starting %d reconcile workers", workers)
+	for i := 0; i < workers; i++ {
+		go wait.Until(func() { r.runWorker(ctx) }, time.Second, stopCh)
+	}
+	return nil
+}
+
+// Stop ends the term of the reconcile loop, the event handlers stop queueing and the queue is shut down
+func (r *ReplicasReconcile) Stop() {
+	atomic.StoreInt32(&r.stopped, 1)
+	r.Queue.ShutDown()
+}
+
+// runWorker processes items from the queue until the queue is shut down
+func (r *ReplicasReconcile) runWorker(ctx context.Context) {
+	for r.processNextWorkItem(ctx) {
+	}
+}
+
+// processNextWorkItem syncs the next key in the queue, a failed key is requeued with backoff
+// and a successful key has its backoff reset
+func (r *ReplicasReconcile) processNextWorkItem(ctx context.Context) bool {
+	item, shutdown := r.Queue.Get()
+	if shutdown {
+		return false
+	}
+	defer r.Queue.Done(item)
+
+	key := item.(reconcileKey)
+	if err := r.sync(ctx, key); err != nil {
+		klog.Errorf("reconcile: error syncing %s, retry %d: %v", key, r.Queue.NumRequeues(key)+1, err)
+		r.Queue.AddRateLimited(key)
+		return true
+	}
+	r.Queue.Forget(key)
+	return true
+}
+
+// sync reconciles the workload of a key, the workload is read from the informer cache
+// and if it no longer exists it is removed from state
+func (r *ReplicasReconcile) sync(ctx context.Context, key reconcileKey) error {
+	lister, ok := r.listers[key.Resource]
+	if !ok {
+		klog.Errorf("reconcile: %s is not watched, add %s to the reconciled resources", key, ResourcePath(key.Resource))
+		return nil
+	}
+
+	w, err := lister(ctx, key.Namespace, key.Name)
+	if k8serrors.IsNotFound(err) {
+		return r.onDelete(ctx, key)
+	}
+	if err != nil {
+		return err
+	}
+
+	status, shouldReconcile, err := r.ShouldReconcile(ctx, w)
+	if err != nil {
+		return err
+	}
+	if status != nil && pinExpired(status, time.Now()) {
+		return r.expirePin(ctx, status, w)
+	}
+	// the key is synced again when the pin expires
+	if status != nil && status.Reconcile && status.Expiry != nil {
+		r.Queue.AddAfter(key, time.Until(*status.Expiry))
+	}
+	if status != nil && status.Reconcile {
+		metrics.SetReplicas(ResourcePath(w.Resource), w.Namespace, w.Name, status.Replicas, w.Replicas)
+	} else {
+		metrics.DeleteReplicas(ResourcePath(w.Resource), w.Namespace, w.Name)
+	}
+	if status != nil && status.Reconcile && status.Paused {
+		r.recordCondition(ctx, status, metav1.ConditionFalse, v1alpha1.ReasonPaused, "reconcile is paused")
+	}
+	if status != nil && status.Reconcile {
+		r.trackDrift(ctx, status, w, shouldReconcile)
+	}
+	if shouldReconcile {
+		return r.Reconcile(ctx, status, w)
+	}
 	return nil
 }
 
-// ShouldReconcile returns the deployment status and a bool to indicate if reconcile should occur or not.
-func (r *ReplicasReconcile) ShouldReconcile(ctx context.Context, deployment *v1.Deployment) (*models.Status, bool) {
-	name := deployment.Name
-	namespace := deployment.Namespace
+// enqueue adds the key of a workload of the given resource to the queue
+func (r *ReplicasReconcile) enqueue(resource string, obj interface{}) {
+	if atomic.LoadInt32(&r.stopped) == 1 {
+		return
+	}
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		klog.Errorf("reconcile: could not get key for object: %v", err)
+		return
+	}
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		klog.Errorf("reconcile: invalid key %s: %v", key, err)
+		return
+	}
+	r.Queue.Add(reconcileKey{Resource: resource, Namespace: namespace, Name: name})
+}
 
+// ShouldReconcile returns the workload status and a bool to indicate if reconcile should occur or not.
+func (r *ReplicasReconcile) ShouldReconcile(ctx context.Context, w *Workload) (*models.Status, bool, error) {
 	// Read state
-	status, err := r.Client.ReadDeploymentState(ctx, name, namespace)
+	status, err := r.state().Read(ctx, w.Resource, w.Name, w.Namespace)
 	if err != nil {
-		klog.Errorf("error reading state %v", err)
-		return nil, false
+		return nil, false, fmt.Errorf("error reading state: %v", err)
+	}
+
+	if status != nil && status.Reconcile && status.Paused {
+		klog.V(3).Infof("reconcile: %s - skipping reconcile, reconcile is paused", w)
+		return status, false, nil
+	}
+
+	if status != nil && pinExpired(status, time.Now()) {
+		klog.V(3).Infof("reconcile: %s - skipping reconcile, pin expired", w)
+		return status, false, nil
+	}
+
+	// wait until workload replicas has stabilized
+	if status != nil && status.Reconcile && w.Replicas == w.ReadyReplicas {
+		return status, true, nil
 	}
 
-	// wait until deployment replicas has stabilized
-	if status != nil && status.Reconcile && *deployment.Spec.Replicas == deployment.Status.ReadyReplicas {
-		return status, true
+	if status != nil && status.Reconcile && w.Replicas == status.Replicas {
+		klog.Infof("reconcile: %s - skipping reconcile, replicas are in sync", w)
 	}
+	return status, false, nil
+}
+
+// trackDrift sets the time a drift of a pinned workload began and clears the drift once the workload is back in sync,
+// a drift about to be reconciled is not written since Reconcile writes state itself
+func (r *ReplicasReconcile) trackDrift(ctx context.Context, status *models.Status, w *Workload, reconciling bool) {
+	drifted := w.Replicas != status.Replicas
+	switch {
+	case drifted && status.DriftSince == nil:
+		now := time.Now()
+		status.DriftSince = &now
+		if reconciling {
+			return
+		}
+	case !drifted && (status.DriftSince != nil || status.ReconcileFailures > 0):
+		clearDrift(status)
+	default:
+		return
+	}
+	if err := r.updateDrift(ctx, status); err != nil {
+		klog.Errorf("reconcile: error updating drift of %s in state: %v", w, err)
+	}
+}
 
-	if status != nil && status.Reconcile && *deployment.Spec.Replicas == status.Replicas {
-		klog.Infof("reconcile: %s.%s - skipping reconcile, replicas are in sync", deployment.Name, deployment.Namespace)
+// updateDrift writes the drift tracking of a status without writing back the rest of the status that was read at the
+// start of the sync, a state store that is not a DriftRecorder writes the whole status
+func (r *ReplicasReconcile) updateDrift(ctx context.Context, status *models.Status) error {
+	if recorder, ok := unwrapState(r.state()).(DriftRecorder); ok {
+		return recorder.RecordDrift(ctx, status)
 	}
-	return status, false
+	return r.state().Update(ctx, status)
 }
 
-// onDelete is an event handler for the kubernetes deployments informer
-func (r *ReplicasReconcile) onDelete(ctx context.Context, deployment *v1.Deployment) {
-	name := deployment.Name
-	namespace := deployment.Namespace
+// clearDrift resets the drift tracking of a status
+func clearDrift(status *models.Status) {
+	status.DriftSince = nil
+	status.ReconcileFailures = 0
+	status.LastReconcileError = ""
+}
+
+// pinExpired returns true when the reconcile pin of a status has expired
+func pinExpired(status *models.Status, now time.Time) bool {
+	return status.Reconcile && status.Expiry != nil && !now.Before(*status.Expiry)
+}
 
+// expirePin stops the reconcile of a workload whose pin expired, the desired replicas are kept in state
+// like when reconcile is unset through the API
+func (r *ReplicasReconcile) expirePin(ctx context.Context, status *models.Status, w *Workload) error {
+	status.Reconcile = false
+	status.Paused = false
+	status.Expiry = nil
+	clearDrift(status)
+	if err := r.state().Update(ctx, status); err != nil {
+		return fmt.Errorf("error updating state of %s with expired pin: %v", w, err)
+	}
+	metrics.DeleteReplicas(ResourcePath(w.Resource), w.Namespace, w.Name)
+	klog.Infof("reconcile: %s - pin expired, stopped reconcile", w)
+	return nil
+}
+
+// onDelete removes a deleted workload from state
+func (r *ReplicasReconcile) onDelete(ctx context.Context, key reconcileKey) error {
 	// Read state and delete the key if exists
-	err := r.Client.DeleteDeploymentFromState(ctx, name, namespace)
+	status, err := r.state().Read(ctx, key.Resource, key.Name, key.Namespace)
 	if err != nil {
-		klog.Errorf("error deleting %s.%s key from state: %v", name, namespace, err)
+		return fmt.Errorf("error reading state of %s: %v", key, err)
+	}
+	if status == nil {
+		return nil
 	}
-	klog.Infof("reconcile: deployment %s at %s was deleted, removed data from state", name, namespace)
+	if err := r.state().Delete(ctx, key.Resource, key.Name, key.Namespace); err != nil {
+		return fmt.Errorf("error deleting %s from state: %v", key, err)
+	}
+	metrics.DeleteReplicas(ResourcePath(key.Resource), key.Namespace, key.Name)
+	klog.Infof("reconcile: %s was deleted, removed data from state", key)
+	r.Client.recordEvent(key.Resource, key.Namespace, key.Name, "", coreV1.EventTypeNormal, EventReasonStateRemoved,
+		"%s was deleted, removed the desired %d replicas from state", resourceKind(key.Resource), status.Replicas)
+	return nil
 }
 
 // Reconcile is actual reconcile action for updating replica count to match state
-func (r *ReplicasReconcile) Reconcile(ctx context.Context, status *models.Status, deployment *v1.Deployment) {
+func (r *ReplicasReconcile) Reconcile(ctx context.Context, status *models.Status, w *Workload) error {
 	defer recoverReconcilePanic()
 
 	klog.V(3).Infof("reconcile is set to: %t", status.Reconcile)
-	if *deployment.Spec.Replicas != status.Replicas {
-		klog.Infof(
-			"reconcile: %s.%s - drift detected => reconcile replicas %d => %d",
-			deployment.Name, deployment.Namespace, *deployment.Spec.Replicas, status.Replicas,
-		)
-		replicas := int32(status.Replicas)
-		d, err := r.Client.ScaleDeploymentReplicas(ctx, deployment, &replicas)
-		if err != nil {
-			klog.Errorf("error reconcile replicas for deployment %s in namespace %s", d.Name, d.Namespace)
-		}
+	if w.Replicas == status.Replicas {
+		r.recordCondition(ctx, status, metav1.ConditionTrue, v1alpha1.ReasonInSync,
+			fmt.Sprintf("%s replicas match the desired %d replicas", resourceKind(w.Resource), status.Replicas))
+		return nil
+	}
 
-		// Update state
-		if err := r.Client.UpdateState(ctx, status); err != nil {
-			klog.Errorf("error updating state with replicas for deployment %s in namespace %s", status.Name, status.Namespace)
+	klog.Infof("reconcile: %s - drift detected => reconcile replicas %d => %d", w, w.Replicas, status.Replicas)
+	metrics.ReconcileDrifts.WithLabelValues(ResourcePath(w.Resource)).Inc()
+	r.Client.recordEvent(w.Resource, w.Namespace, w.Name, w.UID, coreV1.EventTypeWarning, EventReasonDriftDetected,
+		"replicas were changed to %d, reconciling to the desired %d replicas", w.Replicas, status.Replicas)
+	actualReplicas := w.Replicas
+	workloads, err := r.Client.workloads(w.Resource)
+	if err == nil {
+		_, _, err = workloads.Scale(ctx, w.Namespace, w.Name, status.Replicas)
+	}
+	metrics.ReconcileActions.WithLabelValues(ResourcePath(w.Resource), metrics.Result(err)).Inc()
+	if err != nil {
+		// the failure is kept in state so that every replica reports the backoff
+		if status.DriftSince == nil {
+			now := time.Now()
+			status.DriftSince = &now
+		}
+		status.ReconcileFailures++
+		status.LastReconcileError = err.Error()
+		if updateErr := r.updateDrift(ctx, status); updateErr != nil {
+			klog.Errorf("reconcile: error updating drift of %s in state: %v", w, updateErr)
 		}
+		r.recordCondition(ctx, status, metav1.ConditionFalse, v1alpha1.ReasonReconcileFailed, err.Error())
+		r.Client.recordEvent(w.Resource, w.Namespace, w.Name, w.UID, coreV1.EventTypeWarning, EventReasonReconcileFailed,
+			"error reconciling replicas %d => %d: %v", actualReplicas, status.Replicas, err)
+		return fmt.Errorf("error reconcile replicas for %s: %v", w, err)
 	}
+
+	// Update state
+	reconcileTime := time.Now()
+	status.LastReconcileTime = &reconcileTime
+	clearDrift(status)
+	r.Client.recordHistory(status, EventComponent, HistorySourceReconcile, "", actualReplicas, status.Replicas)
+	if err := r.state().Update(ctx, status); err != nil {
+		return fmt.Errorf("error updating state with replicas for %s: %v", w, err)
+	}
+	metrics.SetReplicas(ResourcePath(w.Resource), w.Namespace, w.Name, status.Replicas, status.Replicas)
+	r.Client.recordEvent(w.Resource, w.Namespace, w.Name, w.UID, coreV1.EventTypeNormal, EventReasonDriftReconciled,
+		"reconciled replicas %d => %d", actualReplicas, status.Replicas)
+	r.recordCondition(ctx, status, metav1.ConditionTrue, v1alpha1.ReasonDriftReconciled,
+		fmt.Sprintf("reconciled replicas %d => %d", actualReplicas, status.Replicas))
+	return nil
 }
 
-// ReconcileSync would reconcile or delete out of sync deployments from state
-func (r *ReplicasReconcile) ReconcileSync(ctx context.Context, syncMap map[string][]v1.Deployment) {
-	for _, deployment := range syncMap["inSync"] {
-		status, shouldReconcile := r.ShouldReconcile(ctx, &deployment)
-		if shouldReconcile {
-			r.Reconcile(ctx, status, &deployment)
-		}
+// recordCondition reports the reconcile outcome on the state object if the state store supports it
+func (r *ReplicasReconcile) recordCondition(ctx context.Context, status *models.Status, conditionStatus metav1.ConditionStatus, reason, message string) {
+	recorder, ok := unwrapState(r.state()).(ConditionRecorder)
+	if !ok {
+		return
 	}
 
-	for _, deployment := range syncMap["outOfSync"] {
-		r.onDelete(ctx, &deployment)
+	condition := metav1.Condition{
+		Type:    v1alpha1.ConditionReconciled,
+		Status:  conditionStatus,
+		Reason:  reason,
+		Message: message,
+	}
+	if err := recorder.RecordCondition(ctx, status.Resource, status.Name, status.Namespace, condition); err != nil {
+		klog.Errorf("error recording reconcile condition for %s %s in namespace %s: %v", resourceKind(status.Resource), status.Name, status.Namespace, err)
 	}
 }
 
-// GetStartupSyncMap read the state and list all deployments, it then returns a map with list of deployment in and out of sync
-func (r *ReplicasReconcile) GetStartupSyncMap(ctx context.Context) map[string][]v1.Deployment {
-	state, err := r.Client.GetState(ctx)
-	if err != nil {
-		klog.Errorf("state might be out of sync! could not get state for reconcile start loop: %v", err)
-		return nil
+// ReconcileSync queues the in sync workloads for reconcile and the out of sync workloads for removal from state
+func (r *ReplicasReconcile) ReconcileSync(syncMap map[string][]Workload) {
+	for _, workloads := range [][]Workload{syncMap["inSync"], syncMap["outOfSync"]} {
+		for _, w := range workloads {
+			r.Queue.Add(reconcileKey{Resource: w.Resource, Namespace: w.Namespace, Name: w.Name})
+		}
 	}
+}
 
-	deploymentsList, err := r.Client.Clientset.AppsV1().Deployments("").List(ctx, metav1.ListOptions{})
+// GetStartupSyncMap read the state and list the workloads of every resource in state,
+// it then returns a map with list of workloads in and out of sync
+func (r *ReplicasReconcile) GetStartupSyncMap(ctx context.Context) map[string][]Workload {
+	statuses, err := r.state().List(ctx)
 	if err != nil {
-		klog.Errorf("state might be out of sync! could not list deployments for reconcile start loop: %v", err)
+		klog.Errorf("state might be out of sync! could not get state for reconcile start loop: %v", err)
 		return nil
 	}
 
-	var inSync []v1.Deployment
-	var outOfSync []v1.Deployment
-
-	for key := range state.Data {
-		if key == "status" {
+	// live workloads by resource and namespace/name, a resource that can not be listed is skipped
+	// so its state is kept until the next start
+	live := map[string]map[string]Workload{}
+	for _, status := range statuses {
+		if _, ok := live[status.Resource]; ok {
+			continue
+		}
+		workloads, err := r.Client.workloads(status.Resource)
+		if err != nil {
+			klog.Errorf("state might be out of sync! could not list %s for reconcile start loop: %v", ResourcePath(status.Resource), err)
+			continue
+		}
+		list, _, err := workloads.List(ctx, "", metav1.ListOptions{})
+		if err != nil {
+			klog.Errorf("state might be out of sync! could not list %s for reconcile start loop: %v", ResourcePath(status.Resource), err)
 			continue
 		}
-		found := false
-		s := strings.Split(key, ".")
-		if len(s) != 2 {
-			klog.Errorf("key in state does not match the format of <name>.<namespace>")
-			return nil
+		live[status.Resource] = map[string]Workload{}
+		for _, w := range list {
+			live[status.Resource][w.Namespace+"/"+w.Name] = w
 		}
-		name, namespace := s[0], s[1]
+	}
 
-		for _, d := range deploymentsList.Items {
-			if d.Name == name && d.Namespace == namespace {
-				found = true
-				inSync = append(inSync, d)
-			}
+	var inSync []Workload
+	var outOfSync []Workload
+
+	for _, status := range statuses {
+		workloads, ok := live[status.Resource]
+		if !ok {
+			continue
 		}
 
-		// deployment in state was not found in deployments list
-		// this means that the deployment was deleted but still in state
-		// the use of v1.Deployment here is to align the types of the syncMap
-		if !found {
-			outOfSync = append(outOfSync, v1.Deployment{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      name,
-					Namespace: namespace,
-				},
+		// workload in state was not found in the workloads list
+		// this means that the workload was deleted but still in state
+		if w, found := workloads[status.Namespace+"/"+status.Name]; found {
+			inSync = append(inSync, w)
+		} else {
+			outOfSync = append(outOfSync, Workload{
+				Resource:  status.Resource,
+				Name:      status.Name,
+				Namespace: status.Namespace,
 			})
 		}
 	}
 
-	return map[string][]v1.Deployment{
+	return map[string][]Workload{
 		"inSync":    inSync,
 		"outOfSync": outOfSync,
 	}
 }
 
-// NewReplicaReconcileWatcher will start a shared informer factory listing deployments with onUpdate ot onDelete events
+// NewReplicaReconcileWatcher will start a shared informer factory listing deployments and statefulsets and a dynamic
+// informer factory for the client ReconcileResources, update and delete events queue the workload key and the
+// queue workers do the reconcile
 func (h *KubernetesClient) NewReplicaReconcileWatcher(ctx context.Context, informerFactory informers.SharedInformerFactory) *ReplicasReconcile {
-	deploymentInformer := informerFactory.Apps().V1().Deployments()
-
 	r := &ReplicasReconcile{
 		InformerFactory: informerFactory,
-		DeployInformer:  deploymentInformer,
 		Client:          h,
+		State:           h.stateStore(),
+		Queue:           NewReconcileQueue(),
+		Workers:         h.ReconcileWorkers,
+		listers:         map[string]workloadLister{},
+	}
+
+	r.DeployInformer = informerFactory.Apps().V1().Deployments()
+	r.watch("", r.DeployInformer.Informer(), func(obj interface{}) *Workload {
+		return deploymentWorkload(obj.(*v1.Deployment))
+	}, func(_ context.Context, namespace, name string) (*Workload, error) {
+		d, err := r.DeployInformer.Lister().Deployments(namespace).Get(name)
+		if err != nil {
+			return nil, err
+		}
+		return deploymentWorkload(d), nil
+	})
+
+	r.StatefulSetInformer = informerFactory.Apps().V1().StatefulSets()
+	r.watch(ResourceStatefulSets, r.StatefulSetInformer.Informer(), func(obj interface{}) *Workload {
+		return statefulSetWorkload(obj.(*v1.StatefulSet))
+	}, func(_ context.Context, namespace, name string) (*Workload, error) {
+		s, err := r.StatefulSetInformer.Lister().StatefulSets(namespace).Get(name)
+		if err != nil {
+			return nil, err
+		}
+		return statefulSetWorkload(s), nil
+	})
+
+	for _, resource := range h.ReconcileResources {
+		if err := r.watchScaleResource(resource); err != nil {
+			klog.Errorf("reconcile: %s will not be reconciled: %v", resource, err)
+		}
 	}
 
-	deploymentInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		UpdateFunc: func(_, obj interface{}) {
-			var inSync []v1.Deployment
-			deployment := obj.(*v1.Deployment)
-			inSync = append(inSync, *deployment)
-			syncMap := map[string][]v1.Deployment{
-				"inSync": inSync,
+	// On start-up get state, then list the workloads of every resource in state, go over the keys in the state
+	// for each key check if a matching workload name and namespace exists in the list of workloads,
+	// if not found, it means that workload has been deleted and state is out of sync
+	// remove that key from state
+	syncMap := r.GetStartupSyncMap(ctx)
+	r.ReconcileSync(syncMap)
+
+	return r
+}
+
+// watch registers the event handlers and the lister of a resource informer, update events that do not change the
+// replicas or ready replicas are skipped, ready replicas are relevant since reconcile waits for the workload to stabilize
+func (r *ReplicasReconcile) watch(resource string, informer cache.SharedIndexInformer, workloadOf func(obj interface{}) *Workload, lister workloadLister) {
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldWorkload := workloadOf(oldObj)
+			newWorkload := workloadOf(newObj)
+			if oldWorkload.Replicas == newWorkload.Replicas && oldWorkload.ReadyReplicas == newWorkload.ReadyReplicas {
+				return
 			}
-			r.ReconcileSync(ctx, syncMap)
+			r.enqueue(resource, newObj)
 		},
 		DeleteFunc: func(obj interface{}) {
-			r.onDelete(ctx, obj.(*v1.Deployment))
+			r.enqueue(resource, obj)
 		},
 	})
+	r.listers[resource] = lister
+	r.synced = append(r.synced, informer.HasSynced)
+}
 
-	// On start-up get state, then list deployments from all namespaces, go over the keys in the state
-	// for each key check if a matching deployment name and namespace exists in the list of deployment,
-	// if not found, it means that deployment has been deleted and state is out of sync
-	// remove that key from state
-	syncMap := r.GetStartupSyncMap(ctx)
-	r.ReconcileSync(ctx, syncMap)
+// watchScaleResource watches a custom resource with a dynamic informer, the informer cache only tells if the object
+// exists since the replicas field paths differ between resources, the replicas are read from the scale subresource
+func (r *ReplicasReconcile) watchScaleResource(resource string) error {
+	workloads, err := r.Client.workloads(resource)
+	if err != nil {
+		return err
+	}
+	gvr, err := r.Client.Mapper.ResourceFor(GroupResource(resource).WithVersion(""))
+	if err != nil {
+		return fmt.Errorf("error resolving resource %s: %v", resource, err)
+	}
 
-	return r
+	if r.DynamicInformerFactory == nil {
+		r.DynamicInformerFactory = dynamicinformer.NewDynamicSharedInformerFactory(r.Client.Dynamic, 0)
+	}
+	informer := r.DynamicInformerFactory.ForResource(gvr)
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// skip resyncs, any change may be a change of the replicas
+			oldMeta, err := meta.Accessor(oldObj)
+			if err != nil {
+				return
+			}
+			newMeta, err := meta.Accessor(newObj)
+			if err != nil || oldMeta.GetResourceVersion() == newMeta.GetResourceVersion() {
+				return
+			}
+			r.enqueue(resource, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			r.enqueue(resource, obj)
+		},
+	})
+	r.listers[resource] = func(ctx context.Context, namespace, name string) (*Workload, error) {
+		if _, err := informer.Lister().ByNamespace(namespace).Get(name); err != nil {
+			return nil, err
+		}
+		return workloads.Get(ctx, namespace, name)
+	}
+	r.synced = append(r.synced, informer.Informer().HasSynced)
+	return nil
+}
+
+// replicasOf returns the spec replicas of a deployment, a nil replicas defaults to 1
+func replicasOf(d *v1.Deployment) int32 {
+	if d.Spec.Replicas == nil {
+		return 1
+	}
+	return *d.Spec.Replicas
 }
 
 // recoverReconcilePanic will recover from panic and print a stack trace so that reconcile loop could keep running
@@ -210,12 +590,26 @@ func recoverReconcilePanic() {
 func (h *KubernetesClient) StartReconcileLoop(ctx context.Context, stopCh <-chan struct{}) {
 	// start the Replicas Reconcile loop
 	// the defaultResync should be set on production to something high like 24hr, to reduce the api calls to k8s
-	factory := informers.NewSharedInformerFactory(h.Clientset, 0)
+	// the client informer factory is shared with the API, its informers keep running when leadership is lost
+	// and the handlers of the term are stopped with the loop
+	factory := h.InformerFactory
+	if factory == nil {
+		factory = informers.NewSharedInformerFactory(h.Clientset, 0)
+	}
 	replicaReconcileLoop := h.NewReplicaReconcileWatcher(ctx, factory)
+	defer replicaReconcileLoop.Stop()
+	defer h.Informers.stop()
 
-	err := replicaReconcileLoop.Run(stopCh)
+	err := replicaReconcileLoop.Run(ctx, stopCh)
 	if err != nil {
-		klog.Fatal(err)
+		select {
+		case <-stopCh:
+			// leadership was lost or a signal was received during the initial cache sync
+			klog.Errorf("reconcile loop stopped before it started: %v", err)
+			return
+		default:
+			klog.Fatal(err)
+		}
 	}
 
 	// wait here until signal is received
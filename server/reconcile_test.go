@@ -4,13 +4,19 @@ import (
 	"context"
 	"fmt"
 	"github.com/go-test/deep"
+	"github.com/innovia/portal/server/models"
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/apps/v1"
-	coreV1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	k8stesting "k8s.io/client-go/testing"
 	"net/http"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestCheckForReconcile(t *testing.T) {
@@ -41,7 +47,7 @@ func TestCheckForReconcile(t *testing.T) {
 	for _, c := range testCases {
 		t.Run(c.title, func(t *testing.T) {
 			ctx := context.Background()
-			clientSet := fake.NewSimpleClientset()
+			clientSet := newFakeClientset()
 			client := KubernetesClient{Clientset: clientSet, Namespace: "default"}
 			deployment := createDeployment(t, clientSet, &c.originalReplicas, c.name, c.namespace, c.image)
 
@@ -63,10 +69,13 @@ func TestCheckForReconcile(t *testing.T) {
 
 			// scale deployment out of server scope
 			newReplicas := int32(5)
-			d, err := client.ScaleDeploymentReplicas(context.Background(), deployment, &newReplicas)
-			if err != nil {
+			if _, err := client.ScaleDeploymentReplicas(ctx, deployment.Namespace, deployment.Name, newReplicas); err != nil {
 				t.Fatalf("error scaling deployment replicas: %v", err)
 			}
+			d, err := clientSet.AppsV1().Deployments(c.namespace).Get(ctx, c.name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("error getting deployment: %v", err)
+			}
 
 			// fake ready replicas
 			d.Status.ReadyReplicas = newReplicas
@@ -75,7 +84,10 @@ func TestCheckForReconcile(t *testing.T) {
 				Client: &client,
 			}
 
-			status, shouldReconcile := r.ShouldReconcile(ctx, d)
+			status, shouldReconcile, err := r.ShouldReconcile(ctx, deploymentWorkload(d))
+			if err != nil {
+				t.Fatalf("error checking reconcile: %v", err)
+			}
 			assert.Equal(t, c.reconcile, shouldReconcile)
 			if c.reconcile {
 				assert.True(t, status.Reconcile)
@@ -100,6 +112,13 @@ func TestStartupSync(t *testing.T) {
 			activeName:           "nginx-ingress",
 			activeNamespace:      "nginx-ingress",
 			originalReplicas:     int32(3),
+		}, {
+			title:                "Should sync deployments with dots in the name",
+			deletedName:          "nginx.v1",
+			deletedFromNamespace: "default",
+			activeName:           "web.v2",
+			activeNamespace:      "nginx-ingress",
+			originalReplicas:     int32(3),
 		}, {
 			title:         "Should skip if no deployments found",
 			noDeployments: true,
@@ -108,7 +127,7 @@ func TestStartupSync(t *testing.T) {
 
 	for _, c := range testCases {
 		t.Run(c.title, func(t *testing.T) {
-			clientSet := fake.NewSimpleClientset()
+			clientSet := newFakeClientset()
 			client := KubernetesClient{Clientset: clientSet, Namespace: "default"}
 			r := ReplicasReconcile{Client: &client}
 			ctx := context.Background()
@@ -150,42 +169,21 @@ func TestStartupSync(t *testing.T) {
 					t.Fatalf("failed to delete deployment %v", err)
 				}
 
-				inSync := []v1.Deployment{
+				inSync := []Workload{
 					{
-						TypeMeta: metav1.TypeMeta{},
-						ObjectMeta: metav1.ObjectMeta{
-							Name:      c.activeName,
-							Namespace: c.activeNamespace,
-						},
-						Spec: v1.DeploymentSpec{
-							Replicas: &c.originalReplicas,
-							Template: coreV1.PodTemplateSpec{
-								Spec: coreV1.PodSpec{
-									Containers: []coreV1.Container{
-										{
-											Name:  c.activeName,
-											Image: c.image,
-										},
-									},
-								},
-							},
-						},
-						Status: v1.DeploymentStatus{},
+						Name:      c.activeName,
+						Namespace: c.activeNamespace,
+						Replicas:  c.originalReplicas,
 					},
 				}
-				outOfSync := []v1.Deployment{
+				outOfSync := []Workload{
 					{
-						TypeMeta: metav1.TypeMeta{},
-						ObjectMeta: metav1.ObjectMeta{
-							Name:      c.deletedName,
-							Namespace: c.deletedFromNamespace,
-						},
-						Spec:   v1.DeploymentSpec{},
-						Status: v1.DeploymentStatus{},
+						Name:      c.deletedName,
+						Namespace: c.deletedFromNamespace,
 					},
 				}
 				actualSyncMap := r.GetStartupSyncMap(ctx)
-				expectedSyncMap := map[string][]v1.Deployment{
+				expectedSyncMap := map[string][]Workload{
 					"inSync":    inSync,
 					"outOfSync": outOfSync,
 				}
@@ -196,10 +194,10 @@ func TestStartupSync(t *testing.T) {
 					t.Fatalf("expectedSyncMap vs actualSyncMap compare failed: %#v", diff)
 				}
 			} else {
-				var inSync []v1.Deployment
-				var outOfSync []v1.Deployment
+				var inSync []Workload
+				var outOfSync []Workload
 				actualSyncMap := r.GetStartupSyncMap(ctx)
-				expectedSyncMap := map[string][]v1.Deployment{
+				expectedSyncMap := map[string][]Workload{
 					"inSync":    inSync,
 					"outOfSync": outOfSync,
 				}
@@ -210,3 +208,279 @@ func TestStartupSync(t *testing.T) {
 		})
 	}
 }
+
+func TestReconcileQueueRetriesFailedScale(t *testing.T) {
+	ctx := context.Background()
+	clientSet := newFakeClientset()
+	client := KubernetesClient{Clientset: clientSet, Namespace: "default", State: NewMemoryStateStore()}
+	desiredReplicas := int32(3)
+	createDeployment(t, clientSet, &desiredReplicas, "nginx", "test", "nginx")
+
+	status := &models.Status{
+		Deployment: models.Deployment{Name: "nginx", Namespace: "test", Replicas: desiredReplicas},
+		Reconcile:  true,
+	}
+	if err := client.UpdateState(ctx, status); err != nil {
+		t.Fatalf("error updating state: %v", err)
+	}
+
+	// fail the first reconcile scale so that the key is requeued with backoff
+	var failScale, scaleAttempts int32
+	clientSet.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if atomic.LoadInt32(&failScale) == 0 {
+			return false, nil, nil
+		}
+		if atomic.AddInt32(&scaleAttempts, 1) == 1 {
+			return true, nil, fmt.Errorf("injected error")
+		}
+		return false, nil, nil
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	r := client.NewReplicaReconcileWatcher(ctx, informers.NewSharedInformerFactory(clientSet, 0))
+	defer r.Queue.ShutDown()
+	if err := r.Run(ctx, stopCh); err != nil {
+		t.Fatalf("error running reconcile loop: %v", err)
+	}
+
+	// scale deployment out of server scope and fake ready replicas
+	d, err := clientSet.AppsV1().Deployments("test").Get(ctx, "nginx", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting deployment: %v", err)
+	}
+	driftReplicas := int32(5)
+	d.Spec.Replicas = &driftReplicas
+	d.Status.ReadyReplicas = driftReplicas
+	if _, err := clientSet.AppsV1().Deployments("test").Update(ctx, d, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("error scaling deployment: %v", err)
+	}
+	atomic.StoreInt32(&failScale, 1)
+
+	err = wait.PollImmediate(50*time.Millisecond, 10*time.Second, func() (bool, error) {
+		d, err := clientSet.AppsV1().Deployments("test").Get(ctx, "nginx", metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return *d.Spec.Replicas == desiredReplicas, nil
+	})
+	if err != nil {
+		t.Fatalf("deployment was not reconciled: %v", err)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&scaleAttempts))
+}
+
+func TestReconcileTermsShareInformers(t *testing.T) {
+	ctx := context.Background()
+	clientSet := newFakeClientset()
+	client := KubernetesClient{Clientset: clientSet, Namespace: "default", State: NewMemoryStateStore()}
+	desiredReplicas := int32(3)
+	createDeployment(t, clientSet, &desiredReplicas, "nginx", "test", "nginx")
+	if err := client.UpdateState(ctx, &models.Status{Deployment: models.Deployment{Name: "nginx", Namespace: "test", Replicas: desiredReplicas}, Reconcile: true}); err != nil {
+		t.Fatalf("error updating state: %v", err)
+	}
+
+	// count the deployment watches, the reactor is added before the informers run
+	var watches int32
+	clientSet.PrependWatchReactor("deployments", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		atomic.AddInt32(&watches, 1)
+		return false, nil, nil
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	client.InformerFactory = informers.NewSharedInformerFactory(clientSet, 0)
+	client.StartSharedInformers(stopCh)
+
+	// a lost term stops its handlers while the shared informers keep running for the next term
+	for term := 1; term <= 2; term++ {
+		termCh := make(chan struct{})
+		r := client.NewReplicaReconcileWatcher(ctx, client.InformerFactory)
+		if err := r.Run(ctx, termCh); err != nil {
+			t.Fatalf("error running reconcile loop of term %d: %v", term, err)
+		}
+		if term == 1 {
+			r.Stop()
+			close(termCh)
+			queued := r.Queue.Len()
+			r.enqueue("", &v1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "test"}})
+			assert.Equal(t, queued, r.Queue.Len())
+			continue
+		}
+		defer close(termCh)
+		defer r.Stop()
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&watches))
+
+	// the handlers of the current term reconcile a drift
+	d, err := clientSet.AppsV1().Deployments("test").Get(ctx, "nginx", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting deployment: %v", err)
+	}
+	driftReplicas := int32(5)
+	d.Spec.Replicas = &driftReplicas
+	d.Status.ReadyReplicas = driftReplicas
+	if _, err := clientSet.AppsV1().Deployments("test").Update(ctx, d, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("error scaling deployment: %v", err)
+	}
+	err = wait.PollImmediate(50*time.Millisecond, 10*time.Second, func() (bool, error) {
+		d, err := clientSet.AppsV1().Deployments("test").Get(ctx, "nginx", metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return *d.Spec.Replicas == desiredReplicas, nil
+	})
+	if err != nil {
+		t.Fatalf("deployment was not reconciled: %v", err)
+	}
+}
+
+func TestReconcileLoopStoppedDuringSync(t *testing.T) {
+	clientSet := newFakeClientset()
+	client := KubernetesClient{Clientset: clientSet, Namespace: "default", State: NewMemoryStateStore()}
+
+	// the term ends before the informers synced, the loop returns instead of exiting the process
+	stopCh := make(chan struct{})
+	close(stopCh)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.StartReconcileLoop(context.Background(), stopCh)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("reconcile loop did not return after its term ended")
+	}
+}
+
+func TestReconcileTracksDrift(t *testing.T) {
+	ctx := context.Background()
+	clientSet := newFakeClientset()
+	client := KubernetesClient{Clientset: clientSet, Namespace: "default", State: NewMemoryStateStore()}
+	replicas := int32(5)
+	deployment := createDeployment(t, clientSet, &replicas, "nginx", "test", "nginx")
+	w := deploymentWorkload(deployment)
+	assert.NoError(t, client.UpdateState(ctx, &models.Status{Deployment: models.Deployment{Name: "nginx", Namespace: "test", Replicas: 3}, Reconcile: true, Paused: true}))
+
+	var failScale int32 = 1
+	clientSet.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if atomic.LoadInt32(&failScale) == 1 {
+			return true, nil, fmt.Errorf("injected error")
+		}
+		return false, nil, nil
+	})
+	r := ReplicasReconcile{Client: &client}
+	read := func() *models.Status {
+		status, err := client.ReadWorkloadState(ctx, "", "nginx", "test")
+		if err != nil {
+			t.Fatalf("error reading state: %v", err)
+		}
+		return status
+	}
+
+	// a drift that is not reconciled right away is written to state
+	r.trackDrift(ctx, read(), w, false)
+	driftSince := read().DriftSince
+	assert.NotNil(t, driftSince)
+
+	// failed reconciles are counted and keep the drift start
+	status := read()
+	status.Paused = false
+	for i := 1; i <= 2; i++ {
+		assert.Error(t, r.Reconcile(ctx, status, w))
+		status = read()
+		assert.Equal(t, i, status.ReconcileFailures)
+		assert.Equal(t, driftSince, status.DriftSince)
+		assert.Contains(t, status.LastReconcileError, "injected error")
+	}
+
+	// a successful reconcile clears the drift
+	atomic.StoreInt32(&failScale, 0)
+	assert.NoError(t, r.Reconcile(ctx, status, w))
+	status = read()
+	assert.Nil(t, status.DriftSince)
+	assert.Zero(t, status.ReconcileFailures)
+	assert.Empty(t, status.LastReconcileError)
+
+	// a drift that ends without a reconcile is cleared as well
+	now := time.Now()
+	status.DriftSince = &now
+	assert.NoError(t, client.UpdateState(ctx, status))
+	inSync := *w
+	inSync.Replicas = 3
+	r.trackDrift(ctx, read(), &inSync, false)
+	assert.Nil(t, read().DriftSince)
+}
+
+func TestReconcileDriftKeepsConcurrentPin(t *testing.T) {
+	for _, backend := range []string{StateBackendConfigMap, StateBackendMemory, StateBackendCRD} {
+		t.Run(backend, func(t *testing.T) {
+			ctx := context.Background()
+			client := &KubernetesClient{Clientset: newFakeClientset(), Dynamic: newFakeDynamicClient(), Namespace: "default"}
+			store, err := NewStateStore(backend, client)
+			if err != nil {
+				t.Fatalf("error creating state store: %v", err)
+			}
+			client.State = store
+			r := ReplicasReconcile{Client: client}
+			read := func() *models.Status {
+				status, err := client.ReadWorkloadState(ctx, "", "nginx", "test")
+				if err != nil || status == nil {
+					t.Fatalf("error reading state: %v", err)
+				}
+				return status
+			}
+			assert.NoError(t, client.UpdateState(ctx, &models.Status{Deployment: models.Deployment{Name: "nginx", Namespace: "test", Replicas: 3}, Reconcile: true}))
+
+			// the sync reads the status, then a pin lands through the API before the drift is written
+			stale := read()
+			pin := read()
+			pin.Replicas = 7
+			pin.Paused = true
+			client.recordHistory(pin, "CN=ci", HistorySourceAPI, "", 3, 7)
+			assert.NoError(t, client.UpdateState(ctx, pin))
+			pinned := read()
+
+			r.trackDrift(ctx, stale, &Workload{Name: "nginx", Namespace: "test", Replicas: 5}, false)
+			status := read()
+			assert.NotNil(t, status.DriftSince)
+			assert.Equal(t, int32(7), status.Replicas)
+			assert.True(t, status.Reconcile)
+			assert.True(t, status.Paused)
+			assert.Len(t, status.History, 1)
+			assert.True(t, pinned.Time.Equal(status.Time), "drift tracking must not reset the pin time")
+
+			// a workload removed from state is not written back by the drift tracking
+			assert.NoError(t, store.Delete(ctx, "", "nginx", "test"))
+			r.trackDrift(ctx, &models.Status{Deployment: models.Deployment{Name: "nginx", Namespace: "test", Replicas: 3}, Reconcile: true}, &Workload{Name: "nginx", Namespace: "test", Replicas: 5}, false)
+			deleted, err := store.Read(ctx, "", "nginx", "test")
+			assert.NoError(t, err)
+			assert.Nil(t, deleted)
+		})
+	}
+}
+
+func TestExpiredPin(t *testing.T) {
+	ctx := context.Background()
+	clientSet := newFakeClientset()
+	client := KubernetesClient{Clientset: clientSet, Namespace: "default", State: NewMemoryStateStore()}
+	replicas := int32(5)
+	w := deploymentWorkload(createDeployment(t, clientSet, &replicas, "nginx", "test", "nginx"))
+	expiry := time.Now().Add(-time.Minute)
+	assert.NoError(t, client.UpdateState(ctx, &models.Status{Deployment: models.Deployment{Name: "nginx", Namespace: "test", Replicas: 3}, Reconcile: true, Expiry: &expiry}))
+
+	r := ReplicasReconcile{Client: &client}
+	status, shouldReconcile, err := r.ShouldReconcile(ctx, w)
+	assert.NoError(t, err)
+	assert.False(t, shouldReconcile)
+	assert.True(t, pinExpired(status, time.Now()))
+
+	// the pin is removed and the desired replicas are kept
+	assert.NoError(t, r.expirePin(ctx, status, w))
+	status, err = client.ReadWorkloadState(ctx, "", "nginx", "test")
+	assert.NoError(t, err)
+	assert.False(t, status.Reconcile)
+	assert.Nil(t, status.Expiry)
+	assert.Equal(t, int32(3), status.Replicas)
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"k8s.io/klog/v2"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// OCSP modes of client certificate revocation checks
+const (
+	OCSPModeOff  = "off"  // OCSPModeOff does not query OCSP responders
+	OCSPModeSoft = "soft" // OCSPModeSoft rejects revoked certificates and accepts when the responder can not be reached
+	OCSPModeHard = "hard" // OCSPModeHard rejects revoked and unknown certificates and when the responder can not be reached
+)
+
+// DefaultOCSPTimeout is the default timeout of OCSP responder requests
+const DefaultOCSPTimeout = 5 * time.Second
+
+// defaultOCSPCacheTTL is how long OCSP responses without a next update are cached
+const defaultOCSPCacheTTL = 5 * time.Minute
+
+// maxOCSPCacheEntries is the number of cached OCSP responses, the expired responses and then the responses
+// expiring first are evicted when the cache is full
+const maxOCSPCacheEntries = 10000
+
+// tlsMaterialCRL is the CRL material label of TLS reload metrics
+const tlsMaterialCRL = "crl"
+
+// RevocationChecker rejects revoked client certificates in the TLS handshake by a local CRL file and by OCSP responders,
+// the CRL is reloaded with the certificates by CertificateReloader
+type RevocationChecker struct {
+	CRLFile string
+	// OCSPMode is off, soft or hard
+	OCSPMode string
+	// OCSPResponder overrides the OCSP server of the client certificates when set
+	OCSPResponder string
+	HTTPClient    *http.Client
+
+	mu        sync.RWMutex
+	crl       *x509.RevocationList
+	crlPEM    []byte
+	revoked   map[string]bool
+	responses map[string]*ocspCacheEntry
+	now       func() time.Time
+}
+
+type ocspCacheEntry struct {
+	status  int
+	expires time.Time
+}
+
+// NewRevocationChecker returns a RevocationChecker with the CRL file loaded, crlFile may be empty to only check OCSP
+func NewRevocationChecker(crlFile, ocspMode, ocspResponder string, ocspTimeout time.Duration) (*RevocationChecker, error) {
+	switch ocspMode {
+	case OCSPModeOff, OCSPModeSoft, OCSPModeHard:
+	default:
+		return nil, fmt.Errorf("unknown OCSP mode %q, valid modes are %s, %s and %s", ocspMode, OCSPModeOff, OCSPModeSoft, OCSPModeHard)
+	}
+	c := &RevocationChecker{
+		CRLFile:       crlFile,
+		OCSPMode:      ocspMode,
+		OCSPResponder: ocspResponder,
+		HTTPClient:    &http.Client{Timeout: ocspTimeout},
+		responses:     map[string]*ocspCacheEntry{},
+		now:           time.Now,
+	}
+	if _, err := c.reloadCRL(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// VerifyPeerCertificate rejects the verified client certificate chain if the client certificate is revoked,
+// it is called by the TLS handshake after the chain was verified
+func (c *RevocationChecker) VerifyPeerCertificate(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) < 2 {
+		return nil
+	}
+	leaf, issuer := verifiedChains[0][0], verifiedChains[0][1]
+
+	if err := c.checkCRL(leaf, issuer); err != nil {
+		klog.Warningf("rejected client certificate serial %s CN=%s: %v", leaf.SerialNumber, leaf.Subject.CommonName, err)
+		return err
+	}
+	if err := c.checkOCSP(leaf, issuer); err != nil {
+		klog.Warningf("rejected client certificate serial %s CN=%s: %v", leaf.SerialNumber, leaf.Subject.CommonName, err)
+		return err
+	}
+	return nil
+}
+
+// checkCRL returns an error if the certificate is in the CRL of its issuer
+func (c *RevocationChecker) checkCRL(leaf, issuer *x509.Certificate) error {
+	c.mu.RLock()
+	crl, revoked := c.crl, c.revoked
+	c.mu.RUnlock()
+	if crl == nil || !bytes.Equal(crl.RawIssuer, leaf.RawIssuer) {
+		return nil
+	}
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		return fmt.Errorf("CRL %s is not signed by the client certificate issuer: %v", c.CRLFile, err)
+	}
+	if revoked[leaf.SerialNumber.String()] {
+		return errors.New("certificate is revoked by CRL")
+	}
+	return nil
+}
+
+// checkOCSP returns an error if the OCSP responder reports the certificate revoked, in hard mode also if the status
+// is unknown or the responder can not be reached. responses are cached until their next update, see cacheOCSP
+func (c *RevocationChecker) checkOCSP(leaf, issuer *x509.Certificate) error {
+	if c.OCSPMode == OCSPModeOff {
+		return nil
+	}
+
+	key := string(leaf.RawIssuer) + "/" + leaf.SerialNumber.String()
+	c.mu.RLock()
+	cached, found := c.responses[key]
+	c.mu.RUnlock()
+	status := ocsp.Unknown
+	if found && c.now().Before(cached.expires) {
+		status = cached.status
+	} else {
+		if found {
+			c.mu.Lock()
+			if c.responses[key] == cached {
+				delete(c.responses, key)
+			}
+			c.mu.Unlock()
+		}
+		response, err := c.queryOCSP(leaf, issuer)
+		if err != nil {
+			if c.OCSPMode == OCSPModeHard {
+				return err
+			}
+			klog.Warningf("accepting client certificate serial %s CN=%s without OCSP status: %v", leaf.SerialNumber, leaf.Subject.CommonName, err)
+			return nil
+		}
+		status = response.Status
+		expires := response.NextUpdate
+		if expires.IsZero() {
+			expires = c.now().Add(defaultOCSPCacheTTL)
+		}
+		c.cacheOCSP(key, &ocspCacheEntry{status: status, expires: expires})
+	}
+
+	switch {
+	case status == ocsp.Revoked:
+		return errors.New("certificate is revoked by OCSP responder")
+	case status == ocsp.Unknown && c.OCSPMode == OCSPModeHard:
+		return errors.New("certificate status is unknown to OCSP responder")
+	}
+	return nil
+}
+
+// cacheOCSP caches an OCSP response, a full cache evicts its expired responses or else the response expiring first
+func (c *RevocationChecker) cacheOCSP(key string, entry *ocspCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.responses[key]; !found && len(c.responses) >= maxOCSPCacheEntries {
+		now := c.now()
+		var first string
+		for k, cached := range c.responses {
+			if !now.Before(cached.expires) {
+				delete(c.responses, k)
+			} else if first == "" || cached.expires.Before(c.responses[first].expires) {
+				first = k
+			}
+		}
+		if len(c.responses) >= maxOCSPCacheEntries {
+			delete(c.responses, first)
+		}
+	}
+	c.responses[key] = entry
+}
+
+// queryOCSP requests the status of a certificate from its OCSP responder
+func (c *RevocationChecker) queryOCSP(leaf, issuer *x509.Certificate) (*ocsp.Response, error) {
+	responder := c.OCSPResponder
+	if responder == "" {
+		if len(leaf.OCSPServer) == 0 {
+			return nil, errors.New("certificate has no OCSP server")
+		}
+		responder = leaf.OCSPServer[0]
+	}
+
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating OCSP request: %v", err)
+	}
+	res, err := c.HTTPClient.Post(responder, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, fmt.Errorf("error querying OCSP responder %s: %v", responder, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %s returned %s", responder, res.Status)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading OCSP response from %s: %v", responder, err)
+	}
+	response, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCSP response from %s: %v", responder, err)
+	}
+	return response, nil
+}
+
+// reloadCRL loads the CRL file if it changed since the last successful load, PEM and DER CRLs are accepted
+func (c *RevocationChecker) reloadCRL() (bool, error) {
+	if c.CRLFile == "" {
+		return false, nil
+	}
+	crlPEM, err := os.ReadFile(c.CRLFile)
+	if err != nil {
+		return false, fmt.Errorf("error reading CRL file %s: %v", c.CRLFile, err)
+	}
+
+	c.mu.RLock()
+	unchanged := bytes.Equal(crlPEM, c.crlPEM)
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	der := crlPEM
+	if block, _ := pem.Decode(crlPEM); block != nil {
+		der = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return false, fmt.Errorf("error parsing CRL file %s: %v", c.CRLFile, err)
+	}
+	if !crl.NextUpdate.IsZero() && c.now().After(crl.NextUpdate) {
+		klog.Warningf("CRL %s is past its next update %s", c.CRLFile, crl.NextUpdate)
+	}
+	revoked := make(map[string]bool, len(crl.RevokedCertificates))
+	for _, entry := range crl.RevokedCertificates {
+		revoked[entry.SerialNumber.String()] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.crl, c.crlPEM, c.revoked = crl, crlPEM, revoked
+	return true, nil
+}
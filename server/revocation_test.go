@@ -0,0 +1,210 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestOCSPResponder returns an in-process OCSP responder signed by ca answering with the status of a serial,
+// serials without a status are unknown. requests counts the requests served
+func newTestOCSPResponder(t *testing.T, ca *testCertificate, statuses map[string]int) (server *httptest.Server, requests func() int) {
+	var mu sync.Mutex
+	count := 0
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		count++
+		mu.Unlock()
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		request, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		status, ok := statuses[request.SerialNumber.String()]
+		if !ok {
+			status = ocsp.Unknown
+		}
+		response, err := ocsp.CreateResponse(ca.Cert, ca.Cert, ocsp.Response{
+			Status:       status,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}, ca.Key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(response)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return count
+	}
+}
+
+// newTestCRL returns a PEM CRL of ca revoking the certificates
+func newTestCRL(t *testing.T, ca *testCertificate, number int64, revoked ...*testCertificate) []byte {
+	template := &x509.RevocationList{
+		Number:     big.NewInt(number),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, cert := range revoked {
+		template.RevokedCertificates = append(template.RevokedCertificates, pkix.RevokedCertificate{
+			SerialNumber:   cert.Cert.SerialNumber,
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.Cert, ca.Key)
+	if err != nil {
+		t.Fatalf("error creating CRL: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func TestRevocationChecker(t *testing.T) {
+	ca := newTestCertificate(t, "ca", nil)
+	otherCA := newTestCertificate(t, "other-ca", nil)
+	good := newTestCertificate(t, "good", ca)
+	revokedByCRL := newTestCertificate(t, "revoked-crl", ca)
+	revokedByOCSP := newTestCertificate(t, "revoked-ocsp", ca)
+	unknown := newTestCertificate(t, "unknown", ca)
+	otherClient := newTestCertificate(t, "other", otherCA)
+
+	responder, _ := newTestOCSPResponder(t, ca, map[string]int{
+		good.Cert.SerialNumber.String():          ocsp.Good,
+		revokedByCRL.Cert.SerialNumber.String():  ocsp.Good,
+		revokedByOCSP.Cert.SerialNumber.String(): ocsp.Revoked,
+	})
+	crlFile := writeFile(t, t.TempDir(), "crl.pem", newTestCRL(t, ca, 1, revokedByCRL))
+
+	testCases := []struct {
+		title, ocspMode, responder string
+		client, issuer             *testCertificate
+		expectError                bool
+	}{
+		{title: "Should accept a good certificate", ocspMode: OCSPModeHard, responder: responder.URL, client: good, issuer: ca},
+		{title: "Should reject a certificate in the CRL", ocspMode: OCSPModeOff, client: revokedByCRL, issuer: ca, expectError: true},
+		{title: "Should ignore the CRL of another issuer", ocspMode: OCSPModeOff, client: otherClient, issuer: otherCA},
+		{title: "Should reject a certificate revoked by OCSP", ocspMode: OCSPModeSoft, responder: responder.URL, client: revokedByOCSP, issuer: ca, expectError: true},
+		{title: "Should accept an unknown certificate in soft mode", ocspMode: OCSPModeSoft, responder: responder.URL, client: unknown, issuer: ca},
+		{title: "Should reject an unknown certificate in hard mode", ocspMode: OCSPModeHard, responder: responder.URL, client: unknown, issuer: ca, expectError: true},
+		{title: "Should accept when the responder is down in soft mode", ocspMode: OCSPModeSoft, responder: "http://127.0.0.1:1", client: good, issuer: ca},
+		{title: "Should reject when the responder is down in hard mode", ocspMode: OCSPModeHard, responder: "http://127.0.0.1:1", client: good, issuer: ca, expectError: true},
+		{title: "Should reject a certificate without an OCSP server in hard mode", ocspMode: OCSPModeHard, client: good, issuer: ca, expectError: true},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			checker, err := NewRevocationChecker(crlFile, c.ocspMode, c.responder, time.Second)
+			if err != nil {
+				t.Fatalf("error creating revocation checker: %v", err)
+			}
+			err = checker.VerifyPeerCertificate(nil, [][]*x509.Certificate{{c.client.Cert, c.issuer.Cert}})
+			if c.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestRevocationCheckerCachesOCSPResponses(t *testing.T) {
+	ca := newTestCertificate(t, "ca", nil)
+	client := newTestCertificate(t, "client", ca)
+	responder, requests := newTestOCSPResponder(t, ca, map[string]int{client.Cert.SerialNumber.String(): ocsp.Good})
+
+	checker, err := NewRevocationChecker("", OCSPModeHard, responder.URL, time.Second)
+	if err != nil {
+		t.Fatalf("error creating revocation checker: %v", err)
+	}
+	now := time.Now()
+	checker.now = func() time.Time { return now }
+	chains := [][]*x509.Certificate{{client.Cert, ca.Cert}}
+
+	assert.NoError(t, checker.VerifyPeerCertificate(nil, chains))
+	assert.NoError(t, checker.VerifyPeerCertificate(nil, chains))
+	assert.Equal(t, 1, requests())
+
+	// responses are queried again after their next update
+	now = now.Add(2 * time.Hour)
+	assert.NoError(t, checker.VerifyPeerCertificate(nil, chains))
+	assert.Equal(t, 2, requests())
+}
+
+func TestRevocationCheckerEvictsOCSPResponses(t *testing.T) {
+	now := time.Now()
+	checker := &RevocationChecker{responses: map[string]*ocspCacheEntry{}, now: func() time.Time { return now }}
+	for i := 0; i < maxOCSPCacheEntries; i++ {
+		checker.cacheOCSP(strconv.Itoa(i), &ocspCacheEntry{status: ocsp.Good, expires: now.Add(time.Duration(i+1) * time.Minute)})
+	}
+	assert.Len(t, checker.responses, maxOCSPCacheEntries)
+
+	// a full cache evicts the response expiring first
+	checker.cacheOCSP("new", &ocspCacheEntry{status: ocsp.Good, expires: now.Add(time.Hour)})
+	assert.Len(t, checker.responses, maxOCSPCacheEntries)
+	assert.NotContains(t, checker.responses, "0")
+	assert.Contains(t, checker.responses, "new")
+
+	// and every expired response
+	now = now.Add(10 * time.Minute)
+	checker.cacheOCSP("newer", &ocspCacheEntry{status: ocsp.Good, expires: now.Add(time.Hour)})
+	assert.Len(t, checker.responses, maxOCSPCacheEntries-8)
+	assert.NotContains(t, checker.responses, "9")
+	assert.Contains(t, checker.responses, "10")
+}
+
+func TestCertificateReloaderRejectsRevokedClients(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	serverCert := newTestCertificate(t, "localhost", ca)
+	client := newTestCertificate(t, "client", ca)
+	crlFile := writeFile(t, dir, "crl.pem", newTestCRL(t, ca, 1))
+
+	reloader, err := NewCertificateReloader(writeFile(t, dir, "server.crt", serverCert.CertPEM), writeFile(t, dir, "server.key", serverCert.KeyPEM), writeFile(t, dir, "ca_cert.pem", ca.CertPEM))
+	if err != nil {
+		t.Fatalf("error loading certificates: %v", err)
+	}
+	reloader.Revocation, err = NewRevocationChecker(crlFile, OCSPModeOff, "", time.Second)
+	if err != nil {
+		t.Fatalf("error creating revocation checker: %v", err)
+	}
+	handshake := newTestTLSServer(t, reloader, ca)
+	_, err = handshake(client)
+	assert.NoError(t, err)
+
+	// the CRL is reloaded with the certificates
+	writeFile(t, dir, "crl.pem", newTestCRL(t, ca, 2, client))
+	reloader.Reload()
+	_, err = handshake(client)
+	assert.Error(t, err)
+
+	// an invalid CRL keeps the previous one
+	writeFile(t, dir, "crl.pem", []byte("invalid"))
+	reloader.Reload()
+	_, err = handshake(client)
+	assert.Error(t, err)
+	_, err = handshake(newTestCertificate(t, "client", ca))
+	assert.NoError(t, err)
+}
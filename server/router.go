@@ -3,17 +3,52 @@ package server
 import (
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/innovia/portal/server/metrics"
 	"github.com/innovia/portal/server/models"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // handlerFunc is a wrapper around router handler
 type handlerFunc func(res http.ResponseWriter, req *http.Request) error
 
-// ServeHTTP will call the handler function, if no error returned, return from the function
-// if there's an error log the error and return an HTTP response to client
+// statusRecorder records the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// ServeHTTP will call the handler function and count the request by route and status code in metrics,
+// requests already counted by an outer handlerFunc middleware are not counted again
 func (fn handlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, counted := w.(*statusRecorder); counted {
+		fn.serve(w, r)
+		return
+	}
+
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	fn.serve(recorder, r)
+
+	route := "unknown"
+	if current := mux.CurrentRoute(r); current != nil && current.GetName() != "" {
+		route = current.GetName()
+	}
+	code := strconv.Itoa(recorder.status)
+	metrics.APIRequests.WithLabelValues(route, r.Method, code).Inc()
+	metrics.APIRequestDuration.WithLabelValues(route, r.Method, code).Observe(time.Since(start).Seconds())
+}
+
+// serve will call the handler function, if no error returned, return from the function
+// if there's an error log the error and return an HTTP response to client
+func (fn handlerFunc) serve(w http.ResponseWriter, r *http.Request) {
 	if err := fn(w, r); err != nil { // Call the handler function
 		log.Printf("an error occured: %v", err)
 		clientError, ok := err.(models.ClientError)
@@ -48,17 +83,41 @@ func ApiHandler(client *KubernetesClient) (http.Handler, error) {
 	// RecoveryHandler is HTTP middleware that recovers from a panic, logs the panic, writes http.StatusInternalServerError,
 	// and continues to the next handler.
 	apiHandler.Use(handlers.RecoveryHandler(handlers.PrintRecoveryStack(true)))
-	apiHandler.Handle("/api/v1/namespaces/deployments", handlerFunc(client.GetDeployments))
-	apiHandler.Handle("/api/v1/namespaces/{namespace}/deployments", handlerFunc(client.GetDeployments))
-	apiHandler.Handle("/api/v1/namespaces/{namespace}/deployments/{name}", handlerFunc(client.GetDeployment))
-	apiHandler.Handle("/api/v1/namespaces/{namespace}/deployments/{name}/diff", handlerFunc(client.ReplicasDiff))
-	apiHandler.Handle("/api/v1/namespaces/{namespace}/deployments/{name}/replicas/{replicas}", handlerFunc(client.ScaleReplicas))
-	apiHandler.Handle("/api/v1/namespaces/{namespace}/deployments/{name}/replicas/{replicas}/reconcile", handlerFunc(client.SetReconcileReplicas))
+	// audit mutating requests, denied requests are audited as well
+	if client.Audit != nil {
+		apiHandler.Use(client.audit)
+	}
+	// authorize requests by the client certificate identity when an authorizer is configured
+	if client.Authorizer != nil {
+		apiHandler.Use(client.authorize)
+	}
+	// state and diff routes are registered before the {resource} routes which would match them as well
+	apiHandler.Handle("/api/v1/state", handlerFunc(client.ListState)).Name(routeListState)
+	apiHandler.Handle("/api/v1/namespaces/{namespace}/state", handlerFunc(client.ListState)).Name(routeListState)
+	apiHandler.Handle("/api/v1/diff", handlerFunc(client.ListDiff)).Name(routeListDiff)
+	apiHandler.Handle("/api/v1/namespaces/{namespace}/diff", handlerFunc(client.ListDiff)).Name(routeListDiff)
+	// {resource} is deployments, statefulsets or <resource>.<group> of any resource with a scale subresource
+	apiHandler.Handle("/api/v1/namespaces/{resource}", handlerFunc(client.GetDeployments)).Name(routeListWorkloads)
+	apiHandler.Handle("/api/v1/namespaces/{namespace}/{resource}", handlerFunc(client.GetDeployments)).Name(routeListWorkloads)
+	apiHandler.Handle("/api/v1/namespaces/{namespace}/{resource}/{name}", handlerFunc(client.GetDeployment)).Name(routeGetWorkload)
+	apiHandler.Handle("/api/v1/namespaces/{namespace}/{resource}/{name}/diff", handlerFunc(client.ReplicasDiff)).Name(routeDiff)
+	apiHandler.Handle("/api/v1/namespaces/{namespace}/{resource}/{name}/history", handlerFunc(client.GetHistory)).Name(routeHistory)
+	apiHandler.Handle("/api/v1/namespaces/{namespace}/{resource}/{name}/history/{revision}/rollback", handlerFunc(client.RollbackReplicas)).Name(routeRollback)
+	apiHandler.Handle("/api/v1/namespaces/{namespace}/{resource}/{name}/reconcile", handlerFunc(client.UnsetReconcileReplicas)).Methods(http.MethodDelete).Name(routeUnsetReconcile)
+	apiHandler.Handle("/api/v1/namespaces/{namespace}/{resource}/{name}/reconcile", handlerFunc(client.PatchReconcileReplicas)).Methods(http.MethodPatch).Name(routePatchReconcile)
+	apiHandler.Handle("/api/v1/namespaces/{namespace}/{resource}/{name}/scale", handlerFunc(client.Scale)).Name(routeScale)
+	// the path scale routes are deprecated aliases of the scale route
+	apiHandler.Handle("/api/v1/namespaces/{namespace}/{resource}/{name}/replicas/{replicas}", handlerFunc(client.ScaleReplicas)).Name(routeScaleReplicas)
+	apiHandler.Handle("/api/v1/namespaces/{namespace}/{resource}/{name}/replicas/{replicas}/reconcile", handlerFunc(client.SetReconcileReplicas)).Name(routeReconcileReplicas)
 	return apiHandler, nil
 }
 
 func HealthCheckHandler(client *KubernetesClient) (http.Handler, error) {
 	apiHandler := mux.NewRouter()
-	apiHandler.Handle("/livez", handlerFunc(client.Livez))
+	apiHandler.Handle("/livez", handlerFunc(client.Livez)).Name("livez")
+	apiHandler.Handle("/readyz", handlerFunc(client.Readyz)).Name("readyz")
+	apiHandler.Handle("/readyz/{check}", handlerFunc(client.Readyz)).Name("readyz")
+	apiHandler.Handle("/leader", handlerFunc(client.Leader)).Name("leader")
+	apiHandler.Handle("/metrics", metrics.Handler())
 	return apiHandler, nil
 }
@@ -5,111 +5,181 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/innovia/portal/server/metrics"
 	"github.com/innovia/portal/server/models"
-	v1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
 	"net/http"
-	"strconv"
-	"time"
 )
 
-// ScaleReplicas will scale replica for HTTP PUT requests and update the state
+// ScaleUpdateBackoff is the retry backoff for scale updates that failed on a resourceVersion conflict
+var ScaleUpdateBackoff = retry.DefaultRetry
+
+// ScaleReplicas will scale replica for HTTP PUT requests and update the state,
+// deprecated in favor of the JSON body of the scale route
 func (h *KubernetesClient) ScaleReplicas(res http.ResponseWriter, req *http.Request) error {
 	if req.Method != http.MethodPut {
 		return models.NewHTTPError(nil, http.StatusMethodNotAllowed, "only PUT Method allowed.")
 	}
 
 	vars := mux.Vars(req)
+	deprecateScaleRoute(res, vars)
 	namespace := vars["namespace"]
 	name := vars["name"]
-	replicas, err := strconv.Atoi(vars["replicas"])
+	replicas, err := pathReplicas(vars)
 	if err != nil {
-		return models.NewHTTPError(err, http.StatusInternalServerError, "error can not convert replicas to int32")
+		return err
+	}
+	resource, workloads, err := h.workloadsForRequest(vars)
+	if err != nil {
+		return err
 	}
-	r := int32(replicas)
 
-	// Check if deployment is managed by reconcile loop, return bad request if so.
-	status, err := h.ReadDeploymentState(req.Context(), name, namespace)
+	// Check if workload is managed by reconcile loop, return bad request if so.
+	status, err := h.ReadWorkloadState(req.Context(), resource, name, namespace)
 	if err != nil {
 		return models.NewHTTPError(err, http.StatusBadRequest, "error reading configmap for state")
 	}
 
 	if status != nil && status.Reconcile {
-		return models.NewHTTPError(err, http.StatusBadRequest, "error deployment is managed by reconcile loop")
+		return models.NewHTTPError(err, http.StatusBadRequest, fmt.Sprintf("error %s is managed by reconcile loop", resourceKind(resource)))
 	}
 
-	// scale replicas
-	deployment, err := h.Clientset.AppsV1().Deployments(namespace).Get(req.Context(), name, metav1.GetOptions{})
-	if errors.IsNotFound(err) {
-		return models.NewHTTPError(nil, http.StatusNotFound, fmt.Sprintf("deployment %s in %s namespace not found", name, namespace))
+	reconcile := false
+	status, err = h.applyScale(req, resource, workloads, name, namespace, status, &models.ScaleRequest{Replicas: &replicas, Reconcile: &reconcile})
+	if err != nil {
+		return err
 	}
+	return writeStatus(res, status)
+}
 
-	if err != nil {
-		return models.NewHTTPError(err, http.StatusInternalServerError, "failed to get deployment to scale replicas")
+// SetReconcileReplicas will scale and set the reconcile field in the status to true,
+// deprecated in favor of the JSON body of the scale route
+func (h *KubernetesClient) SetReconcileReplicas(res http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodPut {
+		return models.NewHTTPError(nil, http.StatusMethodNotAllowed, "only PUT Method allowed.")
 	}
 
-	d, err := h.ScaleDeploymentReplicas(req.Context(), deployment, &r)
+	vars := mux.Vars(req)
+	deprecateScaleRoute(res, vars)
+	namespace := vars["namespace"]
+	name := vars["name"]
+	replicas, err := pathReplicas(vars)
 	if err != nil {
 		return err
 	}
-	status.Name = d.ObjectMeta.Name
-	status.Namespace = d.ObjectMeta.Namespace
-	status.Replicas = *d.Spec.Replicas
-
-	// Update state
-	if err := h.UpdateState(req.Context(), status); err != nil {
-		return models.NewHTTPError(err, http.StatusInternalServerError, fmt.Sprintf("error updating state with replicas for deployment %s in namespace %s", name, namespace))
+	resource, workloads, err := h.workloadsForRequest(vars)
+	if err != nil {
+		return err
 	}
 
-	payload, err := json.Marshal(status)
+	// the history of the workload is kept when it is pinned
+	current, err := h.ReadWorkloadState(req.Context(), resource, name, namespace)
 	if err != nil {
-		return models.NewHTTPError(err, http.StatusInternalServerError, "invalid JSON for deployment.")
+		return models.NewHTTPError(err, http.StatusInternalServerError, "error reading configmap for state")
 	}
 
-	res.Header().Set("Content-Type", "application/json")
-	res.Write(payload)
-	return nil
+	// the deprecated route sets a new pin which is not paused
+	if current != nil {
+		unpaused := *current
+		unpaused.Paused = false
+		current = &unpaused
+	}
+	reconcile := true
+	status, err := h.applyScale(req, resource, workloads, name, namespace, current, &models.ScaleRequest{Replicas: &replicas, Reconcile: &reconcile})
+	if err != nil {
+		return err
+	}
+	return writeStatus(res, status)
 }
 
-// SetReconcileReplicas will scale and set the reconcile field in the status to true
-func (h *KubernetesClient) SetReconcileReplicas(res http.ResponseWriter, req *http.Request) error {
-	if req.Method != http.MethodPut {
-		return models.NewHTTPError(nil, http.StatusMethodNotAllowed, "only PUT Method allowed.")
+// UnsetReconcileReplicas will clear the reconcile pin of a workload for HTTP DELETE requests, the desired replicas
+// are kept in state and the workload can be scaled again with ScaleReplicas
+func (h *KubernetesClient) UnsetReconcileReplicas(res http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodDelete {
+		return models.NewHTTPError(nil, http.StatusMethodNotAllowed, "only DELETE Method allowed.")
 	}
 
 	vars := mux.Vars(req)
-	namespace := vars["namespace"]
-	name := vars["name"]
-	replicas, err := strconv.Atoi(vars["replicas"])
+	status, err := h.readReconcileStatus(req.Context(), vars)
 	if err != nil {
-		return models.NewHTTPError(err, http.StatusInternalServerError, "error can not convert replicas to int32")
+		return err
 	}
-	r := int32(replicas)
-	deployment, err := h.Clientset.AppsV1().Deployments(namespace).Get(req.Context(), name, metav1.GetOptions{})
-	if errors.IsNotFound(err) {
-		return models.NewHTTPError(err, http.StatusNotFound, fmt.Sprintf("deployment %s in %s namespace not found", name, namespace))
+
+	status.Reconcile = false
+	status.Paused = false
+	status.Expiry = nil
+	if err := h.UpdateState(req.Context(), status); err != nil {
+		return models.NewHTTPError(err, http.StatusInternalServerError, "failed to update state for reconcile")
+	}
+	auditStatus(req.Context(), status)
+	metrics.DeleteReplicas(ResourcePath(status.Resource), status.Namespace, status.Name)
+	return writeStatus(res, status)
+}
+
+// PatchReconcileReplicas will pause or resume the reconcile of a pinned workload for HTTP PATCH requests,
+// on resume the workload is scaled back to the desired replicas
+func (h *KubernetesClient) PatchReconcileReplicas(res http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodPatch {
+		return models.NewHTTPError(nil, http.StatusMethodNotAllowed, "only PATCH Method allowed.")
 	}
 
-	d, err := h.ScaleDeploymentReplicas(req.Context(), deployment, &r)
+	patch := models.ReconcilePatch{}
+	if err := json.NewDecoder(req.Body).Decode(&patch); err != nil {
+		return models.NewHTTPError(err, http.StatusBadRequest, "invalid JSON for reconcile patch.")
+	}
+	if patch.Paused == nil {
+		return models.NewHTTPError(nil, http.StatusBadRequest, "reconcile patch requires the paused field.")
+	}
+
+	vars := mux.Vars(req)
+	status, err := h.readReconcileStatus(req.Context(), vars)
 	if err != nil {
 		return err
 	}
 
-	status := &models.Status{
-		Deployment: models.Deployment{
-			Name:      d.Name,
-			Namespace: d.Namespace,
-			Replicas:  int32(replicas),
-		},
-		Reconcile: true,
-		Time:      time.Time{},
+	if status.Paused && !*patch.Paused {
+		_, workloads, err := h.workloadsForRequest(vars)
+		if err != nil {
+			return err
+		}
+		if _, _, err := h.scaleWorkload(req.Context(), workloads, status.Resource, status.Name, status.Namespace, status.Replicas); err != nil {
+			return err
+		}
 	}
 
+	status.Paused = *patch.Paused
 	if err := h.UpdateState(req.Context(), status); err != nil {
 		return models.NewHTTPError(err, http.StatusInternalServerError, "failed to update state for reconcile")
 	}
+	auditStatus(req.Context(), status)
+	return writeStatus(res, status)
+}
 
+// readReconcileStatus returns the state of a workload that is pinned by the reconcile loop
+func (h *KubernetesClient) readReconcileStatus(ctx context.Context, vars map[string]string) (*models.Status, error) {
+	namespace := vars["namespace"]
+	name := vars["name"]
+	resource, _, err := h.workloadsForRequest(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := h.ReadWorkloadState(ctx, resource, name, namespace)
+	if err != nil {
+		return nil, models.NewHTTPError(err, http.StatusInternalServerError, "error reading configmap for state")
+	}
+	if status == nil || !status.Reconcile {
+		return nil, models.NewHTTPError(nil, http.StatusNotFound, fmt.Sprintf("%s %s in %s namespace is not managed by reconcile loop", resourceKind(resource), name, namespace))
+	}
+	return status, nil
+}
+
+// writeStatus writes a status as the JSON response
+func writeStatus(res http.ResponseWriter, status *models.Status) error {
 	payload, err := json.Marshal(status)
 	if err != nil {
 		return models.NewHTTPError(err, http.StatusInternalServerError, "invalid JSON for deployment.")
@@ -120,15 +190,74 @@ func (h *KubernetesClient) SetReconcileReplicas(res http.ResponseWriter, req *ht
 	return nil
 }
 
-// ScaleDeploymentReplicas is the core function that scales a deployment replicas in kubernetes
-func (h *KubernetesClient) ScaleDeploymentReplicas(ctx context.Context, d *v1.Deployment, replicas *int32) (*v1.Deployment, error) {
-	d.Spec.Replicas = replicas
-	deployment, err := h.Clientset.AppsV1().Deployments(d.Namespace).Update(ctx, d, metav1.UpdateOptions{})
+// scaleWorkload scales a workload and maps the kubernetes errors to HTTP errors, the replicas before the scale are
+// returned for the history and audit record
+func (h *KubernetesClient) scaleWorkload(ctx context.Context, workloads workloadClient, resource, name, namespace string, replicas int32) (*Workload, int32, error) {
+	w, from, err := workloads.Scale(ctx, namespace, name, replicas)
+	if errors.IsNotFound(err) {
+		return nil, 0, models.NewHTTPError(nil, http.StatusNotFound, fmt.Sprintf("%s %s in %s namespace not found", resourceKind(resource), name, namespace))
+	}
+	if _, ok := err.(models.ClientError); ok {
+		return nil, 0, err
+	}
+	if err != nil {
+		return nil, 0, models.NewHTTPError(err, http.StatusInternalServerError, fmt.Sprintf("error setting replicas for %s %s in namespace %s", resourceKind(resource), name, namespace))
+	}
+	auditReplicas(ctx, from, w.Replicas)
+	return w, from, nil
+}
+
+// ScaleDeploymentReplicas is the core function that scales a deployment replicas in kubernetes through the scale subresource
+func (h *KubernetesClient) ScaleDeploymentReplicas(ctx context.Context, namespace, name string, replicas int32) (*autoscalingv1.Scale, error) {
+	scale, _, err := h.scaleDeployment(ctx, namespace, name, replicas)
+	return scale, err
+}
+
+// scaleDeployment scales a deployment like ScaleDeploymentReplicas and returns the replicas before the scale
+func (h *KubernetesClient) scaleDeployment(ctx context.Context, namespace, name string, replicas int32) (*autoscalingv1.Scale, int32, error) {
+	scale, from, err := updateScale(ctx, h.Clientset.AppsV1().Deployments(namespace), name, replicas)
 	if errors.IsNotFound(err) {
-		return nil, models.NewHTTPError(nil, http.StatusNotFound, fmt.Sprintf("deployment %s not found in %s namespace", d.Name, d.Namespace))
+		return nil, 0, models.NewHTTPError(nil, http.StatusNotFound, fmt.Sprintf("deployment %s not found in %s namespace", name, namespace))
+	}
+	if err != nil {
+		return nil, 0, models.NewHTTPError(err, http.StatusInternalServerError, fmt.Sprintf("error setting replicas for deployment %s in namespace %s", name, namespace))
 	}
+	return scale, from, nil
+}
+
+// scaleInterface reads and writes the scale subresource of a single resource in a namespace
+type scaleInterface interface {
+	GetScale(ctx context.Context, name string, options metav1.GetOptions) (*autoscalingv1.Scale, error)
+	UpdateScale(ctx context.Context, name string, scale *autoscalingv1.Scale, opts metav1.UpdateOptions) (*autoscalingv1.Scale, error)
+}
+
+// updateScale sets the replicas on the scale subresource, the update carries the resourceVersion of the scale
+// that was read so a concurrent change of the replicas results in a conflict, on conflict the scale is read again
+// and the update is retried. the scale is not written when it already has the given replicas.
+// the replicas of the scale that was updated are returned as the replicas before the scale
+func updateScale(ctx context.Context, scales scaleInterface, name string, replicas int32) (*autoscalingv1.Scale, int32, error) {
+	var result *autoscalingv1.Scale
+	var from int32
+	err := retry.RetryOnConflict(ScaleUpdateBackoff, func() error {
+		scale, err := scales.GetScale(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		from = scale.Spec.Replicas
+		if scale.Spec.Replicas == replicas {
+			result = scale
+			return nil
+		}
+
+		scale.Spec.Replicas = replicas
+		result, err = scales.UpdateScale(ctx, name, scale, metav1.UpdateOptions{})
+		if errors.IsConflict(err) {
+			klog.V(3).Infof("scale of %s in namespace %s was modified concurrently, retrying", name, scale.Namespace)
+		}
+		return err
+	})
 	if err != nil {
-		return nil, models.NewHTTPError(err, http.StatusInternalServerError, fmt.Sprintf("error setting replicas for deployment %s in namespace %s", d.Name, d.Namespace))
+		return nil, 0, err
 	}
-	return deployment, nil
+	return result, from, nil
 }
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/innovia/portal/server/audit"
+	"github.com/innovia/portal/server/authz"
+	"github.com/innovia/portal/server/models"
+	"io"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// MaxScaleReasonLength is the maximum number of characters of the reason of a scale request
+const MaxScaleReasonLength = 256
+
+// MaxScaleRequestBytes is the maximum size of the body of a scale request
+const MaxScaleRequestBytes = 64 * 1024
+
+// Scale sets the replicas and the reconcile pin of a workload from the JSON body of HTTP PUT and PATCH requests,
+// PUT replaces the replicas and the pin of the workload and PATCH keeps the current value of the fields that are not set.
+// malformed bodies are rejected with 400 and invalid fields with 422
+func (h *KubernetesClient) Scale(res http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodPut && req.Method != http.MethodPatch {
+		return models.NewHTTPError(nil, http.StatusMethodNotAllowed, "only PUT and PATCH Methods allowed.")
+	}
+
+	scale, err := decodeScaleRequest(res, req)
+	if err != nil {
+		return err
+	}
+
+	vars := mux.Vars(req)
+	namespace := vars["namespace"]
+	name := vars["name"]
+	resource, workloads, err := h.workloadsForRequest(vars)
+	if err != nil {
+		return err
+	}
+
+	current, err := h.ReadWorkloadState(req.Context(), resource, name, namespace)
+	if err != nil {
+		return models.NewHTTPError(err, http.StatusInternalServerError, "error reading configmap for state")
+	}
+	pinned := current != nil && current.Reconcile
+	if req.Method == http.MethodPatch {
+		if err := mergeScaleRequest(req.Context(), scale, current, workloads, resource, name, namespace); err != nil {
+			return err
+		}
+	} else if scale.Reconcile == nil {
+		if pinned {
+			return models.NewHTTPError(nil, http.StatusConflict, fmt.Sprintf("%s %s in %s namespace is managed by reconcile loop, set reconcile to true to change the pinned replicas or to false to unpin it", resourceKind(resource), name, namespace))
+		}
+		reconcile := false
+		scale.Reconcile = &reconcile
+	}
+	if err := validateScaleRequest(scale, time.Now()); err != nil {
+		return err
+	}
+
+	// the replicas of the body are authorized, pinning and unpinning require the reconcile verb
+	if h.Authorizer != nil {
+		verb := authz.VerbScale
+		if *scale.Reconcile || pinned {
+			verb = authz.VerbReconcile
+		}
+		if err := h.authorizeRequest(req, verb, scale.Replicas); err != nil {
+			return err
+		}
+	}
+
+	status, err := h.applyScale(req, resource, workloads, name, namespace, current, scale)
+	if err != nil {
+		return err
+	}
+	return writeStatus(res, status)
+}
+
+// decodeScaleRequest reads the JSON body of a scale request, malformed JSON, unknown fields and fields of the
+// wrong type are rejected with 400 and bodies larger than MaxScaleRequestBytes with 413
+func decodeScaleRequest(res http.ResponseWriter, req *http.Request) (*models.ScaleRequest, error) {
+	scale := &models.ScaleRequest{}
+	dec := json.NewDecoder(http.MaxBytesReader(res, req.Body, MaxScaleRequestBytes))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(scale)
+	if err == nil && dec.More() {
+		return nil, models.NewHTTPError(nil, http.StatusBadRequest, "scale request must be a single JSON object.")
+	}
+	if err == nil {
+		return scale, nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var timeErr *time.ParseError
+	var sizeErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &sizeErr):
+		return nil, models.NewHTTPError(err, http.StatusRequestEntityTooLarge, fmt.Sprintf("scale request body must be at most %d bytes.", sizeErr.Limit))
+	case errors.Is(err, io.EOF):
+		return nil, models.NewHTTPError(err, http.StatusBadRequest, "scale request body is empty.")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return nil, models.NewHTTPError(err, http.StatusBadRequest, "invalid JSON for scale request: unexpected end of body.")
+	case errors.As(err, &syntaxErr):
+		return nil, models.NewHTTPError(err, http.StatusBadRequest, fmt.Sprintf("invalid JSON for scale request at offset %d.", syntaxErr.Offset))
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return nil, models.NewHTTPError(err, http.StatusBadRequest, fmt.Sprintf("field %s must be of type %s.", typeErr.Field, typeErr.Type))
+	case errors.As(err, &typeErr):
+		return nil, models.NewHTTPError(err, http.StatusBadRequest, "scale request must be a JSON object.")
+	case errors.As(err, &timeErr):
+		return nil, models.NewHTTPError(err, http.StatusBadRequest, "field expiry must be an RFC 3339 time.")
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return nil, models.NewHTTPError(err, http.StatusBadRequest, fmt.Sprintf("unknown field %s.", strings.TrimPrefix(err.Error(), "json: unknown field ")))
+	}
+	return nil, models.NewHTTPError(err, http.StatusBadRequest, "invalid JSON for scale request.")
+}
+
+// mergeScaleRequest fills the fields a PATCH scale request does not set from the current state of the workload,
+// the replicas default to the pinned replicas or else to the live replicas
+func mergeScaleRequest(ctx context.Context, scale *models.ScaleRequest, current *models.Status, workloads workloadClient, resource, name, namespace string) error {
+	pinned := current != nil && current.Reconcile
+	if scale.Reconcile == nil {
+		scale.Reconcile = &pinned
+	}
+	if *scale.Reconcile && pinned && scale.Expiry == nil && current.Expiry != nil && current.Expiry.After(time.Now()) {
+		scale.Expiry = current.Expiry
+	}
+	if scale.Replicas != nil {
+		return nil
+	}
+	if pinned {
+		replicas := current.Replicas
+		scale.Replicas = &replicas
+		return nil
+	}
+
+	w, err := workloads.Get(ctx, namespace, name)
+	if k8serrors.IsNotFound(err) {
+		return models.NewHTTPError(nil, http.StatusNotFound, fmt.Sprintf("%s %s in %s namespace not found", resourceKind(resource), name, namespace))
+	}
+	if err != nil {
+		return models.NewHTTPError(err, http.StatusInternalServerError, fmt.Sprintf("error getting %s", resourceKind(resource)))
+	}
+	scale.Replicas = &w.Replicas
+	return nil
+}
+
+// validateScaleRequest returns a 422 error listing every invalid field of a scale request, reconcile must be set
+func validateScaleRequest(scale *models.ScaleRequest, now time.Time) error {
+	var fieldErrors []models.FieldError
+	if scale.Replicas == nil {
+		fieldErrors = append(fieldErrors, models.FieldError{Field: "replicas", Detail: "replicas is required"})
+	} else if *scale.Replicas < 0 {
+		fieldErrors = append(fieldErrors, models.FieldError{Field: "replicas", Detail: "replicas must be greater than or equal to 0"})
+	}
+	if utf8.RuneCountInString(scale.Reason) > MaxScaleReasonLength {
+		fieldErrors = append(fieldErrors, models.FieldError{Field: "reason", Detail: fmt.Sprintf("reason must be at most %d characters", MaxScaleReasonLength)})
+	}
+	if scale.Expiry != nil {
+		if !*scale.Reconcile {
+			fieldErrors = append(fieldErrors, models.FieldError{Field: "expiry", Detail: "expiry requires reconcile to be true"})
+		} else if !scale.Expiry.After(now) {
+			fieldErrors = append(fieldErrors, models.FieldError{Field: "expiry", Detail: "expiry must be in the future"})
+		}
+	}
+	if len(fieldErrors) > 0 {
+		return models.NewValidationError("invalid scale request.", fieldErrors)
+	}
+	return nil
+}
+
+// applyScale scales a workload to the replicas of a validated scale request and writes its state, a dry run gets the
+// workload to check the request against it and returns the resulting state without scaling, recording history or
+// writing it
+func (h *KubernetesClient) applyScale(req *http.Request, resource string, workloads workloadClient, name, namespace string, current *models.Status, scale *models.ScaleRequest) (*models.Status, error) {
+	ctx := req.Context()
+	replicas := *scale.Replicas
+	var w *Workload
+	var from int32
+	var err error
+	if scale.DryRun {
+		w, err = workloads.Get(ctx, namespace, name)
+		if k8serrors.IsNotFound(err) {
+			return nil, models.NewHTTPError(nil, http.StatusNotFound, fmt.Sprintf("%s %s in %s namespace not found", resourceKind(resource), name, namespace))
+		}
+		if err != nil {
+			return nil, models.NewHTTPError(err, http.StatusInternalServerError, fmt.Sprintf("error getting %s", resourceKind(resource)))
+		}
+		w.Replicas = replicas
+	} else {
+		w, from, err = h.scaleWorkload(ctx, workloads, resource, name, namespace, replicas)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	status := &models.Status{Deployment: w.Model(), Reconcile: *scale.Reconcile}
+	status.Replicas = replicas
+	if status.Reconcile {
+		status.Expiry = scale.Expiry
+	}
+	// the history of the workload is kept and a paused pin stays paused when it is kept
+	if current != nil {
+		status.History = current.History
+		status.LastReconcileTime = current.LastReconcileTime
+		status.Paused = current.Reconcile && status.Reconcile && current.Paused
+	}
+	if record := audit.RecordFrom(ctx); record != nil {
+		record.Reason, record.DryRun = scale.Reason, scale.DryRun
+	}
+	// a dry run is audited without the replicas and the state it would have changed
+	if scale.DryRun {
+		status.Time = time.Now()
+		return status, nil
+	}
+
+	h.recordHistory(status, actorOf(req), HistorySourceAPI, scale.Reason, from, replicas)
+	if err := h.UpdateState(ctx, status); err != nil {
+		return nil, models.NewHTTPError(err, http.StatusInternalServerError, fmt.Sprintf("error updating state with replicas for %s %s in namespace %s", resourceKind(resource), name, namespace))
+	}
+	auditStatus(ctx, status)
+	return status, nil
+}
+
+// pathReplicas returns the replicas of the deprecated path scale routes
+func pathReplicas(vars map[string]string) (int32, error) {
+	replicas, err := strconv.ParseInt(vars["replicas"], 10, 32)
+	if err != nil || replicas < 0 {
+		return 0, models.NewHTTPError(err, http.StatusBadRequest, fmt.Sprintf("invalid replicas %q, replicas must be an integer greater than or equal to 0", vars["replicas"]))
+	}
+	return int32(replicas), nil
+}
+
+// deprecateScaleRoute marks the response of a path scale route as deprecated and links the JSON scale route
+func deprecateScaleRoute(res http.ResponseWriter, vars map[string]string) {
+	res.Header().Set("Deprecation", "true")
+	res.Header().Set("Link", fmt.Sprintf("</api/v1/namespaces/%s/%s/%s/scale>; rel=\"successor-version\"", vars["namespace"], vars["resource"], vars["name"]))
+}
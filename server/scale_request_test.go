@@ -0,0 +1,322 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"github.com/innovia/portal/server/authz"
+	"github.com/innovia/portal/server/models"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScale(t *testing.T) {
+	expiry := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	expired := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+	testCases := []struct {
+		title, method, body string
+		pinned, paused      bool
+		dryRun              bool
+		expectedCode        int
+		expectedReplicas    int32 // expectedReplicas are the deployment replicas after the request
+		expectedReconcile   bool
+		expectedExpiry      bool
+		expectedPaused      bool
+		expectedDetail      string
+		expectedErrors      []models.FieldError
+	}{
+		{
+			title:            "Should scale with PUT",
+			method:           http.MethodPut,
+			body:             `{"replicas": 3, "reason": "load test"}`,
+			expectedCode:     http.StatusOK,
+			expectedReplicas: 3,
+		}, {
+			title:             "Should scale and pin with PUT",
+			method:            http.MethodPut,
+			body:              fmt.Sprintf(`{"replicas": 4, "reconcile": true, "expiry": %q}`, expiry),
+			expectedCode:      http.StatusOK,
+			expectedReplicas:  4,
+			expectedReconcile: true,
+			expectedExpiry:    true,
+		}, {
+			title:            "Should unpin with PUT",
+			method:           http.MethodPut,
+			body:             `{"replicas": 3, "reconcile": false}`,
+			pinned:           true,
+			expectedCode:     http.StatusOK,
+			expectedReplicas: 3,
+		}, {
+			title:            "Should not scale a pinned deployment with PUT without reconcile",
+			method:           http.MethodPut,
+			body:             `{"replicas": 3}`,
+			pinned:           true,
+			expectedCode:     http.StatusConflict,
+			expectedReplicas: 2,
+		}, {
+			title:             "Should keep the pin with PATCH",
+			method:            http.MethodPatch,
+			body:              `{"replicas": 5}`,
+			pinned:            true,
+			expectedCode:      http.StatusOK,
+			expectedReplicas:  5,
+			expectedReconcile: true,
+		}, {
+			title:             "Should keep a paused pin paused with PATCH",
+			method:            http.MethodPatch,
+			body:              `{"replicas": 5}`,
+			pinned:            true,
+			paused:            true,
+			expectedCode:      http.StatusOK,
+			expectedReplicas:  5,
+			expectedReconcile: true,
+			expectedPaused:    true,
+		}, {
+			title:            "Should unpause when unpinning with PUT",
+			method:           http.MethodPut,
+			body:             `{"replicas": 3, "reconcile": false}`,
+			pinned:           true,
+			paused:           true,
+			expectedCode:     http.StatusOK,
+			expectedReplicas: 3,
+		}, {
+			title:             "Should keep the pinned replicas with PATCH",
+			method:            http.MethodPatch,
+			body:              fmt.Sprintf(`{"expiry": %q}`, expiry),
+			pinned:            true,
+			expectedCode:      http.StatusOK,
+			expectedReplicas:  2,
+			expectedReconcile: true,
+			expectedExpiry:    true,
+		}, {
+			title:             "Should pin the live replicas with PATCH",
+			method:            http.MethodPatch,
+			body:              `{"reconcile": true}`,
+			expectedCode:      http.StatusOK,
+			expectedReplicas:  1,
+			expectedReconcile: true,
+		}, {
+			title:            "Should not scale on dry run",
+			method:           http.MethodPut,
+			body:             `{"replicas": 3, "dryRun": true}`,
+			dryRun:           true,
+			expectedCode:     http.StatusOK,
+			expectedReplicas: 1,
+		}, {
+			title:            "Should return 400 for an empty body",
+			method:           http.MethodPut,
+			expectedCode:     http.StatusBadRequest,
+			expectedReplicas: 1,
+			expectedDetail:   "scale request body is empty.",
+		}, {
+			title:            "Should return 413 for a body over the maximum size",
+			method:           http.MethodPut,
+			body:             fmt.Sprintf(`{"replicas": 3, "reason": %q}`, strings.Repeat("x", MaxScaleRequestBytes)),
+			expectedCode:     http.StatusRequestEntityTooLarge,
+			expectedReplicas: 1,
+			expectedDetail:   fmt.Sprintf("scale request body must be at most %d bytes.", MaxScaleRequestBytes),
+		}, {
+			title:            "Should return 400 for malformed JSON",
+			method:           http.MethodPut,
+			body:             `{"replicas": 3,}`,
+			expectedCode:     http.StatusBadRequest,
+			expectedReplicas: 1,
+			expectedDetail:   "invalid JSON for scale request at offset 16.",
+		}, {
+			title:            "Should return 400 for non-numeric replicas",
+			method:           http.MethodPut,
+			body:             `{"replicas": "three"}`,
+			expectedCode:     http.StatusBadRequest,
+			expectedReplicas: 1,
+			expectedDetail:   "field replicas must be of type int32.",
+		}, {
+			title:            "Should return 400 for an unknown field",
+			method:           http.MethodPut,
+			body:             `{"replicas": 3, "ttl": "1h"}`,
+			expectedCode:     http.StatusBadRequest,
+			expectedReplicas: 1,
+			expectedDetail:   `unknown field "ttl".`,
+		}, {
+			title:            "Should return 400 for an invalid expiry",
+			method:           http.MethodPut,
+			body:             `{"replicas": 3, "reconcile": true, "expiry": "tomorrow"}`,
+			expectedCode:     http.StatusBadRequest,
+			expectedReplicas: 1,
+			expectedDetail:   "field expiry must be an RFC 3339 time.",
+		}, {
+			title:            "Should return 422 for every invalid field",
+			method:           http.MethodPut,
+			body:             fmt.Sprintf(`{"reason": %q, "expiry": %q}`, strings.Repeat("x", MaxScaleReasonLength+1), expiry),
+			expectedCode:     http.StatusUnprocessableEntity,
+			expectedReplicas: 1,
+			expectedDetail:   "invalid scale request.",
+			expectedErrors: []models.FieldError{
+				{Field: "replicas", Detail: "replicas is required"},
+				{Field: "reason", Detail: "reason must be at most 256 characters"},
+				{Field: "expiry", Detail: "expiry requires reconcile to be true"},
+			},
+		}, {
+			title:            "Should return 422 for negative replicas and an expiry in the past",
+			method:           http.MethodPut,
+			body:             fmt.Sprintf(`{"replicas": -1, "reconcile": true, "expiry": %q}`, expired),
+			expectedCode:     http.StatusUnprocessableEntity,
+			expectedReplicas: 1,
+			expectedDetail:   "invalid scale request.",
+			expectedErrors: []models.FieldError{
+				{Field: "replicas", Detail: "replicas must be greater than or equal to 0"},
+				{Field: "expiry", Detail: "expiry must be in the future"},
+			},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			ctx := context.Background()
+			api := newTestAPI(t)
+			replicas := int32(1)
+			createDeployment(t, api.clientSet, &replicas, "web", "prod", "nginx")
+			serve := func(method, path, body string) *httptest.ResponseRecorder {
+				return api.serve(httptest.NewRequest(method, path, strings.NewReader(body)))
+			}
+			if c.pinned {
+				assert.Equal(t, http.StatusOK, serve(http.MethodPut, "/api/v1/namespaces/prod/deployments/web/replicas/2/reconcile", "").Code)
+			}
+			if c.paused {
+				assert.Equal(t, http.StatusOK, serve(http.MethodPatch, "/api/v1/namespaces/prod/deployments/web/reconcile", `{"paused": true}`).Code)
+			}
+
+			res := serve(c.method, "/api/v1/namespaces/prod/deployments/web/scale", c.body)
+			assert.Equal(t, c.expectedCode, res.Code)
+			deployment, _ := api.clientSet.AppsV1().Deployments("prod").Get(ctx, "web", metav1.GetOptions{})
+			assert.Equal(t, c.expectedReplicas, *deployment.Spec.Replicas)
+
+			if c.expectedCode != http.StatusOK {
+				if c.expectedDetail != "" {
+					httpErr := models.HTTPError{}
+					assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &httpErr))
+					assert.Equal(t, c.expectedDetail, httpErr.Detail)
+					assert.Equal(t, c.expectedErrors, httpErr.Errors)
+				}
+				return
+			}
+			status := models.Status{}
+			assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &status))
+			assert.Equal(t, c.expectedReconcile, status.Reconcile)
+			assert.Equal(t, c.expectedExpiry, status.Expiry != nil)
+			assert.Equal(t, c.expectedPaused, status.Paused)
+			if c.dryRun {
+				assert.Empty(t, status.History)
+				return
+			}
+			assert.Equal(t, HistorySourceAPI, status.History[len(status.History)-1].Source)
+		})
+	}
+}
+
+func TestScaleRecordsReasonAndDryRun(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+	replicas := int32(1)
+	createDeployment(t, api.clientSet, &replicas, "web", "prod", "nginx")
+
+	// a dry run does not write state
+	res := api.serve(httptest.NewRequest(http.MethodPut, "/api/v1/namespaces/prod/deployments/web/scale", strings.NewReader(`{"replicas": 3, "dryRun": true}`)))
+	assert.Equal(t, http.StatusOK, res.Code)
+	status, err := api.client.ReadWorkloadState(ctx, "", "web", "prod")
+	assert.NoError(t, err)
+	assert.Nil(t, status)
+
+	res = api.serve(httptest.NewRequest(http.MethodPut, "/api/v1/namespaces/prod/deployments/web/scale", strings.NewReader(`{"replicas": 3, "reason": "load test"}`)))
+	assert.Equal(t, http.StatusOK, res.Code)
+	status, err = api.client.ReadWorkloadState(ctx, "", "web", "prod")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), status.Replicas)
+	last := status.History[len(status.History)-1]
+	assert.Equal(t, models.HistoryEntry{Revision: 1, Time: last.Time, Source: HistorySourceAPI, Reason: "load test", From: 1, To: 3}, last)
+}
+
+func TestDeprecatedScaleRoutes(t *testing.T) {
+	testCases := []struct {
+		title, path  string
+		expectedCode int
+	}{
+		{
+			title:        "Should scale through the deprecated route",
+			path:         "/api/v1/namespaces/prod/deployments/web/replicas/3",
+			expectedCode: http.StatusOK,
+		}, {
+			title:        "Should pin through the deprecated route",
+			path:         "/api/v1/namespaces/prod/deployments/web/replicas/3/reconcile",
+			expectedCode: http.StatusOK,
+		}, {
+			title:        "Should return 400 for non-numeric replicas",
+			path:         "/api/v1/namespaces/prod/deployments/web/replicas/three",
+			expectedCode: http.StatusBadRequest,
+		}, {
+			title:        "Should return 400 for negative replicas",
+			path:         "/api/v1/namespaces/prod/deployments/web/replicas/-1/reconcile",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			api := newTestAPI(t)
+			replicas := int32(1)
+			createDeployment(t, api.clientSet, &replicas, "web", "prod", "nginx")
+			res := api.serve(httptest.NewRequest(http.MethodPut, c.path, nil))
+			assert.Equal(t, c.expectedCode, res.Code)
+			assert.Equal(t, "true", res.Header().Get("Deprecation"))
+			assert.Equal(t, `</api/v1/namespaces/prod/deployments/web/scale>; rel="successor-version"`, res.Header().Get("Link"))
+		})
+	}
+}
+
+func TestScaleAuthorizesBodyReplicas(t *testing.T) {
+	api := newTestAPI(t)
+	replicas := int32(1)
+	createDeployment(t, api.clientSet, &replicas, "web", "prod", "nginx")
+	maxReplicas := int32(5)
+	api.client.Authorizer = &authz.PolicyAuthorizer{Policies: []authz.Policy{{
+		Name:        "ci",
+		Subjects:    authz.Subjects{CommonNames: []string{"ci"}},
+		Namespaces:  []string{"prod"},
+		Deployments: []string{"*"},
+		Verbs:       []string{authz.VerbScale},
+		MaxReplicas: &maxReplicas,
+	}, {
+		Name:        "ops",
+		Subjects:    authz.Subjects{CommonNames: []string{"ops"}},
+		Namespaces:  []string{"prod"},
+		Deployments: []string{"*"},
+		Verbs:       []string{authz.VerbReconcile},
+	}}}
+
+	testCases := []struct {
+		title, identity, method, body string
+		expectedCode                  int
+	}{
+		{title: "Should allow replicas up to the policy maximum", identity: "ci", method: http.MethodPut, body: `{"replicas": 5}`, expectedCode: http.StatusOK},
+		{title: "Should deny replicas over the policy maximum", identity: "ci", method: http.MethodPut, body: `{"replicas": 6}`, expectedCode: http.StatusForbidden},
+		{title: "Should deny a pin without the reconcile verb", identity: "ci", method: http.MethodPatch, body: `{"reconcile": true}`, expectedCode: http.StatusForbidden},
+		{title: "Should allow a pin with only the reconcile verb", identity: "ops", method: http.MethodPut, body: `{"replicas": 2, "reconcile": true}`, expectedCode: http.StatusOK},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, "/api/v1/namespaces/prod/deployments/web/scale", strings.NewReader(c.body))
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: c.identity}}
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+			assert.Equal(t, c.expectedCode, api.serve(req).Code)
+		})
+	}
+}
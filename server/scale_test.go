@@ -8,8 +8,11 @@ import (
 	"github.com/stretchr/testify/assert"
 	"io"
 	v1 "k8s.io/api/apps/v1"
-	"k8s.io/client-go/kubernetes/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
 	"net/http"
+	"strings"
 	"testing"
 )
 
@@ -49,7 +52,7 @@ func TestScaleReplicasForDeployment(t *testing.T) {
 	for _, c := range testCases {
 		t.Run(c.title, func(t *testing.T) {
 			var expectedDeployment *v1.Deployment
-			clientSet := fake.NewSimpleClientset()
+			clientSet := newFakeClientset()
 			client := KubernetesClient{Clientset: clientSet, Namespace: "default"}
 
 			// unless specified in subtest as name "non-exist" create the deployment
@@ -129,3 +132,132 @@ func TestScaleReplicasForDeployment(t *testing.T) {
 		})
 	}
 }
+
+func TestScaleDeploymentRetriesOnConflict(t *testing.T) {
+	ctx := context.Background()
+	clientSet := newFakeClientset()
+	client := KubernetesClient{Clientset: clientSet, Namespace: "default"}
+	replicas := int32(1)
+	deployment := createDeployment(t, clientSet, &replicas, "nginx", "test", "nginx:1.0")
+
+	// the fake object tracker does not set a resourceVersion on create
+	deployment.ResourceVersion = "1"
+	if err := clientSet.Tracker().Update(v1.SchemeGroupVersion.WithResource("deployments"), deployment, "test"); err != nil {
+		t.Fatalf("error updating deployment: %v", err)
+	}
+
+	// change the image between the scale read and write of the first attempt, like a CI image bump would
+	scaleUpdates := 0
+	clientSet.PrependReactor("update", "deployments/scale", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		scaleUpdates++
+		if scaleUpdates > 1 {
+			return false, nil, nil
+		}
+		d, err := clientSet.Tracker().Get(action.GetResource(), "test", "nginx")
+		if err != nil {
+			return true, nil, err
+		}
+		deployment := d.(*v1.Deployment)
+		deployment.Spec.Template.Spec.Containers[0].Image = "nginx:2.0"
+		deployment.ResourceVersion = "10"
+		return false, nil, clientSet.Tracker().Update(action.GetResource(), deployment, "test")
+	})
+
+	scale, err := client.ScaleDeploymentReplicas(ctx, "test", "nginx", 3)
+	if err != nil {
+		t.Fatalf("error scaling deployment: %v", err)
+	}
+	assert.Equal(t, int32(3), scale.Spec.Replicas)
+	assert.Equal(t, 2, scaleUpdates)
+
+	d, err := clientSet.AppsV1().Deployments("test").Get(ctx, "nginx", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting deployment: %v", err)
+	}
+	assert.Equal(t, int32(3), *d.Spec.Replicas)
+	assert.Equal(t, "nginx:2.0", d.Spec.Template.Spec.Containers[0].Image)
+
+	// scaling never writes the full deployment
+	for _, action := range clientSet.Actions() {
+		if action.GetVerb() == "update" {
+			assert.Equal(t, "scale", action.GetSubresource())
+		}
+	}
+}
+
+func TestUnsetAndPauseReconcile(t *testing.T) {
+	ctx := context.Background()
+	clientSet := newFakeClientset()
+	client := KubernetesClient{Clientset: clientSet, Namespace: "default", State: NewMemoryStateStore()}
+	replicas := int32(1)
+	createDeployment(t, clientSet, &replicas, "nginx", "test", "nginx")
+	server := createHttpTestServer(t, client, clientSet)
+	reconcileUrl := fmt.Sprintf("%s/api/v1/namespaces/test/deployments/nginx/reconcile", server.URL)
+
+	do := func(method, url, body string) (*http.Response, models.Status) {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error calling %s %s: %v", method, url, err)
+		}
+		defer res.Body.Close()
+		status := models.Status{}
+		if res.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+				t.Fatalf("error decoding status: %v", err)
+			}
+		}
+		return res, status
+	}
+
+	// nothing to unpin before the deployment is pinned
+	res, _ := do(http.MethodDelete, reconcileUrl, "")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res, _ = do(http.MethodPut, fmt.Sprintf("%s/api/v1/namespaces/test/deployments/nginx/replicas/3/reconcile", server.URL), "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res, status := do(http.MethodPatch, reconcileUrl, `{"paused": true}`)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.True(t, status.Reconcile)
+	assert.True(t, status.Paused)
+	assert.Equal(t, int32(3), status.Replicas)
+
+	// a paused deployment is not reconciled
+	if _, err := client.ScaleDeploymentReplicas(ctx, "test", "nginx", 5); err != nil {
+		t.Fatalf("error scaling deployment: %v", err)
+	}
+	r := ReplicasReconcile{Client: &client}
+	_, shouldReconcile, err := r.ShouldReconcile(ctx, &Workload{Name: "nginx", Namespace: "test", Replicas: 5, ReadyReplicas: 5})
+	assert.NoError(t, err)
+	assert.False(t, shouldReconcile)
+
+	// the deployment is still pinned while paused
+	res, _ = do(http.MethodPut, fmt.Sprintf("%s/api/v1/namespaces/test/deployments/nginx/replicas/4", server.URL), "")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, _ = do(http.MethodPatch, reconcileUrl, `{}`)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// resume scales back to the desired replicas
+	res, status = do(http.MethodPatch, reconcileUrl, `{"paused": false}`)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.False(t, status.Paused)
+	d, err := clientSet.AppsV1().Deployments("test").Get(ctx, "nginx", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting deployment: %v", err)
+	}
+	assert.Equal(t, int32(3), *d.Spec.Replicas)
+
+	res, status = do(http.MethodDelete, reconcileUrl, "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.False(t, status.Reconcile)
+	assert.Equal(t, int32(3), status.Replicas)
+
+	// an unpinned deployment can be scaled again
+	res, _ = do(http.MethodPut, fmt.Sprintf("%s/api/v1/namespaces/test/deployments/nginx/replicas/4", server.URL), "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res, _ = do(http.MethodGet, reconcileUrl, "")
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+}
@@ -4,12 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/innovia/portal/server/metrics"
 	"github.com/innovia/portal/server/models"
 	v1 "k8s.io/api/core/v1"
 	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -20,10 +23,33 @@ const (
 	StateDefaultStatusMsg   = "Portal Replica Controller State"
 )
 
+// state configmap schema, version 1 keys are <name>.<namespace> which is ambiguous for deployment names with dots,
+// version 2 keys are <namespace>_<name> for deployments and <namespace>_<name>_<resource> for other workloads,
+// an underscore is not allowed in namespace, object or resource names and every key that holds a status contains one
+const (
+	StateStatusKey        = "status"
+	StateSchemaVersionKey = "schemaVersion"
+	StateSchemaVersion    = "2"
+)
+
+// MaxStateConfigMapBytes is the size the data of the state configmap is kept under, below the 1 MiB limit of a
+// configmap, the oldest history entries of a workload are dropped to keep its write under it
+const MaxStateConfigMapBytes = 900 * 1024
+
+// StateUpdateBackoff is the retry backoff for state writes that failed on a resourceVersion conflict
+var StateUpdateBackoff = wait.Backoff{
+	Steps:    20,
+	Duration: 10 * time.Millisecond,
+	Factor:   1.5,
+	Jitter:   1,
+	Cap:      time.Second,
+}
+
 // InitState will create a new configmap with a state placeholder of status and the StateDefaultStatusMsg constant
 func (h *KubernetesClient) InitState(ctx context.Context, name, namespace string) (*v1.ConfigMap, error) {
 	data := map[string]string{
-		"status": StateDefaultStatusMsg,
+		StateStatusKey:        StateDefaultStatusMsg,
+		StateSchemaVersionKey: StateSchemaVersion,
 	}
 	obj := SetConfigMapObject(name, namespace, data)
 	cfgMap, err := h.CreateConfigMap(ctx, obj, namespace)
@@ -34,86 +60,309 @@ func (h *KubernetesClient) InitState(ctx context.Context, name, namespace string
 	return cfgMap, nil
 }
 
-// UpdateState will get the state and update the configmap with the mutated data
-func (h *KubernetesClient) UpdateState(ctx context.Context, status *models.Status) error {
-	state, err := h.GetState(ctx)
-	if err != nil {
-		return models.NewHTTPError(err, http.StatusInternalServerError, fmt.Sprintf("could not retrieve state configmap  %s at %s namespace", StateConfigMapName, h.Namespace))
-	}
+// ConfigMapStateStore is a StateStore that keeps the status of every deployment as a JSON entry
+// in the portal-replica-controller configmap
+type ConfigMapStateStore struct {
+	Client *KubernetesClient
+}
 
+// Update will write the status of a workload into the state configmap, only the key of the given workload
+// is changed and the write is retried on a fresh copy of the state when the configmap was modified concurrently
+func (s *ConfigMapStateStore) Update(ctx context.Context, status *models.Status) error {
 	status.Time = time.Now()
 
-	data, err := json.Marshal(status)
+	key := stateKey(status.Resource, status.Name, status.Namespace)
+	var entryErr error
+	err := s.Client.mutateState(ctx, func(state map[string]string) bool {
+		if status.Resource == "" {
+			delete(state, legacyStateKey(status.Name, status.Namespace))
+		}
+		delete(state, key)
+		var data string
+		data, entryErr = fitStateEntry(state, key, status)
+		if entryErr != nil {
+			return false
+		}
+		state[key] = data
+		return true
+	})
+	if err == nil {
+		err = entryErr
+	}
 	if err != nil {
-		return err
+		return fmt.Errorf("error updating configmap state: %v", err)
 	}
+	return nil
+}
 
-	identifier := fmt.Sprintf("%s.%s", status.Name, status.Namespace)
-	state.Data[identifier] = string(data)
+// RecordDrift sets the drift tracking of a status on the entry of the workload in the state configmap, the entry is
+// read again on every write attempt so the rest of it and its time are kept. a workload that is not in state is ignored
+func (s *ConfigMapStateStore) RecordDrift(ctx context.Context, status *models.Status) error {
+	key := stateKey(status.Resource, status.Name, status.Namespace)
+	var entryErr error
+	err := s.Client.mutateState(ctx, func(state map[string]string) bool {
+		entryErr = nil
+		value, ok := state[key]
+		if !ok && status.Resource == "" {
+			value, ok = state[legacyStateKey(status.Name, status.Namespace)]
+		}
+		if !ok {
+			return false
+		}
 
-	_, err = h.UpdateConfigMap(ctx, state, h.Namespace)
+		current := &models.Status{}
+		if entryErr = json.Unmarshal([]byte(value), current); entryErr != nil {
+			return false
+		}
+		if !setDrift(current, status) {
+			return false
+		}
+		if status.Resource == "" {
+			delete(state, legacyStateKey(status.Name, status.Namespace))
+		}
+		delete(state, key)
+		var data string
+		data, entryErr = fitStateEntry(state, key, current)
+		if entryErr != nil {
+			return false
+		}
+		state[key] = data
+		return true
+	})
+	if err == nil {
+		err = entryErr
+	}
 	if err != nil {
-		return fmt.Errorf("error updating configmap state: %v", err.Error())
+		return fmt.Errorf("error updating drift of %s in configmap state: %v", key, err)
 	}
 	return nil
 }
 
-// ReadDeploymentState will get the state and return a status for a given deployment name and namespace
-func (h *KubernetesClient) ReadDeploymentState(ctx context.Context, deploymentName string, deploymentNamespace string) (*models.Status, error) {
-	state, err := h.GetState(ctx)
+// fitStateEntry returns the JSON of a status for a key of the state, the oldest history entries of the status are
+// dropped while the state data would be larger than MaxStateConfigMapBytes
+func fitStateEntry(state map[string]string, key string, status *models.Status) (string, error) {
+	size := len(key)
+	for k, v := range state {
+		size += len(k) + len(v)
+	}
+	for {
+		data, err := json.Marshal(status)
+		if err != nil {
+			return "", err
+		}
+		if size+len(data) <= MaxStateConfigMapBytes {
+			return string(data), nil
+		}
+		if len(status.History) == 0 {
+			return "", fmt.Errorf("state of %s would exceed %d bytes, use the crd state backend for more workloads", key, MaxStateConfigMapBytes)
+		}
+		klog.Warningf("state configmap is close to its size limit, dropping the oldest history entry of %s", key)
+		status.History = status.History[1:]
+	}
+}
+
+// Read will get the state and return a status for a given workload resource, name and namespace,
+// nil is returned if the workload is not in state
+func (s *ConfigMapStateStore) Read(ctx context.Context, resource, name, namespace string) (*models.Status, error) {
+	state, err := s.Client.GetState(ctx)
+	if err != nil {
+		return nil, models.NewHTTPError(err, http.StatusInternalServerError, "could not retrieve state configmap")
+	}
+
+	key := stateKey(resource, name, namespace)
+	value, ok := state.Data[key]
+	if !ok && resource == "" {
+		// fallback for entries written by a replica that was not upgraded yet
+		value, ok = state.Data[legacyStateKey(name, namespace)]
+	}
+	if !ok {
+		klog.V(3).Infof("did not find %s in state", key)
+		return nil, nil
+	}
+
+	status := &models.Status{}
+	if err := json.Unmarshal([]byte(value), status); err != nil {
+		return nil, fmt.Errorf("error parsing status of %s from state: %v", key, err)
+	}
+	return status, nil
+}
+
+// List returns the status of every workload in the state configmap
+func (s *ConfigMapStateStore) List(ctx context.Context) ([]models.Status, error) {
+	state, err := s.Client.GetState(ctx)
 	if err != nil {
 		return nil, models.NewHTTPError(err, http.StatusInternalServerError, "could not retrieve state configmap")
 	}
 
-	if state != nil {
-		key := fmt.Sprintf("%s.%s", deploymentName, deploymentNamespace)
-		status := &models.Status{}
+	entries, err := parseStateEntries(state.Data)
+	if err != nil {
+		return nil, err
+	}
 
-		if value, ok := state.Data[key]; ok {
-			err := json.Unmarshal([]byte(value), status)
+	statuses := make([]models.Status, 0, len(entries))
+	for _, entry := range entries {
+		statuses = append(statuses, entry.status)
+	}
+	sortStatuses(statuses)
+	return statuses, nil
+}
+
+// Delete will remove a key entry from state for a given workload resource, name and namespace
+func (s *ConfigMapStateStore) Delete(ctx context.Context, resource, name, namespace string) error {
+	keys := []string{stateKey(resource, name, namespace)}
+	if resource == "" {
+		keys = append(keys, legacyStateKey(name, namespace))
+	}
+	err := s.Client.mutateState(ctx, func(state map[string]string) bool {
+		changed := false
+		for _, key := range keys {
+			if _, ok := state[key]; ok {
+				delete(state, key)
+				changed = true
+			}
+		}
+		return changed
+	})
+	if err != nil {
+		return fmt.Errorf("error updating configmap state: %v", err)
+	}
+	return nil
+}
+
+// Migrate rewrites the keys of a version 1 state configmap in place to the current schema version,
+// if a deployment has both an old and a new key the new key is kept. it returns the number of migrated keys.
+func (s *ConfigMapStateStore) Migrate(ctx context.Context) (int, error) {
+	migrated := 0
+	err := s.Client.mutateState(ctx, func(state map[string]string) bool {
+		migrated = 0
+		if state[StateSchemaVersionKey] == StateSchemaVersion {
+			return false
+		}
+
+		for key, value := range state {
+			if isReservedStateKey(key) || isStateKey(key) {
+				continue
+			}
+			name, namespace, err := parseLegacyStateEntry(key, value)
 			if err != nil {
-				return nil, fmt.Errorf("error parsing status of deployment from state: %v", err)
+				klog.Errorf("skipping migration of state key %s: %v", key, err)
+				continue
 			}
 
-			if !ok {
-				klog.Infof("did not find %s in state, skipping drift detection...", key)
-				return nil, nil
+			if _, ok := state[stateKey("", name, namespace)]; !ok {
+				state[stateKey("", name, namespace)] = value
 			}
+			delete(state, key)
+			migrated++
 		}
-		return status, nil
+		state[StateSchemaVersionKey] = StateSchemaVersion
+		return true
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error migrating state configmap to schema version %s: %v", StateSchemaVersion, err)
+	}
+	if migrated > 0 {
+		klog.Infof("migrated %d state keys to schema version %s", migrated, StateSchemaVersion)
 	}
-	return nil, nil
+	return migrated, nil
 }
 
-// DeleteDeploymentFromState will remove a key entry from state for a given deployment name and namespace
-func (h *KubernetesClient) DeleteDeploymentFromState(ctx context.Context, deploymentName string, deploymentNamespace string) error {
-	key := fmt.Sprintf("%s.%s", deploymentName, deploymentNamespace)
-	state, err := h.GetState(ctx)
-	if err != nil {
-		return models.NewHTTPError(err, http.StatusInternalServerError, "could not retrieve state configmap")
+// stateEntry is a parsed deployment status from the state configmap
+type stateEntry struct {
+	key    string
+	status models.Status
+}
+
+// parseStateEntries parses every workload status in the state configmap data, when a deployment
+// has both a legacy and a current key the current key wins
+func parseStateEntries(data map[string]string) (map[string]stateEntry, error) {
+	entries := map[string]stateEntry{}
+	for key, value := range data {
+		if isReservedStateKey(key) {
+			continue
+		}
+
+		status := models.Status{}
+		if err := json.Unmarshal([]byte(value), &status); err != nil {
+			return nil, fmt.Errorf("error parsing status of %s from state: %v", key, err)
+		}
+
+		id := stateKey(status.Resource, status.Name, status.Namespace)
+		if existing, ok := entries[id]; ok && isStateKey(existing.key) {
+			continue
+		}
+		entries[id] = stateEntry{key: key, status: status}
 	}
-	delete(state.Data, key)
+	return entries, nil
+}
 
-	cfg := &v1.ConfigMap{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: StateConfigMapName,
-		},
-		Data: state.Data,
+// stateKey returns the state configmap key of a workload, deployments keep the key without a resource suffix
+func stateKey(resource, name, namespace string) string {
+	if resource == "" {
+		return namespace + "_" + name
 	}
+	return namespace + "_" + name + "_" + resource
+}
 
-	_, err = h.UpdateConfigMap(ctx, cfg, h.Namespace)
-	if err != nil {
-		return fmt.Errorf("error updating configmap state: %v", err.Error())
+// legacyStateKey returns the schema version 1 state configmap key of a deployment
+func legacyStateKey(name, namespace string) string {
+	return fmt.Sprintf("%s.%s", name, namespace)
+}
+
+// isStateKey returns true if the key is a current schema version workload key
+func isStateKey(key string) bool {
+	return strings.Contains(key, "_")
+}
+
+// isReservedStateKey returns true for the state configmap keys that do not hold a workload status
+func isReservedStateKey(key string) bool {
+	return key == StateStatusKey || key == StateSchemaVersionKey
+}
+
+// parseLegacyStateEntry returns the deployment name and namespace of a schema version 1 entry, the status value
+// holds both, if it can not be parsed the key is split on the last dot since namespaces can not contain dots
+func parseLegacyStateEntry(key, value string) (string, string, error) {
+	status := models.Status{}
+	if err := json.Unmarshal([]byte(value), &status); err == nil && status.Name != "" && status.Namespace != "" {
+		return status.Name, status.Namespace, nil
 	}
-	return nil
+
+	i := strings.LastIndex(key, ".")
+	if i <= 0 || i == len(key)-1 {
+		return "", "", fmt.Errorf("key does not match the format of <name>.<namespace>")
+	}
+	return key[:i], key[i+1:], nil
+}
+
+// mutateState runs a read-modify-write cycle on the state configmap, the update carries the resourceVersion
+// of the configmap that was read so a concurrent write results in a conflict, on conflict the state is read again
+// and mutate is re-applied. mutate returns false when there is nothing to write.
+func (h *KubernetesClient) mutateState(ctx context.Context, mutate func(state map[string]string) bool) error {
+	return retry.RetryOnConflict(StateUpdateBackoff, func() error {
+		state, err := h.GetState(ctx)
+		if err != nil {
+			return err
+		}
+
+		if !mutate(state.Data) {
+			return nil
+		}
+
+		_, err = h.UpdateConfigMap(ctx, state, h.Namespace)
+		if k8sErrors.IsConflict(err) {
+			klog.V(3).Infof("state configmap %s was modified concurrently, retrying", StateConfigMapName)
+			metrics.StateConflicts.WithLabelValues(StateBackendConfigMap).Inc()
+		}
+		return err
+	})
 }
 
 // GetState will return the state configmap
 func (h *KubernetesClient) GetState(ctx context.Context) (*v1.ConfigMap, error) {
 	cfg, err := h.GetConfigMap(ctx, StateConfigMapName, h.Namespace)
 
-	// if configmap is empty create new one with init state and return
-	if k8sErrors.IsNotFound(err) || cfg == nil {
+	// if configmap is not found create new one with init state and return
+	if k8sErrors.IsNotFound(err) {
 		klog.V(3).Info("state configmap was not found initializing state")
 		if h.Namespace == "" {
 			h.Namespace = StateConfigMapNamespace
@@ -131,7 +380,8 @@ func (h *KubernetesClient) GetState(ctx context.Context) (*v1.ConfigMap, error)
 
 	if cfg.Data == nil {
 		cfg.Data = map[string]string{
-			"status": StateDefaultStatusMsg,
+			StateStatusKey:        StateDefaultStatusMsg,
+			StateSchemaVersionKey: StateSchemaVersion,
 		}
 		cfgMap, err := h.UpdateConfigMap(ctx, cfg, h.Namespace)
 
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/innovia/portal/server/models"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"strconv"
+)
+
+// ListState returns every status in state with the live replicas of its workload for HTTP request,
+// if namespace is set only the statuses of that namespace are returned. the reconcile and drift query parameters
+// filter the statuses by their reconcile flag and by drift between the live and the desired replicas
+func (h *KubernetesClient) ListState(res http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return models.NewHTTPError(nil, http.StatusMethodNotAllowed, "only GET Method allowed.")
+	}
+
+	namespace := mux.Vars(req)["namespace"]
+	reconcileFilter, err := boolQueryParam(req, "reconcile")
+	if err != nil {
+		return err
+	}
+	driftFilter, err := boolQueryParam(req, "drift")
+	if err != nil {
+		return err
+	}
+
+	statuses, err := h.stateStore().List(req.Context())
+	if err != nil {
+		return models.NewHTTPError(err, http.StatusInternalServerError, "could not list state")
+	}
+
+	// live workloads by resource and namespace/name, every resource in state is listed once
+	live := map[string]map[string]Workload{}
+	entries := models.StateEntries{Items: []models.StateEntry{}}
+	for _, status := range statuses {
+		if namespace != "" && status.Namespace != namespace {
+			continue
+		}
+		if reconcileFilter != nil && status.Reconcile != *reconcileFilter {
+			continue
+		}
+
+		workloads, ok := live[status.Resource]
+		if !ok {
+			workloads, err = h.listWorkloads(req, status.Resource, namespace)
+			if err != nil {
+				return err
+			}
+			live[status.Resource] = workloads
+		}
+
+		entry := models.StateEntry{Status: status}
+		if w, found := workloads[status.Namespace+"/"+status.Name]; found {
+			replicas := w.Replicas
+			entry.LiveReplicas = &replicas
+			entry.Drift = replicas != status.Replicas
+		}
+		if driftFilter != nil && entry.Drift != *driftFilter {
+			continue
+		}
+		entries.Items = append(entries.Items, entry)
+	}
+	entries.Count = len(entries.Items)
+
+	payload, err := json.Marshal(entries)
+	if err != nil {
+		return models.NewHTTPError(err, http.StatusInternalServerError, "invalid JSON for state.")
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(payload)
+	return nil
+}
+
+// listWorkloads returns the workloads of a resource in a namespace by namespace/name
+func (h *KubernetesClient) listWorkloads(req *http.Request, resource, namespace string) (map[string]Workload, error) {
+	workloads, err := h.workloads(resource)
+	if err != nil {
+		return nil, models.NewHTTPError(err, http.StatusInternalServerError, fmt.Sprintf("error listing %s", ResourcePath(resource)))
+	}
+	list, _, err := workloads.List(req.Context(), namespace, metav1.ListOptions{})
+	if err != nil {
+		return nil, models.NewHTTPError(err, http.StatusInternalServerError, fmt.Sprintf("error listing %s", ResourcePath(resource)))
+	}
+
+	byKey := make(map[string]Workload, len(list))
+	for _, w := range list {
+		byKey[w.Namespace+"/"+w.Name] = w
+	}
+	return byKey, nil
+}
+
+// boolQueryParam returns the value of a boolean query parameter, nil when the parameter is not set
+func boolQueryParam(req *http.Request, name string) (*bool, error) {
+	value := req.URL.Query().Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, models.NewHTTPError(err, http.StatusBadRequest, fmt.Sprintf("invalid value %q for query parameter %s, must be true or false", value, name))
+	}
+	return &b, nil
+}
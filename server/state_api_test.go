@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/innovia/portal/server/models"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestListState(t *testing.T) {
+	ctx := context.Background()
+	clientSet := newFakeClientset()
+	client := KubernetesClient{Clientset: clientSet, Namespace: "default", State: NewMemoryStateStore()}
+
+	replicas := int32(1)
+	for _, d := range []struct{ name, namespace string }{{"nginx", "test"}, {"web", "test"}, {"api", "prod"}} {
+		createDeployment(t, clientSet, &replicas, d.name, d.namespace, "nginx")
+	}
+	reconcileTime := time.Now()
+	for _, status := range []models.Status{
+		{Deployment: models.Deployment{Name: "nginx", Namespace: "test", Replicas: 3}, Reconcile: true, LastReconcileTime: &reconcileTime},
+		{Deployment: models.Deployment{Name: "web", Namespace: "test", Replicas: 1}},
+		{Deployment: models.Deployment{Name: "api", Namespace: "prod", Replicas: 1}, Reconcile: true},
+		{Deployment: models.Deployment{Name: "deleted", Namespace: "prod", Replicas: 2}, Reconcile: true},
+	} {
+		if err := client.UpdateState(ctx, &status); err != nil {
+			t.Fatalf("error updating state: %v", err)
+		}
+	}
+	server := createHttpTestServer(t, client, clientSet)
+
+	testCases := []struct {
+		title, path    string
+		expectedStatus int
+		expected       []string
+	}{
+		{
+			title:          "Should list every status in state",
+			path:           "/api/v1/state",
+			expectedStatus: http.StatusOK,
+			expected:       []string{"prod/api", "prod/deleted", "test/nginx", "test/web"},
+		}, {
+			title:          "Should list the statuses of a namespace",
+			path:           "/api/v1/namespaces/test/state",
+			expectedStatus: http.StatusOK,
+			expected:       []string{"test/nginx", "test/web"},
+		}, {
+			title:          "Should filter by reconcile",
+			path:           "/api/v1/state?reconcile=false",
+			expectedStatus: http.StatusOK,
+			expected:       []string{"test/web"},
+		}, {
+			title:          "Should filter by drift",
+			path:           "/api/v1/state?drift=true",
+			expectedStatus: http.StatusOK,
+			expected:       []string{"test/nginx"},
+		}, {
+			title:          "Should combine filters",
+			path:           "/api/v1/namespaces/prod/state?reconcile=true&drift=false",
+			expectedStatus: http.StatusOK,
+			expected:       []string{"prod/api", "prod/deleted"},
+		}, {
+			title:          "Should reject an invalid filter",
+			path:           "/api/v1/state?drift=maybe",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			res, err := http.Get(server.URL + c.path)
+			if err != nil {
+				t.Fatalf("error listing state: %v", err)
+			}
+			defer res.Body.Close()
+			assert.Equal(t, c.expectedStatus, res.StatusCode)
+			if c.expectedStatus != http.StatusOK {
+				return
+			}
+
+			entries := models.StateEntries{}
+			if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+				t.Fatalf("error decoding state: %v", err)
+			}
+			var names []string
+			for _, entry := range entries.Items {
+				names = append(names, fmt.Sprintf("%s/%s", entry.Namespace, entry.Name))
+
+				switch entry.Name {
+				case "nginx":
+					assert.Equal(t, int32(1), *entry.LiveReplicas)
+					assert.True(t, entry.Drift)
+					assert.NotNil(t, entry.LastReconcileTime)
+				case "deleted":
+					assert.Nil(t, entry.LiveReplicas)
+					assert.False(t, entry.Drift)
+				default:
+					assert.Equal(t, int32(1), *entry.LiveReplicas)
+					assert.False(t, entry.Drift)
+				}
+			}
+			assert.Equal(t, c.expected, names)
+			assert.Equal(t, len(c.expected), entries.Count)
+		})
+	}
+}
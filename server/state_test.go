@@ -2,11 +2,16 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"github.com/innovia/portal/server/models"
 	"github.com/stretchr/testify/assert"
-	"k8s.io/client-go/kubernetes/fake"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestStateCrud(t *testing.T) {
@@ -39,7 +44,7 @@ func TestStateCrud(t *testing.T) {
 
 	for _, c := range testCases {
 		t.Run(c.title, func(t *testing.T) {
-			clientSet := fake.NewSimpleClientset()
+			clientSet := newFakeClientset()
 			client := KubernetesClient{Clientset: clientSet, Namespace: "default"}
 
 			if c.name == "state" && c.namespace == "state" {
@@ -48,7 +53,8 @@ func TestStateCrud(t *testing.T) {
 					t.Fatalf("could not initialize state: %v", err)
 				}
 				expectedState := map[string]string{
-					"status": StateDefaultStatusMsg,
+					StateStatusKey:        StateDefaultStatusMsg,
+					StateSchemaVersionKey: StateSchemaVersion,
 				}
 				assert.True(t, reflect.DeepEqual(expectedState, cfgMap.Data))
 			}
@@ -74,3 +80,299 @@ func TestStateCrud(t *testing.T) {
 		})
 	}
 }
+
+func TestStateConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	clientSet := newFakeClientset()
+	enforceResourceVersion(clientSet, "configmaps")
+	client := KubernetesClient{Clientset: clientSet, Namespace: "default"}
+
+	workers := 25
+
+	// pre-populate entries that will be deleted concurrently with the updates below
+	for i := 0; i < workers; i++ {
+		status := &models.Status{Deployment: models.Deployment{Name: fmt.Sprintf("deleted-%d", i), Namespace: "test", Replicas: 1}}
+		if err := client.UpdateState(ctx, status); err != nil {
+			t.Fatalf("error updating state: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*2)
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			status := &models.Status{
+				Deployment: models.Deployment{Name: fmt.Sprintf("nginx-%d", i), Namespace: "test", Replicas: int32(i)},
+				Reconcile:  i%2 == 0,
+			}
+			errs <- client.UpdateState(ctx, status)
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			errs <- client.DeleteDeploymentFromState(ctx, fmt.Sprintf("deleted-%d", i), "test")
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	state, err := client.GetState(ctx)
+	if err != nil {
+		t.Fatalf("error reading state: %v", err)
+	}
+	// every update should be kept and every delete applied, plus the status and schema version keys
+	assert.Len(t, state.Data, workers+2)
+
+	for i := 0; i < workers; i++ {
+		status, err := client.ReadDeploymentState(ctx, fmt.Sprintf("nginx-%d", i), "test")
+		if err != nil {
+			t.Fatalf("error reading state: %v", err)
+		}
+		assert.Equal(t, int32(i), status.Replicas)
+		assert.Equal(t, i%2 == 0, status.Reconcile)
+	}
+}
+
+func TestStateConcurrentInit(t *testing.T) {
+	ctx := context.Background()
+	clientSet := newFakeClientset()
+	enforceResourceVersion(clientSet, "configmaps")
+	client := KubernetesClient{Clientset: clientSet, Namespace: "default"}
+
+	// all writers race to create the missing state configmap
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			status := &models.Status{Deployment: models.Deployment{Name: fmt.Sprintf("nginx-%d", i), Namespace: "test", Replicas: 1}}
+			assert.NoError(t, client.UpdateState(ctx, status))
+		}(i)
+	}
+	wg.Wait()
+
+	state, err := client.GetState(ctx)
+	if err != nil {
+		t.Fatalf("error reading state: %v", err)
+	}
+	assert.Len(t, state.Data, 12)
+}
+
+func TestStateUpdateStaleResourceVersion(t *testing.T) {
+	ctx := context.Background()
+	clientSet := newFakeClientset()
+	enforceResourceVersion(clientSet, "configmaps")
+	client := KubernetesClient{Clientset: clientSet, Namespace: "default"}
+
+	state, err := client.GetState(ctx)
+	if err != nil {
+		t.Fatalf("error reading state: %v", err)
+	}
+
+	status := &models.Status{Deployment: models.Deployment{Name: "nginx", Namespace: "test", Replicas: 2}}
+	if err := client.UpdateState(ctx, status); err != nil {
+		t.Fatalf("error updating state: %v", err)
+	}
+
+	// writing a stale copy must be rejected instead of dropping the entry written above
+	state.Data["other.test"] = "{}"
+	_, err = client.UpdateConfigMap(ctx, state, client.Namespace)
+	assert.True(t, k8sErrors.IsConflict(err))
+
+	status, err = client.ReadDeploymentState(ctx, "nginx", "test")
+	if err != nil {
+		t.Fatalf("error reading state: %v", err)
+	}
+	assert.Equal(t, int32(2), status.Replicas)
+}
+
+func TestStateConfigMapSizeLimit(t *testing.T) {
+	ctx := context.Background()
+	client := KubernetesClient{Clientset: newFakeClientset(), Namespace: "default"}
+	store := &ConfigMapStateStore{Client: &client}
+	status := &models.Status{Deployment: models.Deployment{Name: "nginx", Namespace: "test", Replicas: 2}}
+	for i := 0; i < DefaultHistoryLimit; i++ {
+		client.recordHistory(status, "CN=ci", HistorySourceAPI, strings.Repeat("x", MaxScaleReasonLength), int32(i), int32(i+1))
+	}
+	assert.NoError(t, store.Update(ctx, status))
+	state, err := client.GetState(ctx)
+	if err != nil {
+		t.Fatalf("error reading state: %v", err)
+	}
+	size := 0
+	for k, v := range state.Data {
+		size += len(k) + len(v)
+	}
+
+	// the oldest history entries are dropped to keep the state under the limit
+	filler := strings.Repeat("x", MaxStateConfigMapBytes-size-len("filler")+1000)
+	assert.NoError(t, client.mutateState(ctx, func(state map[string]string) bool {
+		state["filler"] = filler
+		return true
+	}))
+	assert.NoError(t, store.Update(ctx, status))
+	read, err := store.Read(ctx, "", "nginx", "test")
+	assert.NoError(t, err)
+	assert.Less(t, len(read.History), DefaultHistoryLimit)
+	assert.Equal(t, status.History, read.History)
+	assert.Equal(t, int64(DefaultHistoryLimit), read.History[len(read.History)-1].Revision)
+
+	// a state without room for the status is not written
+	assert.NoError(t, client.mutateState(ctx, func(state map[string]string) bool {
+		state["filler"] = filler + strings.Repeat("x", 10000)
+		return true
+	}))
+	status.Replicas = 3
+	assert.Error(t, store.Update(ctx, status))
+	read, err = store.Read(ctx, "", "nginx", "test")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), read.Replicas)
+}
+
+func TestStateStoreBackends(t *testing.T) {
+	for _, backend := range []string{StateBackendConfigMap, StateBackendMemory, StateBackendCRD} {
+		t.Run(backend, func(t *testing.T) {
+			ctx := context.Background()
+			client := &KubernetesClient{Clientset: newFakeClientset(), Dynamic: newFakeDynamicClient(), Namespace: "default"}
+			store, err := NewStateStore(backend, client)
+			if err != nil {
+				t.Fatalf("error creating state store: %v", err)
+			}
+
+			// reading a deployment that is not in state returns nil
+			status, err := store.Read(ctx, "", "nginx", "test")
+			assert.NoError(t, err)
+			assert.Nil(t, status)
+
+			for _, d := range []models.Deployment{
+				{Name: "web", Namespace: "b", Replicas: 1},
+				{Name: "nginx", Namespace: "test", Replicas: 3},
+				{Name: "api", Namespace: "b", Replicas: 2},
+				{Name: "web", Namespace: "b", Replicas: 4, Resource: ResourceStatefulSets},
+			} {
+				if err := store.Update(ctx, &models.Status{Deployment: d, Reconcile: true}); err != nil {
+					t.Fatalf("error updating state: %v", err)
+				}
+			}
+
+			status, err = store.Read(ctx, "", "nginx", "test")
+			assert.NoError(t, err)
+			assert.Equal(t, int32(3), status.Replicas)
+			assert.True(t, status.Reconcile)
+			assert.False(t, status.Time.IsZero())
+
+			// the replicas history is persisted with the status
+			client.recordHistory(status, "CN=ci", HistorySourceAPI, "", 3, 5)
+			assert.NoError(t, store.Update(ctx, status))
+			status, err = store.Read(ctx, "", "nginx", "test")
+			assert.NoError(t, err)
+			if assert.Len(t, status.History, 1) {
+				assert.Equal(t, "CN=ci", status.History[0].Actor)
+				assert.Equal(t, int32(5), status.History[0].To)
+			}
+
+			// the drift tracking of the reconcile loop is persisted with the status
+			driftSince := time.Date(2022, 8, 30, 4, 20, 11, 0, time.UTC)
+			status.DriftSince = &driftSince
+			status.ReconcileFailures = 2
+			status.LastReconcileError = "forbidden"
+			assert.NoError(t, store.Update(ctx, status))
+			status, err = store.Read(ctx, "", "nginx", "test")
+			assert.NoError(t, err)
+			if assert.NotNil(t, status.DriftSince) {
+				assert.True(t, driftSince.Equal(*status.DriftSince))
+			}
+			assert.Equal(t, 2, status.ReconcileFailures)
+			assert.Equal(t, "forbidden", status.LastReconcileError)
+
+			// a statefulset and a deployment with the same name are kept apart
+			status, err = store.Read(ctx, ResourceStatefulSets, "web", "b")
+			assert.NoError(t, err)
+			assert.Equal(t, int32(4), status.Replicas)
+			assert.Equal(t, ResourceStatefulSets, status.Resource)
+			status, err = store.Read(ctx, "", "web", "b")
+			assert.NoError(t, err)
+			assert.Equal(t, int32(1), status.Replicas)
+
+			statuses, err := store.List(ctx)
+			assert.NoError(t, err)
+			var names []string
+			for _, s := range statuses {
+				names = append(names, ResourcePath(s.Resource)+"/"+s.Namespace+"/"+s.Name)
+			}
+			assert.Equal(t, []string{"deployments/b/api", "deployments/b/web", "statefulsets/b/web", "deployments/test/nginx"}, names)
+
+			assert.NoError(t, store.Delete(ctx, "", "nginx", "test"))
+			assert.NoError(t, store.Delete(ctx, "", "nginx", "test"))
+			status, err = store.Read(ctx, "", "nginx", "test")
+			assert.NoError(t, err)
+			assert.Nil(t, status)
+		})
+	}
+
+	_, err := NewStateStore("etcd", &KubernetesClient{})
+	assert.Error(t, err)
+}
+
+func TestStateKeyMigration(t *testing.T) {
+	ctx := context.Background()
+	clientSet := newFakeClientset()
+	client := &KubernetesClient{Clientset: clientSet, Namespace: "default"}
+	store := &ConfigMapStateStore{Client: client}
+
+	// schema version 1 state, a deployment name with dots and a deployment that has both key versions
+	legacy := map[string]string{
+		StateStatusKey:              StateDefaultStatusMsg,
+		"nginx.test":                `{"name":"nginx","namespace":"test","replicas":3,"reconcile":true}`,
+		"web.v2.prod":               `{"name":"web.v2","namespace":"prod","replicas":4,"reconcile":false}`,
+		"api.prod":                  `{"name":"api","namespace":"prod","replicas":1,"reconcile":false}`,
+		stateKey("", "api", "prod"): `{"name":"api","namespace":"prod","replicas":2,"reconcile":true}`,
+	}
+	if _, err := client.CreateConfigMap(ctx, SetConfigMapObject(StateConfigMapName, "default", legacy), "default"); err != nil {
+		t.Fatalf("error creating state configmap: %v", err)
+	}
+
+	// legacy keys are readable before the migration
+	status, err := store.Read(ctx, "", "web.v2", "prod")
+	if err != nil {
+		t.Fatalf("error reading state: %v", err)
+	}
+	assert.Equal(t, int32(4), status.Replicas)
+
+	migrated, err := store.Migrate(ctx)
+	if err != nil {
+		t.Fatalf("error migrating state: %v", err)
+	}
+	assert.Equal(t, 3, migrated)
+
+	state, err := client.GetState(ctx)
+	if err != nil {
+		t.Fatalf("error reading state: %v", err)
+	}
+	expectedKeys := []string{"prod_api", "prod_web.v2", StateSchemaVersionKey, StateStatusKey, "test_nginx"}
+	var keys []string
+	for key := range state.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	assert.Equal(t, expectedKeys, keys)
+	assert.Equal(t, StateSchemaVersion, state.Data[StateSchemaVersionKey])
+
+	// the current key wins over the legacy key
+	status, err = store.Read(ctx, "", "api", "prod")
+	if err != nil {
+		t.Fatalf("error reading state: %v", err)
+	}
+	assert.Equal(t, int32(2), status.Replicas)
+	assert.True(t, status.Reconcile)
+
+	// migrating again is a no-op
+	migrated, err = store.Migrate(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, migrated)
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/innovia/portal/server/metrics"
+	"github.com/innovia/portal/server/models"
+	"sort"
+	"time"
+)
+
+// state backends that can be selected with the --state_backend flag
+const (
+	StateBackendConfigMap = "configmap"
+	StateBackendMemory    = "memory"
+	StateBackendCRD       = "crd"
+)
+
+// StateStore persists the desired replicas status of deployments and other scalable workloads,
+// the resource of a workload is normalized with NormalizeResource so deployments have an empty resource
+type StateStore interface {
+	// Read returns the status for a given workload resource, name and namespace, nil if the workload is not in state
+	Read(ctx context.Context, resource, name, namespace string) (*models.Status, error)
+
+	// List returns the status of every workload in state sorted by namespace, name and resource
+	List(ctx context.Context) ([]models.Status, error)
+
+	// Update writes the status of a workload into state and sets the status time to now
+	Update(ctx context.Context, status *models.Status) error
+
+	// Delete removes a workload from state, deleting a workload that is not in state is not an error
+	Delete(ctx context.Context, resource, name, namespace string) error
+}
+
+// NewStateStore returns the state store for the given backend name
+func NewStateStore(backend string, client *KubernetesClient) (StateStore, error) {
+	switch backend {
+	case StateBackendConfigMap:
+		return &ConfigMapStateStore{Client: client}, nil
+	case StateBackendMemory:
+		return NewMemoryStateStore(), nil
+	case StateBackendCRD:
+		if client.Dynamic == nil {
+			return nil, fmt.Errorf("state backend %s requires a dynamic kubernetes client", backend)
+		}
+		return &CRDStateStore{Client: client.Dynamic}, nil
+	default:
+		return nil, fmt.Errorf("unknown state backend %q, valid backends are %s, %s and %s", backend, StateBackendConfigMap, StateBackendMemory, StateBackendCRD)
+	}
+}
+
+// stateStore returns the configured state store, when none is set the configmap state is used.
+// the latency of state operations is observed in metrics
+func (h *KubernetesClient) stateStore() StateStore {
+	if h.State == nil {
+		return observeState(&ConfigMapStateStore{Client: h})
+	}
+	return observeState(h.State)
+}
+
+// observedStateStore observes the latency of the operations of a state store
+type observedStateStore struct {
+	StateStore
+	backend string
+}
+
+// observeState returns the state store with its operations observed in metrics
+func observeState(store StateStore) StateStore {
+	if _, observed := store.(*observedStateStore); observed {
+		return store
+	}
+	return &observedStateStore{StateStore: store, backend: stateBackend(store)}
+}
+
+// setDrift copies the drift tracking of src to dst and returns true when it changed
+func setDrift(dst, src *models.Status) bool {
+	sameSince := (dst.DriftSince == nil) == (src.DriftSince == nil) && (dst.DriftSince == nil || dst.DriftSince.Equal(*src.DriftSince))
+	if sameSince && dst.ReconcileFailures == src.ReconcileFailures && dst.LastReconcileError == src.LastReconcileError {
+		return false
+	}
+	dst.DriftSince = src.DriftSince
+	dst.ReconcileFailures = src.ReconcileFailures
+	dst.LastReconcileError = src.LastReconcileError
+	return true
+}
+
+// unwrapState returns the state store observed by observeState
+func unwrapState(store StateStore) StateStore {
+	if observed, ok := store.(*observedStateStore); ok {
+		return observed.StateStore
+	}
+	return store
+}
+
+// stateBackend returns the backend name of a state store used as the metrics label
+func stateBackend(store StateStore) string {
+	switch store.(type) {
+	case *ConfigMapStateStore:
+		return StateBackendConfigMap
+	case *MemoryStateStore:
+		return StateBackendMemory
+	case *CRDStateStore:
+		return StateBackendCRD
+	}
+	return "other"
+}
+
+// observe records the latency of a state operation started at start
+func (s *observedStateStore) observe(operation string, start time.Time, err error) {
+	metrics.StateOperationDuration.WithLabelValues(s.backend, operation, metrics.Result(err)).Observe(time.Since(start).Seconds())
+}
+
+func (s *observedStateStore) Read(ctx context.Context, resource, name, namespace string) (status *models.Status, err error) {
+	defer func(start time.Time) { s.observe("read", start, err) }(time.Now())
+	return s.StateStore.Read(ctx, resource, name, namespace)
+}
+
+func (s *observedStateStore) List(ctx context.Context) (statuses []models.Status, err error) {
+	defer func(start time.Time) { s.observe("list", start, err) }(time.Now())
+	return s.StateStore.List(ctx)
+}
+
+func (s *observedStateStore) Update(ctx context.Context, status *models.Status) (err error) {
+	defer func(start time.Time) { s.observe("update", start, err) }(time.Now())
+	return s.StateStore.Update(ctx, status)
+}
+
+func (s *observedStateStore) Delete(ctx context.Context, resource, name, namespace string) (err error) {
+	defer func(start time.Time) { s.observe("delete", start, err) }(time.Now())
+	return s.StateStore.Delete(ctx, resource, name, namespace)
+}
+
+// UpdateState will write the status of a deployment to the state store
+func (h *KubernetesClient) UpdateState(ctx context.Context, status *models.Status) error {
+	return h.stateStore().Update(ctx, status)
+}
+
+// ReadDeploymentState will return the status for a given deployment name and namespace from the state store
+func (h *KubernetesClient) ReadDeploymentState(ctx context.Context, deploymentName string, deploymentNamespace string) (*models.Status, error) {
+	return h.ReadWorkloadState(ctx, "", deploymentName, deploymentNamespace)
+}
+
+// ReadWorkloadState will return the status for a given workload resource, name and namespace from the state store
+func (h *KubernetesClient) ReadWorkloadState(ctx context.Context, resource, name, namespace string) (*models.Status, error) {
+	return h.stateStore().Read(ctx, resource, name, namespace)
+}
+
+// DeleteDeploymentFromState will remove a given deployment name and namespace from the state store
+func (h *KubernetesClient) DeleteDeploymentFromState(ctx context.Context, deploymentName string, deploymentNamespace string) error {
+	return h.stateStore().Delete(ctx, "", deploymentName, deploymentNamespace)
+}
+
+// sortStatuses sorts statuses by namespace, name and resource
+func sortStatuses(statuses []models.Status) {
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Namespace != statuses[j].Namespace {
+			return statuses[i].Namespace < statuses[j].Namespace
+		}
+		if statuses[i].Name != statuses[j].Name {
+			return statuses[i].Name < statuses[j].Name
+		}
+		return statuses[i].Resource < statuses[j].Resource
+	})
+}
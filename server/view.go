@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"github.com/innovia/portal/server/models"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+	"net/http"
+)
+
+// views of the workload read routes selected with the view query parameter
+const (
+	ViewCompact = "compact"
+	ViewFull    = "full"
+)
+
+// viewOf returns the view query parameter of a request, compact when not set
+func viewOf(req *http.Request) (string, error) {
+	switch view := req.URL.Query().Get("view"); view {
+	case "", ViewCompact:
+		return ViewCompact, nil
+	case ViewFull:
+		return ViewFull, nil
+	default:
+		return "", models.NewHTTPError(nil, http.StatusBadRequest, fmt.Sprintf("unknown view %q, valid views are %s and %s", view, ViewCompact, ViewFull))
+	}
+}
+
+// workloadDetails returns the full view of workloads of a single resource, the status is merged with the HPA
+// targeting each workload and its pin status in state. HPAs are listed once per namespace, all namespaces when
+// namespace is empty, and left out when the list is forbidden
+func (h *KubernetesClient) workloadDetails(req *http.Request, resource, namespace string, workloads []Workload) ([]models.DeploymentDetail, error) {
+	ctx := req.Context()
+	details := make([]models.DeploymentDetail, 0, len(workloads))
+	if len(workloads) == 0 {
+		return details, nil
+	}
+
+	hpas, err := h.listHPAs(req, namespace)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := h.objectReference(resource, "", "", "")
+	if err != nil {
+		return nil, models.NewHTTPError(err, http.StatusInternalServerError, fmt.Sprintf("error resolving kind of %s", ResourcePath(resource)))
+	}
+	group := schema.FromAPIVersionAndKind(ref.APIVersion, ref.Kind).Group
+	targets := map[string]*autoscalingv1.HorizontalPodAutoscaler{}
+	for _, hpa := range hpas {
+		target := hpa.Spec.ScaleTargetRef
+		gv, err := schema.ParseGroupVersion(target.APIVersion)
+		if err != nil || gv.Group != group || target.Kind != ref.Kind {
+			continue
+		}
+		targets[hpa.Namespace+"/"+target.Name] = hpa
+	}
+
+	// a single workload reads its own state, lists read the whole state once
+	statuses := map[string]*models.Status{}
+	if len(workloads) == 1 {
+		w := workloads[0]
+		status, err := h.ReadWorkloadState(ctx, resource, w.Name, w.Namespace)
+		if err != nil {
+			return nil, models.NewHTTPError(err, http.StatusInternalServerError, "error reading state")
+		}
+		if status != nil {
+			statuses[w.Namespace+"/"+w.Name] = status
+		}
+	} else {
+		list, err := h.stateStore().List(ctx)
+		if err != nil {
+			return nil, models.NewHTTPError(err, http.StatusInternalServerError, "error reading state")
+		}
+		for i := range list {
+			if list[i].Resource == resource {
+				statuses[list[i].Namespace+"/"+list[i].Name] = &list[i]
+			}
+		}
+	}
+
+	for i := range workloads {
+		w := &workloads[i]
+		detail := w.Detail()
+		if hpa, ok := targets[w.Namespace+"/"+w.Name]; ok {
+			detail.HPA = hpaModel(hpa)
+		}
+		if status, ok := statuses[w.Namespace+"/"+w.Name]; ok {
+			detail.State = &models.PinStatus{
+				Replicas:          status.Replicas,
+				Reconcile:         status.Reconcile,
+				Paused:            status.Paused,
+				Time:              status.Time,
+				LastReconcileTime: status.LastReconcileTime,
+			}
+		}
+		details = append(details, detail)
+	}
+	return details, nil
+}
+
+// listHPAs returns the HorizontalPodAutoscalers of a namespace, all namespaces when namespace is empty. they are read
+// from the shared informer cache once it synced unless ?consistent=true asks for a live read, nil is returned when
+// listing them is forbidden
+func (h *KubernetesClient) listHPAs(req *http.Request, namespace string) ([]*autoscalingv1.HorizontalPodAutoscaler, error) {
+	consistent, err := boolQueryParam(req, ConsistentQueryParam)
+	if err != nil {
+		return nil, err
+	}
+	if h.InformerFactory != nil && (consistent == nil || !*consistent) {
+		informer := h.InformerFactory.Autoscaling().V1().HorizontalPodAutoscalers()
+		if informer.Informer().HasSynced() {
+			hpas, err := informer.Lister().HorizontalPodAutoscalers(namespace).List(labels.Everything())
+			if err != nil {
+				return nil, models.NewHTTPError(err, http.StatusInternalServerError, "error listing horizontal pod autoscalers")
+			}
+			return hpas, nil
+		}
+	}
+
+	list, err := h.Clientset.AutoscalingV1().HorizontalPodAutoscalers(namespace).List(req.Context(), metav1.ListOptions{})
+	if k8serrors.IsForbidden(err) {
+		klog.V(3).Infof("leaving out horizontal pod autoscalers of the full view: %v", err)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, models.NewHTTPError(err, http.StatusInternalServerError, "error listing horizontal pod autoscalers")
+	}
+	hpas := make([]*autoscalingv1.HorizontalPodAutoscaler, 0, len(list.Items))
+	for i := range list.Items {
+		hpas = append(hpas, &list.Items[i])
+	}
+	return hpas, nil
+}
+
+// hpaModel returns the API representation of a HorizontalPodAutoscaler, min replicas default to 1
+func hpaModel(hpa *autoscalingv1.HorizontalPodAutoscaler) *models.HPA {
+	minReplicas := int32(1)
+	if hpa.Spec.MinReplicas != nil {
+		minReplicas = *hpa.Spec.MinReplicas
+	}
+	return &models.HPA{
+		Name:            hpa.Name,
+		MinReplicas:     minReplicas,
+		MaxReplicas:     hpa.Spec.MaxReplicas,
+		CurrentReplicas: hpa.Status.CurrentReplicas,
+		DesiredReplicas: hpa.Status.DesiredReplicas,
+	}
+}
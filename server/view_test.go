@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/innovia/portal/server/models"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	coreV1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFullView(t *testing.T) {
+	ctx := context.Background()
+	transitionTime := metav1.NewTime(time.Date(2022, 8, 30, 4, 20, 11, 0, time.UTC))
+	minReplicas := int32(2)
+
+	api := newTestAPI(t)
+	clientSet := api.clientSet
+	replicas := int32(3)
+	web := createDeployment(t, clientSet, &replicas, "web", "prod", "nginx")
+	web.Generation = 4
+	web.Status = v1.DeploymentStatus{
+		ObservedGeneration: 4, Replicas: 4, ReadyReplicas: 3, AvailableReplicas: 2, UpdatedReplicas: 1,
+		Conditions: []v1.DeploymentCondition{{
+			Type: v1.DeploymentAvailable, Status: coreV1.ConditionTrue, Reason: "MinimumReplicasAvailable",
+			Message: "Deployment has minimum availability.", LastTransitionTime: transitionTime,
+		}},
+	}
+	if _, err := clientSet.AppsV1().Deployments("prod").UpdateStatus(ctx, web, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("error updating deployment status: %v", err)
+	}
+	createDeployment(t, clientSet, &replicas, "api", "prod", "nginx")
+	for _, hpa := range []*autoscalingv1.HorizontalPodAutoscaler{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "prod"},
+			Spec: autoscalingv1.HorizontalPodAutoscalerSpec{
+				ScaleTargetRef: autoscalingv1.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "web"},
+				MinReplicas:    &minReplicas,
+				MaxReplicas:    10,
+			},
+			Status: autoscalingv1.HorizontalPodAutoscalerStatus{CurrentReplicas: 3, DesiredReplicas: 4},
+		}, {
+			// a statefulset named like the deployment is not matched
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "prod"},
+			Spec: autoscalingv1.HorizontalPodAutoscalerSpec{
+				ScaleTargetRef: autoscalingv1.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "api"},
+				MaxReplicas:    5,
+			},
+		},
+	} {
+		if _, err := clientSet.AutoscalingV1().HorizontalPodAutoscalers("prod").Create(ctx, hpa, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("error creating hpa: %v", err)
+		}
+	}
+
+	if err := api.client.UpdateState(ctx, &models.Status{Deployment: models.Deployment{Name: "web", Namespace: "prod", Replicas: 3}, Reconcile: true}); err != nil {
+		t.Fatalf("error updating state: %v", err)
+	}
+	status, _ := api.client.ReadWorkloadState(ctx, "", "web", "prod")
+
+	expectedWeb := models.DeploymentDetail{
+		Deployment:     models.Deployment{Name: "web", Namespace: "prod", Replicas: 3},
+		StatusReplicas: 4, ReadyReplicas: 3, AvailableReplicas: 2, UpdatedReplicas: 1, Generation: 4, ObservedGeneration: 4,
+		Conditions: []models.Condition{{
+			Type: "Available", Status: "True", Reason: "MinimumReplicasAvailable",
+			Message: "Deployment has minimum availability.", LastTransitionTime: transitionTime.Time,
+		}},
+		HPA:   &models.HPA{Name: "web", MinReplicas: 2, MaxReplicas: 10, CurrentReplicas: 3, DesiredReplicas: 4},
+		State: &models.PinStatus{Replicas: 3, Reconcile: true, Time: status.Time.Round(0).UTC()},
+	}
+	expectedAPI := models.DeploymentDetail{Deployment: models.Deployment{Name: "api", Namespace: "prod", Replicas: 3}}
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		return api.serve(httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	testCases := []struct {
+		title, path  string
+		expectedCode int
+		expected     interface{}
+		actual       interface{}
+	}{
+		{
+			title:        "Should return the compact view by default",
+			path:         "/api/v1/namespaces/prod/deployments/web",
+			expectedCode: http.StatusOK,
+			expected:     &map[string]interface{}{"name": "web", "namespace": "prod", "replicas": float64(3)},
+			actual:       &map[string]interface{}{},
+		}, {
+			title:        "Should return the full view of a deployment",
+			path:         "/api/v1/namespaces/prod/deployments/web?view=full",
+			expectedCode: http.StatusOK,
+			expected:     &expectedWeb,
+			actual:       &models.DeploymentDetail{},
+		}, {
+			title:        "Should leave out the hpa and state of a deployment without them",
+			path:         "/api/v1/namespaces/prod/deployments/api?view=full",
+			expectedCode: http.StatusOK,
+			expected:     &expectedAPI,
+			actual:       &models.DeploymentDetail{},
+		}, {
+			title:        "Should return the full view of a list",
+			path:         "/api/v1/namespaces/prod/deployments?view=full&sort=name",
+			expectedCode: http.StatusOK,
+			expected:     &models.DeploymentDetails{Count: 2, Items: []models.DeploymentDetail{expectedAPI, expectedWeb}},
+			actual:       &models.DeploymentDetails{},
+		}, {
+			title:        "Should reject an unknown view",
+			path:         "/api/v1/namespaces/prod/deployments/web?view=wide",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			res := serve(c.path)
+			assert.Equal(t, c.expectedCode, res.Code)
+			if c.expected == nil {
+				return
+			}
+			assert.NoError(t, json.Unmarshal(res.Body.Bytes(), c.actual))
+			assert.Equal(t, c.expected, c.actual)
+		})
+	}
+}
+
+func TestFullViewHPAs(t *testing.T) {
+	testCases := []struct {
+		title, path   string
+		start         bool
+		listErr       error
+		expectedCode  int
+		expectedHPA   bool
+		expectedCalls int
+	}{
+		{
+			title:         "Should read the hpas from the cache",
+			path:          "/api/v1/namespaces/prod/deployments/web?view=full",
+			start:         true,
+			expectedCode:  http.StatusOK,
+			expectedHPA:   true,
+			expectedCalls: 0,
+		}, {
+			title:         "Should list the hpas live when consistent is set",
+			path:          "/api/v1/namespaces/prod/deployments/web?view=full&consistent=true",
+			start:         true,
+			expectedCode:  http.StatusOK,
+			expectedHPA:   true,
+			expectedCalls: 1,
+		}, {
+			title:         "Should list the hpas live before the cache synced",
+			path:          "/api/v1/namespaces/prod/deployments?view=full",
+			expectedCode:  http.StatusOK,
+			expectedHPA:   true,
+			expectedCalls: 1,
+		}, {
+			title:         "Should leave out the hpa when listing hpas is forbidden",
+			path:          "/api/v1/namespaces/prod/deployments/web?view=full",
+			listErr:       k8serrors.NewForbidden(autoscalingv1.Resource("horizontalpodautoscalers"), "", errors.New("rbac")),
+			expectedCode:  http.StatusOK,
+			expectedHPA:   false,
+			expectedCalls: 1,
+		}, {
+			title:         "Should fail when listing hpas fails",
+			path:          "/api/v1/namespaces/prod/deployments/web?view=full",
+			listErr:       k8serrors.NewInternalError(errors.New("etcd unavailable")),
+			expectedCode:  http.StatusInternalServerError,
+			expectedCalls: 1,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			api := newTestAPI(t)
+			clientSet := api.clientSet
+			replicas := int32(3)
+			createDeployment(t, clientSet, &replicas, "web", "prod", "nginx")
+			hpa := &autoscalingv1.HorizontalPodAutoscaler{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "prod"},
+				Spec: autoscalingv1.HorizontalPodAutoscalerSpec{
+					ScaleTargetRef: autoscalingv1.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "web"},
+					MaxReplicas:    5,
+				},
+			}
+			if _, err := clientSet.AutoscalingV1().HorizontalPodAutoscalers("prod").Create(context.Background(), hpa, metav1.CreateOptions{}); err != nil {
+				t.Fatalf("error creating hpa: %v", err)
+			}
+
+			// count the hpa lists that reach the API server, the reactor is added before the informers run
+			var mu sync.Mutex
+			calls := 0
+			clientSet.PrependReactor("list", "horizontalpodautoscalers", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				calls++
+				return c.listErr != nil, nil, c.listErr
+			})
+
+			api.client.InformerFactory = informers.NewSharedInformerFactory(clientSet, 0)
+			if c.start {
+				stopCh := make(chan struct{})
+				defer close(stopCh)
+				api.client.StartSharedInformers(stopCh)
+				if !cache.WaitForCacheSync(stopCh,
+					api.client.InformerFactory.Apps().V1().Deployments().Informer().HasSynced,
+					api.client.InformerFactory.Autoscaling().V1().HorizontalPodAutoscalers().Informer().HasSynced) {
+					t.Fatal("informer cache did not sync")
+				}
+			}
+			// the lists of the informers are not counted
+			mu.Lock()
+			calls = 0
+			mu.Unlock()
+
+			res := api.serve(httptest.NewRequest(http.MethodGet, c.path, nil))
+			assert.Equal(t, c.expectedCode, res.Code)
+			mu.Lock()
+			assert.Equal(t, c.expectedCalls, calls)
+			mu.Unlock()
+			if c.expectedCode != http.StatusOK {
+				return
+			}
+
+			body := res.Body.Bytes()
+			detail := models.DeploymentDetail{}
+			if strings.Contains(c.path, "/deployments?") {
+				list := models.DeploymentDetails{}
+				assert.NoError(t, json.Unmarshal(body, &list))
+				if assert.Len(t, list.Items, 1) {
+					detail = list.Items[0]
+				}
+			} else {
+				assert.NoError(t, json.Unmarshal(body, &detail))
+			}
+			if c.expectedHPA {
+				assert.Equal(t, &models.HPA{Name: "web", MinReplicas: 1, MaxReplicas: 5}, detail.HPA)
+			} else {
+				assert.Nil(t, detail.HPA)
+			}
+		})
+	}
+}
@@ -0,0 +1,397 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/innovia/portal/server/models"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/scale"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// resources that have a typed client, any other resource is scaled through the generic scale subresource client
+const (
+	ResourceDeployments  = "deployments"
+	ResourceStatefulSets = "statefulsets"
+)
+
+var (
+	deploymentsGroupResource  = schema.GroupResource{Group: "apps", Resource: ResourceDeployments}
+	statefulSetsGroupResource = schema.GroupResource{Group: "apps", Resource: ResourceStatefulSets}
+)
+
+// Workload is the scale view of a deployment, statefulset or a custom resource with a scale subresource
+type Workload struct {
+	Resource      string // Resource is empty for deployments, see NormalizeResource
+	Name          string
+	Namespace     string
+	Replicas      int32 // Replicas is the desired replicas from the workload spec
+	ReadyReplicas int32 // ReadyReplicas falls back to the status replicas for resources without ready replicas
+	UID           types.UID
+
+	// the live status of the full API view, only the status replicas are known for scale subresources
+	StatusReplicas     int32
+	AvailableReplicas  int32
+	UpdatedReplicas    int32
+	Generation         int64
+	ObservedGeneration int64
+	Conditions         []models.Condition
+}
+
+// Model returns the API representation of a workload
+func (w *Workload) Model() models.Deployment {
+	return models.Deployment{
+		Name:      w.Name,
+		Namespace: w.Namespace,
+		Replicas:  w.Replicas,
+		Resource:  w.Resource,
+	}
+}
+
+// Detail returns the full API view of a workload with its live status
+func (w *Workload) Detail() models.DeploymentDetail {
+	return models.DeploymentDetail{
+		Deployment:         w.Model(),
+		StatusReplicas:     w.StatusReplicas,
+		ReadyReplicas:      w.ReadyReplicas,
+		AvailableReplicas:  w.AvailableReplicas,
+		UpdatedReplicas:    w.UpdatedReplicas,
+		Generation:         w.Generation,
+		ObservedGeneration: w.ObservedGeneration,
+		Conditions:         w.Conditions,
+	}
+}
+
+// String returns the kind, namespace and name of the workload used in logs
+func (w *Workload) String() string {
+	return fmt.Sprintf("%s %s/%s", resourceKind(w.Resource), w.Namespace, w.Name)
+}
+
+// NormalizeResource returns the canonical resource name stored in state for an API path resource,
+// deployments are stored as an empty resource so state written before resources were supported stays valid,
+// statefulsets as statefulsets and any other resource as <resource>.<group>
+func NormalizeResource(resource string) (string, error) {
+	gr := schema.ParseGroupResource(strings.ToLower(resource))
+	switch {
+	case gr == schema.GroupResource{}:
+		return "", nil
+	case gr.Resource == ResourceDeployments && (gr.Group == "" || gr.Group == "apps"):
+		return "", nil
+	case gr.Resource == ResourceStatefulSets && (gr.Group == "" || gr.Group == "apps"):
+		return ResourceStatefulSets, nil
+	case gr.Group == "":
+		return "", fmt.Errorf("unsupported resource %s, use deployments, statefulsets or <resource>.<group> for resources with a scale subresource", resource)
+	}
+	return gr.String(), nil
+}
+
+// ResourcePath returns the API path segment of a normalized resource
+func ResourcePath(resource string) string {
+	if resource == "" {
+		return ResourceDeployments
+	}
+	return resource
+}
+
+// resourceKind returns the singular name of a normalized resource used in messages
+func resourceKind(resource string) string {
+	switch resource {
+	case "":
+		return "deployment"
+	case ResourceStatefulSets:
+		return "statefulset"
+	}
+	return resource
+}
+
+// GroupResource returns the group resource of a normalized resource
+func GroupResource(resource string) schema.GroupResource {
+	switch resource {
+	case "":
+		return deploymentsGroupResource
+	case ResourceStatefulSets:
+		return statefulSetsGroupResource
+	}
+	return schema.ParseGroupResource(resource)
+}
+
+// workloadClient reads and scales a single kind of workload
+type workloadClient interface {
+	Get(ctx context.Context, namespace, name string) (*Workload, error)
+	// List returns a page of workloads and the continue token of the next page, empty on the last page
+	List(ctx context.Context, namespace string, opts metav1.ListOptions) ([]Workload, string, error)
+	// Scale returns the scaled workload and the replicas before the scale
+	Scale(ctx context.Context, namespace, name string, replicas int32) (*Workload, int32, error)
+}
+
+// workloads returns the workload client for a normalized resource
+func (h *KubernetesClient) workloads(resource string) (workloadClient, error) {
+	switch resource {
+	case "":
+		return &deploymentWorkloads{client: h}, nil
+	case ResourceStatefulSets:
+		return &statefulSetWorkloads{client: h}, nil
+	}
+	if h.Scales == nil || h.Dynamic == nil || h.Mapper == nil {
+		return nil, fmt.Errorf("scaling %s requires the scale subresource client", resource)
+	}
+	return &scaleWorkloads{client: h, resource: GroupResource(resource)}, nil
+}
+
+// workloadsForRequest returns the normalized resource and workload client of the {resource} route variable,
+// routes without a resource variable are deployment routes
+func (h *KubernetesClient) workloadsForRequest(vars map[string]string) (string, workloadClient, error) {
+	resource, err := NormalizeResource(vars["resource"])
+	if err != nil {
+		return "", nil, models.NewHTTPError(err, http.StatusNotFound, "unsupported resource")
+	}
+	workloads, err := h.workloads(resource)
+	if err != nil {
+		return "", nil, models.NewHTTPError(err, http.StatusNotFound, "unsupported resource")
+	}
+	return resource, workloads, nil
+}
+
+// deploymentWorkloads is the workload client for apps/v1 deployments
+type deploymentWorkloads struct {
+	client *KubernetesClient
+}
+
+func (c *deploymentWorkloads) Get(ctx context.Context, namespace, name string) (*Workload, error) {
+	d, err := c.client.Clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return deploymentWorkload(d), nil
+}
+
+func (c *deploymentWorkloads) List(ctx context.Context, namespace string, opts metav1.ListOptions) ([]Workload, string, error) {
+	list, err := c.client.ListDeployments(ctx, namespace, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	workloads := make([]Workload, 0, len(list.Items))
+	for i := range list.Items {
+		workloads = append(workloads, *deploymentWorkload(&list.Items[i]))
+	}
+	return workloads, list.Continue, nil
+}
+
+func (c *deploymentWorkloads) Scale(ctx context.Context, namespace, name string, replicas int32) (*Workload, int32, error) {
+	scale, from, err := c.client.scaleDeployment(ctx, namespace, name, replicas)
+	if err != nil {
+		return nil, 0, err
+	}
+	return scaleWorkload("", scale), from, nil
+}
+
+// deploymentWorkload returns the workload view of a deployment
+func deploymentWorkload(d *appsv1.Deployment) *Workload {
+	w := &Workload{
+		Name:               d.Name,
+		Namespace:          d.Namespace,
+		Replicas:           replicasOf(d),
+		ReadyReplicas:      d.Status.ReadyReplicas,
+		UID:                d.UID,
+		StatusReplicas:     d.Status.Replicas,
+		AvailableReplicas:  d.Status.AvailableReplicas,
+		UpdatedReplicas:    d.Status.UpdatedReplicas,
+		Generation:         d.Generation,
+		ObservedGeneration: d.Status.ObservedGeneration,
+	}
+	for _, c := range d.Status.Conditions {
+		w.Conditions = append(w.Conditions, workloadCondition(string(c.Type), c.Status, c.Reason, c.Message, c.LastTransitionTime))
+	}
+	return w
+}
+
+// workloadCondition returns the API representation of a deployment or statefulset status condition
+func workloadCondition(conditionType string, status corev1.ConditionStatus, reason, message string, lastTransitionTime metav1.Time) models.Condition {
+	return models.Condition{
+		Type:               conditionType,
+		Status:             string(status),
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: lastTransitionTime.Time,
+	}
+}
+
+// statefulSetWorkloads is the workload client for apps/v1 statefulsets
+type statefulSetWorkloads struct {
+	client *KubernetesClient
+}
+
+func (c *statefulSetWorkloads) Get(ctx context.Context, namespace, name string) (*Workload, error) {
+	s, err := c.client.Clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return statefulSetWorkload(s), nil
+}
+
+func (c *statefulSetWorkloads) List(ctx context.Context, namespace string, opts metav1.ListOptions) ([]Workload, string, error) {
+	list, err := c.client.Clientset.AppsV1().StatefulSets(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, "", fmt.Errorf("error listing statefulsets: %w", err)
+	}
+	workloads := make([]Workload, 0, len(list.Items))
+	for i := range list.Items {
+		workloads = append(workloads, *statefulSetWorkload(&list.Items[i]))
+	}
+	return workloads, list.Continue, nil
+}
+
+func (c *statefulSetWorkloads) Scale(ctx context.Context, namespace, name string, replicas int32) (*Workload, int32, error) {
+	scale, from, err := updateScale(ctx, c.client.Clientset.AppsV1().StatefulSets(namespace), name, replicas)
+	if err != nil {
+		return nil, 0, err
+	}
+	return scaleWorkload(ResourceStatefulSets, scale), from, nil
+}
+
+// statefulSetWorkload returns the workload view of a statefulset
+func statefulSetWorkload(s *appsv1.StatefulSet) *Workload {
+	replicas := int32(1)
+	if s.Spec.Replicas != nil {
+		replicas = *s.Spec.Replicas
+	}
+	w := &Workload{
+		Resource:           ResourceStatefulSets,
+		Name:               s.Name,
+		Namespace:          s.Namespace,
+		Replicas:           replicas,
+		ReadyReplicas:      s.Status.ReadyReplicas,
+		UID:                s.UID,
+		StatusReplicas:     s.Status.Replicas,
+		AvailableReplicas:  s.Status.AvailableReplicas,
+		UpdatedReplicas:    s.Status.UpdatedReplicas,
+		Generation:         s.Generation,
+		ObservedGeneration: s.Status.ObservedGeneration,
+	}
+	for _, c := range s.Status.Conditions {
+		w.Conditions = append(w.Conditions, workloadCondition(string(c.Type), c.Status, c.Reason, c.Message, c.LastTransitionTime))
+	}
+	return w
+}
+
+// scaleWorkloads is the workload client for any resource that implements the scale subresource
+type scaleWorkloads struct {
+	client   *KubernetesClient
+	resource schema.GroupResource
+}
+
+func (c *scaleWorkloads) Get(ctx context.Context, namespace, name string) (*Workload, error) {
+	scale, err := c.scales(namespace).GetScale(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return scaleWorkload(c.resource.String(), scale), nil
+}
+
+func (c *scaleWorkloads) List(ctx context.Context, namespace string, opts metav1.ListOptions) ([]Workload, string, error) {
+	gvr, err := c.client.Mapper.ResourceFor(c.resource.WithVersion(""))
+	if err != nil {
+		return nil, "", fmt.Errorf("error resolving resource %s: %v", c.resource, err)
+	}
+
+	list, err := c.client.Dynamic.Resource(gvr).Namespace(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, "", fmt.Errorf("error listing %s: %w", c.resource, err)
+	}
+	workloads := make([]Workload, 0, len(list.Items))
+	for i := range list.Items {
+		workloads = append(workloads, *unstructuredWorkload(c.resource.String(), &list.Items[i]))
+	}
+	return workloads, list.GetContinue(), nil
+}
+
+func (c *scaleWorkloads) Scale(ctx context.Context, namespace, name string, replicas int32) (*Workload, int32, error) {
+	scale, from, err := updateScale(ctx, c.scales(namespace), name, replicas)
+	if err != nil {
+		return nil, 0, err
+	}
+	return scaleWorkload(c.resource.String(), scale), from, nil
+}
+
+func (c *scaleWorkloads) scales(namespace string) scaleInterface {
+	return &genericScales{scales: c.client.Scales.Scales(namespace), resource: c.resource}
+}
+
+// genericScales adapts the generic scale client of a resource to the typed GetScale and UpdateScale methods
+type genericScales struct {
+	scales   scale.ScaleInterface
+	resource schema.GroupResource
+}
+
+func (s *genericScales) GetScale(ctx context.Context, name string, options metav1.GetOptions) (*autoscalingv1.Scale, error) {
+	return s.scales.Get(ctx, s.resource, name, options)
+}
+
+func (s *genericScales) UpdateScale(ctx context.Context, _ string, scale *autoscalingv1.Scale, opts metav1.UpdateOptions) (*autoscalingv1.Scale, error) {
+	return s.scales.Update(ctx, s.resource, scale, opts)
+}
+
+// scaleWorkload returns the workload view of a scale subresource, the status replicas are used as ready replicas
+func scaleWorkload(resource string, scale *autoscalingv1.Scale) *Workload {
+	return &Workload{
+		Resource:       resource,
+		Name:           scale.Name,
+		Namespace:      scale.Namespace,
+		Replicas:       scale.Spec.Replicas,
+		ReadyReplicas:  scale.Status.Replicas,
+		UID:            scale.UID,
+		StatusReplicas: scale.Status.Replicas,
+	}
+}
+
+// unstructuredWorkload returns the workload view of a custom resource, the replicas are read from the
+// spec.replicas, status.readyReplicas and status.replicas fields used by most scalable resources and the full view
+// status from the status fields and conditions named like the ones of deployments
+func unstructuredWorkload(resource string, obj *unstructured.Unstructured) *Workload {
+	w := &Workload{
+		Resource:  resource,
+		Name:      obj.GetName(),
+		Namespace: obj.GetNamespace(),
+		UID:       obj.GetUID(),
+	}
+	if replicas, found, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas"); found {
+		w.Replicas = int32(replicas)
+	}
+	if ready, found, _ := unstructured.NestedInt64(obj.Object, "status", "readyReplicas"); found {
+		w.ReadyReplicas = int32(ready)
+	} else if replicas, found, _ := unstructured.NestedInt64(obj.Object, "status", "replicas"); found {
+		w.ReadyReplicas = int32(replicas)
+	}
+	replicas, _, _ := unstructured.NestedInt64(obj.Object, "status", "replicas")
+	available, _, _ := unstructured.NestedInt64(obj.Object, "status", "availableReplicas")
+	updated, _, _ := unstructured.NestedInt64(obj.Object, "status", "updatedReplicas")
+	w.StatusReplicas, w.AvailableReplicas, w.UpdatedReplicas = int32(replicas), int32(available), int32(updated)
+	w.Generation = obj.GetGeneration()
+	w.ObservedGeneration, _, _ = unstructured.NestedInt64(obj.Object, "status", "observedGeneration")
+
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, item := range conditions {
+		condition, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		c := models.Condition{}
+		c.Type, _, _ = unstructured.NestedString(condition, "type")
+		c.Status, _, _ = unstructured.NestedString(condition, "status")
+		c.Reason, _, _ = unstructured.NestedString(condition, "reason")
+		c.Message, _, _ = unstructured.NestedString(condition, "message")
+		if value, _, _ := unstructured.NestedString(condition, "lastTransitionTime"); value != "" {
+			c.LastTransitionTime, _ = time.Parse(time.RFC3339, value)
+		}
+		w.Conditions = append(w.Conditions, c)
+	}
+	return w
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/innovia/portal/server/models"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNormalizeResource(t *testing.T) {
+	testCases := []struct {
+		title, resource, expected string
+		expectError               bool
+	}{
+		{title: "Should store deployments without a resource", resource: "deployments", expected: ""},
+		{title: "Should accept the apps group for deployments", resource: "deployments.apps", expected: ""},
+		{title: "Should normalize statefulsets", resource: "StatefulSets.apps", expected: ResourceStatefulSets},
+		{title: "Should keep the group of custom resources", resource: "rollouts.argoproj.io", expected: "rollouts.argoproj.io"},
+		{title: "Should reject core resources without a group", resource: "pods", expectError: true},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			resource, err := NormalizeResource(c.resource)
+			if c.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, resource)
+		})
+	}
+}
+
+func TestScaleWorkloads(t *testing.T) {
+	testCases := []struct {
+		title, resource, name, namespace string
+		create                           func(t *testing.T, client *KubernetesClient)
+		replicas                         func(t *testing.T, client *KubernetesClient) int32
+	}{
+		{
+			title:     "Should scale a statefulset",
+			resource:  ResourceStatefulSets,
+			name:      "web",
+			namespace: "test",
+			create: func(t *testing.T, client *KubernetesClient) {
+				replicas := int32(1)
+				createStatefulSet(t, client.Clientset.(*fake.Clientset), &replicas, "web", "test", "nginx")
+			},
+			replicas: func(t *testing.T, client *KubernetesClient) int32 {
+				s, err := client.Clientset.AppsV1().StatefulSets("test").Get(context.Background(), "web", metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("error getting statefulset: %v", err)
+				}
+				return *s.Spec.Replicas
+			},
+		}, {
+			title:     "Should scale a custom resource through the scale subresource",
+			resource:  "rollouts.argoproj.io",
+			name:      "web",
+			namespace: "test",
+			create: func(t *testing.T, client *KubernetesClient) {
+				_, err := client.Dynamic.Resource(rolloutsResource).Namespace("test").Create(context.Background(), newRollout("web", "test", 1), metav1.CreateOptions{})
+				if err != nil {
+					t.Fatalf("error creating rollout: %v", err)
+				}
+			},
+			replicas: func(t *testing.T, client *KubernetesClient) int32 {
+				obj, err := client.Dynamic.Resource(rolloutsResource).Namespace("test").Get(context.Background(), "web", metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("error getting rollout: %v", err)
+				}
+				replicas, _, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+				return int32(replicas)
+			},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.title, func(t *testing.T) {
+			ctx := context.Background()
+			clientSet := newFakeClientset()
+			dynamicClient := newFakeDynamicClient()
+			client := KubernetesClient{
+				Clientset: clientSet,
+				Dynamic:   dynamicClient,
+				Scales:    newFakeScaleClient(dynamicClient),
+				Mapper:    newFakeRESTMapper(),
+				Namespace: "default",
+				State:     NewMemoryStateStore(),
+			}
+			c.create(t, &client)
+
+			// a deployment with the same name must not share state with the workload
+			deploymentReplicas := int32(2)
+			createDeployment(t, clientSet, &deploymentReplicas, c.name, c.namespace, "nginx")
+
+			server := createHttpTestServer(t, client, clientSet)
+			url := fmt.Sprintf("%s/api/v1/namespaces/%s/%s/%s/replicas/3/reconcile", server.URL, c.namespace, c.resource, c.name)
+			req, _ := http.NewRequest(http.MethodPut, url, nil)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("error scaling replicas: %v", err)
+			}
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			assert.Equal(t, int32(3), c.replicas(t, &client))
+
+			status, err := client.ReadWorkloadState(ctx, c.resource, c.name, c.namespace)
+			if err != nil {
+				t.Fatalf("error reading state: %v", err)
+			}
+			assert.Equal(t, c.resource, status.Resource)
+			assert.Equal(t, int32(3), status.Replicas)
+			assert.True(t, status.Reconcile)
+
+			deploymentStatus, err := client.ReadDeploymentState(ctx, c.name, c.namespace)
+			if err != nil {
+				t.Fatalf("error reading state: %v", err)
+			}
+			assert.Nil(t, deploymentStatus)
+
+			res, err = http.Get(fmt.Sprintf("%s/api/v1/namespaces/%s/%s", server.URL, c.namespace, c.resource))
+			if err != nil {
+				t.Fatalf("error listing %s: %v", c.resource, err)
+			}
+			defer res.Body.Close()
+			list := models.Deployments{}
+			if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+				t.Fatalf("error decoding list: %v", err)
+			}
+			assert.Equal(t, []models.Deployment{{Name: c.name, Namespace: c.namespace, Replicas: 3, Resource: c.resource}}, list.Items)
+		})
+	}
+}
+
+func TestScaleUnsupportedResource(t *testing.T) {
+	clientSet := newFakeClientset()
+	client := KubernetesClient{Clientset: clientSet, Namespace: "default"}
+	server := createHttpTestServer(t, client, clientSet)
+
+	for _, resource := range []string{"pods", "rollouts.argoproj.io"} {
+		req, _ := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/api/v1/namespaces/test/%s/web/replicas/3", server.URL, resource), nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error scaling replicas: %v", err)
+		}
+		assert.Equal(t, http.StatusNotFound, res.StatusCode, resource)
+	}
+}
+
+func TestReconcileStatefulSetDrift(t *testing.T) {
+	ctx := context.Background()
+	clientSet := newFakeClientset()
+	client := KubernetesClient{Clientset: clientSet, Namespace: "default", State: NewMemoryStateStore()}
+	desiredReplicas := int32(3)
+	createStatefulSet(t, clientSet, &desiredReplicas, "web", "test", "nginx")
+
+	status := &models.Status{
+		Deployment: models.Deployment{Name: "web", Namespace: "test", Replicas: desiredReplicas, Resource: ResourceStatefulSets},
+		Reconcile:  true,
+	}
+	if err := client.UpdateState(ctx, status); err != nil {
+		t.Fatalf("error updating state: %v", err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	r := client.NewReplicaReconcileWatcher(ctx, informers.NewSharedInformerFactory(clientSet, 0))
+	defer r.Queue.ShutDown()
+	if err := r.Run(ctx, stopCh); err != nil {
+		t.Fatalf("error running reconcile loop: %v", err)
+	}
+
+	// scale statefulset out of server scope and fake ready replicas
+	s, err := clientSet.AppsV1().StatefulSets("test").Get(ctx, "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting statefulset: %v", err)
+	}
+	driftReplicas := int32(5)
+	s.Spec.Replicas = &driftReplicas
+	s.Status.ReadyReplicas = driftReplicas
+	if _, err := clientSet.AppsV1().StatefulSets("test").Update(ctx, s, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("error scaling statefulset: %v", err)
+	}
+
+	err = wait.PollImmediate(50*time.Millisecond, 10*time.Second, func() (bool, error) {
+		s, err := clientSet.AppsV1().StatefulSets("test").Get(ctx, "web", metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return *s.Spec.Replicas == desiredReplicas, nil
+	})
+	if err != nil {
+		t.Fatalf("statefulset was not reconciled: %v", err)
+	}
+
+	// deleting the statefulset removes it from state
+	if err := clientSet.AppsV1().StatefulSets("test").Delete(ctx, "web", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("error deleting statefulset: %v", err)
+	}
+	err = wait.PollImmediate(50*time.Millisecond, 10*time.Second, func() (bool, error) {
+		status, err := client.ReadWorkloadState(ctx, ResourceStatefulSets, "web", "test")
+		return status == nil, err
+	})
+	if err != nil {
+		t.Fatalf("statefulset was not removed from state: %v", err)
+	}
+}